@@ -0,0 +1,229 @@
+package betproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the line format of the AccessLog
+type AccessLogFormat int
+
+const (
+	// AccessLogCommon is the Apache Common Log Format
+	AccessLogCommon AccessLogFormat = iota
+	// AccessLogCombined is the Apache Combined Log Format, the Common format with the referer and user agent
+	AccessLogCombined
+	// AccessLogSquid is the Squid native access.log format
+	AccessLogSquid
+	// AccessLogJSON writes every entry as a JSON object on a line
+	AccessLogJSON
+)
+
+// AccessLogEntry is a line of the access log
+type AccessLogEntry struct {
+	Time      time.Time     `json:"time"`
+	SessionID uint64        `json:"session"`
+	Client    string        `json:"client"`
+	User      string        `json:"user,omitempty"`
+	Method    string        `json:"method"`
+	URL       string        `json:"url"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"duration"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"userAgent,omitempty"`
+	// ContentType is the type of the response
+	ContentType string `json:"contentType,omitempty"`
+	TLS         bool   `json:"tls"`
+}
+
+// NewAccessLog create an AccessLog instance writing the giving format to w
+// Use a RotatingWriter to rotate the log files
+func NewAccessLog(w io.Writer, format AccessLogFormat) *AccessLog {
+	return &AccessLog{w: w, format: format}
+}
+
+// AccessLog writes a line for every request handled by the service
+// A nil *AccessLog is valid and writes nothing
+type AccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format AccessLogFormat
+}
+
+// SetAccessLog writes the requests into the access log
+func (s *Service) SetAccessLog(accessLog *AccessLog) {
+	s.accessLog = accessLog
+}
+
+// Write formats the entry and writes it as a line
+func (l *AccessLog) Write(entry *AccessLogEntry) error {
+	if l == nil {
+		return nil
+	}
+	var line []byte
+	switch l.format {
+	case AccessLogCombined:
+		line = appendCommon(nil, entry)
+		line = fmt.Appendf(line, " %s %s", quoteField(entry.Referer), quoteField(entry.UserAgent))
+	case AccessLogSquid:
+		line = appendSquid(nil, entry)
+	case AccessLogJSON:
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			return err
+		}
+	default:
+		line = appendCommon(nil, entry)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(line)
+	return err
+}
+
+// appendCommon appends the entry in the Common Log Format
+//
+//	127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://example.com/ HTTP/1.1" 200 2326
+func appendCommon(line []byte, entry *AccessLogEntry) []byte {
+	request := entry.Method + " " + entry.URL + " " + entry.Proto
+	return fmt.Appendf(line, "%s - %s [%s] %s %d %s",
+		clientHost(entry.Client),
+		orDash(entry.User),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(request),
+		entry.Status,
+		bytesField(entry.Bytes),
+	)
+}
+
+// appendSquid appends the entry in the Squid native format
+//
+//	1286536308.779    180 192.168.0.224 TCP_MISS/200 411 GET http://example.com/ - HIER_DIRECT/example.com text/html
+func appendSquid(line []byte, entry *AccessLogEntry) []byte {
+	action := "TCP_MISS"
+	hierarchy := "HIER_DIRECT/" + requestHost(entry)
+	switch {
+	case entry.Status == http.StatusProxyAuthRequired || entry.Status == http.StatusForbidden:
+		action = "TCP_DENIED"
+		hierarchy = "HIER_NONE/-"
+	case entry.Method == "CONNECT":
+		action = "TCP_TUNNEL"
+	}
+	bytes := entry.Bytes
+	if bytes < 0 {
+		bytes = 0
+	}
+	return fmt.Appendf(line, "%d.%03d %6d %s %s/%03d %d %s %s %s %s %s",
+		entry.Time.Unix(), entry.Time.Nanosecond()/int(time.Millisecond),
+		entry.Duration.Milliseconds(),
+		clientHost(entry.Client),
+		action, entry.Status,
+		bytes,
+		entry.Method,
+		entry.URL,
+		orDash(entry.User),
+		hierarchy,
+		orDash(entry.ContentType),
+	)
+}
+
+func requestHost(entry *AccessLogEntry) string {
+	if entry.Method == "CONNECT" {
+		return stripPort(entry.URL)
+	}
+	if u, err := url.Parse(entry.URL); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	return "-"
+}
+
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return orDash(addr)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func bytesField(n int64) string {
+	if n <= 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func quoteField(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// logAccess writes the request into the access log of the service
+// The header is of the response, it can be nil for the tunnels
+func (s *Session) logAccess(r *http.Request, status int, header http.Header, bytes int64, start time.Time) {
+	if s.service.accessLog == nil {
+		return
+	}
+	entry := &AccessLogEntry{
+		Time:      start,
+		SessionID: s.id,
+		Client:    s.conn.RemoteAddr().String(),
+		User:      s.user,
+		Method:    r.Method,
+		URL:       r.URL.String(),
+		Proto:     r.Proto,
+		Status:    status,
+		Bytes:     bytes,
+		Duration:  time.Since(start),
+		Referer:   r.Header.Get("Referer"),
+		UserAgent: r.Header.Get("User-Agent"),
+		TLS:       s.secure,
+	}
+	if r.Method == "CONNECT" {
+		entry.URL = r.Host
+	}
+	if header != nil {
+		entry.ContentType = header.Get("Content-Type")
+	}
+	if err := s.service.accessLog.Write(entry); err != nil {
+		s.log(r.Context(), slog.LevelError, "write access log failed", slog.Any("error", err))
+	}
+}
+
+// countBody replaces the response body to count the bytes sent to the client
+// It returns nil when neither the access log nor the logger is set
+func (s *Session) countBody(w *http.Response) *captureBody {
+	if (s.service.accessLog == nil && s.service.logger == nil) || w.Body == nil {
+		return nil
+	}
+	body := newCaptureBody(w.Body, 0, nil)
+	w.Body = body
+	return body
+}
+
+// sentBytes returns the bytes read from the counted body, or the Content-Length if it's not counted
+func sentBytes(body *captureBody, w *http.Response) int64 {
+	if body == nil {
+		return w.ContentLength
+	}
+	return body.size
+}
@@ -0,0 +1,132 @@
+package betproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newAccessLogEntry() *AccessLogEntry {
+	return &AccessLogEntry{
+		Time:        time.Date(2000, 10, 10, 13, 55, 36, 779000000, time.FixedZone("", -7*3600)),
+		SessionID:   1,
+		Client:      "127.0.0.1:10086",
+		User:        "frank",
+		Method:      "GET",
+		URL:         "http://example.com/index.html",
+		Proto:       "HTTP/1.1",
+		Status:      http.StatusOK,
+		Bytes:       2326,
+		Duration:    180 * time.Millisecond,
+		Referer:     "http://example.com/",
+		UserAgent:   "curl/8.0",
+		ContentType: "text/html",
+	}
+}
+
+func Test_AccessLogFormats(t *testing.T) {
+	cases := []struct {
+		format AccessLogFormat
+		line   string
+	}{
+		{AccessLogCommon, `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://example.com/index.html HTTP/1.1" 200 2326`},
+		{AccessLogCombined, `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://example.com/index.html HTTP/1.1" 200 2326 "http://example.com/" "curl/8.0"`},
+		{AccessLogSquid, `971211336.779    180 127.0.0.1 TCP_MISS/200 2326 GET http://example.com/index.html frank HIER_DIRECT/example.com text/html`},
+	}
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		if err := NewAccessLog(buf, c.format).Write(newAccessLogEntry()); err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		if buf.String() != c.line+"\n" {
+			t.Errorf("line must be\n%s\nbut got\n%s", c.line, buf.String())
+		}
+	}
+}
+
+func Test_AccessLogJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := NewAccessLog(buf, AccessLogJSON).Write(newAccessLogEntry()); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if !strings.HasSuffix(buf.String(), "}\n") || strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("entry must be a JSON line, but got %s", buf.String())
+	}
+	var entry AccessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if entry.URL != "http://example.com/index.html" || entry.Status != http.StatusOK || entry.Duration != 180*time.Millisecond {
+		t.Errorf("entry must be decoded, but got %+v", entry)
+	}
+}
+
+func Test_AccessLogSquidTunnel(t *testing.T) {
+	entry := newAccessLogEntry()
+	entry.Method = "CONNECT"
+	entry.URL = "example.com:443"
+	entry.User = ""
+	entry.ContentType = ""
+	line := string(appendSquid(nil, entry))
+	if !strings.Contains(line, "TCP_TUNNEL/200 2326 CONNECT example.com:443 - HIER_DIRECT/example.com -") {
+		t.Errorf("tunnel must be logged as TCP_TUNNEL, but got %s", line)
+	}
+
+	entry.Status = http.StatusProxyAuthRequired
+	line = string(appendSquid(nil, entry))
+	if !strings.Contains(line, "TCP_DENIED/407") || !strings.Contains(line, "HIER_NONE/-") {
+		t.Errorf("rejected request must be logged as TCP_DENIED, but got %s", line)
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func Test_AccessLogSession(t *testing.T) {
+	buf := &syncBuffer{}
+	client := ClientFunc(func(req *http.Request) (*http.Response, error) {
+		res := NewResponse(http.StatusOK, http.Header{"Content-Type": {"text/plain"}}, strings.NewReader("hello world"), req)
+		return res, nil
+	})
+	conn, session := newHookSession(client)
+	session.service.SetAccessLog(NewAccessLog(buf, AccessLogCombined))
+
+	go session.handleLoop()
+
+	fmt.Fprint(conn.Client, "GET http://example.com/get HTTP/1.1\r\nHost: example.com\r\nUser-Agent: test\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+
+	for i := 0; i < 100 && buf.String() == ""; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	line := buf.String()
+	// the chunked body is counted by the bytes sent
+	if !strings.HasPrefix(line, "127.0.0.1 - - [") || !strings.HasSuffix(line, `"GET http://example.com/get HTTP/1.1" 200 11 "-" "test"`+"\n") {
+		t.Errorf("request must be logged, but got %s", line)
+	}
+}
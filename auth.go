@@ -0,0 +1,252 @@
+package betproxy
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Authenticator authenticates the requests sent to the proxy
+type Authenticator interface {
+	// Authenticate returns the identity of the requester, ok is false if the credentials are missing or invalid
+	Authenticate(r *http.Request) (user string, ok bool)
+	// Challenge returns the Proxy-Authenticate header values of the 407 response
+	Challenge(r *http.Request) []string
+}
+
+// PasswordVerifier verifies the username and password
+// An Authenticator implementing it is also used to authenticate SOCKS5 clients
+type PasswordVerifier interface {
+	Verify(username, password string) bool
+}
+
+// BasicAuth authenticates the requests with the Basic scheme
+type BasicAuth struct {
+	realm  string
+	verify func(username, password string) bool
+}
+
+// NewBasicAuth create a BasicAuth instance
+// Use (*Htpasswd).Verify as verify to authenticate with htpasswd file
+func NewBasicAuth(realm string, verify func(username, password string) bool) *BasicAuth {
+	return &BasicAuth{realm: realm, verify: verify}
+}
+
+// Authenticate implements Authenticator
+func (a *BasicAuth) Authenticate(r *http.Request) (string, bool) {
+	scheme, credentials := proxyAuthorization(r)
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !a.verify(username, password) {
+		return "", false
+	}
+	return username, true
+}
+
+// Challenge implements Authenticator
+func (a *BasicAuth) Challenge(r *http.Request) []string {
+	return []string{fmt.Sprintf("Basic realm=%q", a.realm)}
+}
+
+// Verify implements PasswordVerifier
+func (a *BasicAuth) Verify(username, password string) bool {
+	return a.verify(username, password)
+}
+
+// DefaultNonceTTL is how long the nonce of DigestAuth is valid
+const DefaultNonceTTL = 5 * time.Minute
+
+// DigestAuth authenticates the requests with the Digest scheme using MD5 algorithm
+// https://tools.ietf.org/html/rfc7616
+type DigestAuth struct {
+	realm    string
+	ha1      func(username string) (string, bool)
+	secret   []byte
+	nonceTTL time.Duration
+}
+
+// NewDigestAuth create a DigestAuth instance
+// The ha1 returns the hex encoded MD5(username:realm:password) of the user, see DigestHA1 and (*Htdigest).HA1
+func NewDigestAuth(realm string, ha1 func(username string) (string, bool)) *DigestAuth {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &DigestAuth{realm: realm, ha1: ha1, secret: secret, nonceTTL: DefaultNonceTTL}
+}
+
+// SetNonceTTL sets how long the nonce is valid
+func (a *DigestAuth) SetNonceTTL(ttl time.Duration) {
+	a.nonceTTL = ttl
+}
+
+// DigestHA1 returns the hex encoded MD5(username:realm:password)
+func DigestHA1(username, realm, password string) string {
+	return md5Hex(username + ":" + realm + ":" + password)
+}
+
+// Authenticate implements Authenticator
+func (a *DigestAuth) Authenticate(r *http.Request) (string, bool) {
+	scheme, credentials := proxyAuthorization(r)
+	if !strings.EqualFold(scheme, "Digest") {
+		return "", false
+	}
+	params := parseAuthParams(credentials)
+	username := params["username"]
+
+	if params["realm"] != a.realm || params["uri"] != r.RequestURI {
+		return "", false
+	}
+	if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return "", false
+	}
+	if valid, stale := a.checkNonce(params["nonce"]); !valid || stale {
+		return "", false
+	}
+	ha1, ok := a.ha1(username)
+	if !ok {
+		return "", false
+	}
+
+	ha2 := md5Hex(r.Method + ":" + params["uri"])
+	var expected string
+	switch params["qop"] {
+	case "":
+		expected = md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	case "auth":
+		expected = md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+	default:
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(params["response"])) != 1 {
+		return "", false
+	}
+	return username, true
+}
+
+// Challenge implements Authenticator
+func (a *DigestAuth) Challenge(r *http.Request) []string {
+	challenge := fmt.Sprintf("Digest realm=%q, qop=\"auth\", algorithm=MD5, nonce=%q", a.realm, a.newNonce(time.Now()))
+	if scheme, credentials := proxyAuthorization(r); strings.EqualFold(scheme, "Digest") {
+		if valid, stale := a.checkNonce(parseAuthParams(credentials)["nonce"]); valid && stale {
+			challenge += ", stale=true"
+		}
+	}
+	return []string{challenge}
+}
+
+// newNonce returns base64(timestamp + HMAC(timestamp)), so the nonce can be verified without state
+func (a *DigestAuth) newNonce(now time.Time) string {
+	b := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(now.UnixNano()))
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b))
+}
+
+func (a *DigestAuth) checkNonce(nonce string) (valid, stale bool) {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false, false
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil), b[8:]) {
+		return false, false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))
+	return true, time.Since(issued) > a.nonceTTL
+}
+
+// MultiAuth accepts the request if any of the authenticators accepts it
+type MultiAuth []Authenticator
+
+// Authenticate implements Authenticator
+func (m MultiAuth) Authenticate(r *http.Request) (string, bool) {
+	for _, auth := range m {
+		if user, ok := auth.Authenticate(r); ok {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// Challenge implements Authenticator
+func (m MultiAuth) Challenge(r *http.Request) []string {
+	var challenges []string
+	for _, auth := range m {
+		challenges = append(challenges, auth.Challenge(r)...)
+	}
+	return challenges
+}
+
+// Verify implements PasswordVerifier with the first authenticator implementing it
+func (m MultiAuth) Verify(username, password string) bool {
+	for _, auth := range m {
+		if verifier, ok := auth.(PasswordVerifier); ok {
+			return verifier.Verify(username, password)
+		}
+	}
+	return false
+}
+
+func proxyAuthorization(r *http.Request) (scheme, credentials string) {
+	scheme, credentials, _ = strings.Cut(strings.TrimSpace(r.Header.Get("Proxy-Authorization")), " ")
+	return scheme, strings.TrimSpace(credentials)
+}
+
+// parseAuthParams parses the comma separated key=value or key="value" pairs
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " ")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var sb strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				sb.WriteByte(rest[i])
+			}
+			value = sb.String()
+			if i < len(rest) {
+				i++
+			}
+			s = rest[i:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,227 @@
+package betproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func userEchoClient() Client {
+	return ClientFunc(func(req *http.Request) (*http.Response, error) {
+		user, _ := UserFromContext(req.Context())
+		return HTTPText(http.StatusOK, http.Header{"X-Proxy-Authorization": req.Header["Proxy-Authorization"]}, user, req), nil
+	})
+}
+
+func newAuthSession(auth Authenticator) (*FakeConn, *bufio.Reader) {
+	conn := NewFakeConn()
+	service := &Service{client: userEchoClient()}
+	service.SetAuthenticator(auth)
+	session := &Session{service: service, conn: conn.Server}
+	go session.serve()
+	return conn, bufio.NewReader(conn.Client)
+}
+
+func basicCredentials(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func verifyFaceair(username, password string) bool {
+	return username == "faceair" && password == "secret"
+}
+
+func Test_BasicAuthSession(t *testing.T) {
+	conn, reader := newAuthSession(NewBasicAuth("betproxy", verifyFaceair))
+	defer conn.Client.Close()
+
+	conn.Client.Write([]byte("POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody"))
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("res.StatusCode must be 407, but got %d", res.StatusCode)
+	}
+	if got := res.Header.Get("Proxy-Authenticate"); got != `Basic realm="betproxy"` {
+		t.Errorf("challenge not match, got %s", got)
+	}
+
+	fmt.Fprintf(conn.Client, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: %s\r\n\r\n", basicCredentials("faceair", "wrong"))
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("res.StatusCode must be 407, but got %d", res.StatusCode)
+	}
+
+	fmt.Fprintf(conn.Client, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: %s\r\n\r\n", basicCredentials("faceair", "secret"))
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "faceair" {
+		t.Errorf("user must be faceair, but got %s", body)
+	}
+	if res.Header.Get("X-Proxy-Authorization") != "" {
+		t.Error("Proxy-Authorization must not be forwarded")
+	}
+}
+
+func Test_BasicAuthConnect(t *testing.T) {
+	conn, reader := newAuthSession(NewBasicAuth("betproxy", verifyFaceair))
+	defer conn.Client.Close()
+
+	fmt.Fprintf(conn.Client, "CONNECT example.com:80 HTTP/1.1\r\nHost: example.com:80\r\nProxy-Authorization: %s\r\n\r\n", basicCredentials("faceair", "secret"))
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("res.StatusCode must be 200, but got %d", res.StatusCode)
+	}
+
+	// the requests in the authenticated tunnel don't carry credentials
+	conn.Client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "faceair" {
+		t.Errorf("user must be faceair, but got %s", body)
+	}
+}
+
+func digestCredentials(challenge, method, uri, username, password string) string {
+	params := parseAuthParams(strings.TrimPrefix(challenge, "Digest "))
+	ha1 := DigestHA1(username, params["realm"], password)
+	ha2 := md5Hex(method + ":" + uri)
+	response := md5Hex(strings.Join([]string{ha1, params["nonce"], "00000001", "0a4f113b", "auth", ha2}, ":"))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", qop=auth, nc=00000001, cnonce="0a4f113b", response="%s", algorithm=MD5`,
+		username, params["realm"], params["nonce"], uri, response)
+}
+
+func Test_DigestAuthSession(t *testing.T) {
+	auth := NewDigestAuth("betproxy", func(username string) (string, bool) {
+		if username != "faceair" {
+			return "", false
+		}
+		return DigestHA1("faceair", "betproxy", "secret"), true
+	})
+	conn, reader := newAuthSession(auth)
+	defer conn.Client.Close()
+
+	conn.Client.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	challenge := res.Header.Get("Proxy-Authenticate")
+	if !strings.HasPrefix(challenge, "Digest ") {
+		t.Fatalf("challenge must be Digest, but got %s", challenge)
+	}
+
+	credentials := digestCredentials(challenge, "GET", "http://example.com/", "faceair", "wrong")
+	fmt.Fprintf(conn.Client, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: %s\r\n\r\n", credentials)
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("res.StatusCode must be 407, but got %d", res.StatusCode)
+	}
+
+	credentials = digestCredentials(challenge, "GET", "http://example.com/", "faceair", "secret")
+	fmt.Fprintf(conn.Client, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: %s\r\n\r\n", credentials)
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "faceair" {
+		t.Errorf("user must be faceair, but got %s", body)
+	}
+}
+
+func Test_DigestAuthStaleNonce(t *testing.T) {
+	auth := NewDigestAuth("betproxy", func(username string) (string, bool) {
+		return DigestHA1("faceair", "betproxy", "secret"), true
+	})
+	auth.SetNonceTTL(-time.Second)
+
+	r, _ := http.NewRequest("GET", "http://example.com/", nil)
+	r.RequestURI = "http://example.com/"
+	challenge := auth.Challenge(r)[0]
+	r.Header.Set("Proxy-Authorization", digestCredentials(challenge, "GET", "http://example.com/", "faceair", "secret"))
+
+	if _, ok := auth.Authenticate(r); ok {
+		t.Error("stale nonce must be rejected")
+	}
+	if !strings.HasSuffix(auth.Challenge(r)[0], "stale=true") {
+		t.Error("challenge must be stale")
+	}
+}
+
+func Test_MultiAuth(t *testing.T) {
+	auth := MultiAuth{
+		NewDigestAuth("betproxy", func(username string) (string, bool) { return "", false }),
+		NewBasicAuth("betproxy", verifyFaceair),
+	}
+
+	r, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if challenges := auth.Challenge(r); len(challenges) != 2 {
+		t.Errorf("must have 2 challenges, but got %d", len(challenges))
+	}
+	r.Header.Set("Proxy-Authorization", basicCredentials("faceair", "secret"))
+	if user, ok := auth.Authenticate(r); !ok || user != "faceair" {
+		t.Errorf("user must be faceair, but got %s", user)
+	}
+	if !auth.Verify("faceair", "secret") {
+		t.Error("verify must use the basic auth")
+	}
+}
+
+func Test_SOCKSWithAuthenticator(t *testing.T) {
+	conn := NewFakeConn()
+	service := &Service{client: userEchoClient()}
+	service.EnableSOCKS(true)
+	service.SetAuthenticator(NewBasicAuth("betproxy", verifyFaceair))
+	session := &Session{service: service, conn: conn.Server}
+	go session.serve()
+	defer conn.Client.Close()
+
+	conn.Client.Write([]byte{socks5Version, 1, socks5AuthPassword})
+	readExactly(t, conn.Client, []byte{socks5Version, socks5AuthPassword})
+	conn.Client.Write([]byte("\x01\x07faceair\x06secret"))
+	readExactly(t, conn.Client, []byte{0x01, 0x00})
+	conn.Client.Write(socks5Request("example.com", 80))
+	readExactly(t, conn.Client, []byte{socks5Version, socks5Succeeded, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+
+	conn.Client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "faceair" {
+		t.Errorf("user must be faceair, but got %s", body)
+	}
+}
+
+func Test_ParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`username="fa\"ce", qop=auth, nc=00000001 , realm="a,b"`)
+	if params["username"] != `fa"ce` || params["qop"] != "auth" || params["nc"] != "00000001" || params["realm"] != "a,b" {
+		t.Errorf("params not match, got %v", params)
+	}
+}
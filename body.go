@@ -0,0 +1,92 @@
+package betproxy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// captureBody keeps the first limit bytes read from the body
+// onDone is called once the body reaches EOF, fails or is closed, eof tells whether it was read completely
+// The captured state is frozen once the body is done or detached, so it can be read from the other goroutines
+type captureBody struct {
+	io.ReadCloser
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int64
+	size      int64
+	truncated bool
+	eof       bool
+	err       error
+	finished  bool
+	onDone    func(c *captureBody)
+}
+
+func newCaptureBody(body io.ReadCloser, limit int64, onDone func(c *captureBody)) *captureBody {
+	return &captureBody{ReadCloser: body, limit: limit, onDone: onDone}
+}
+
+func (c *captureBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finished {
+		return n, err
+	}
+	if n > 0 {
+		c.size += int64(n)
+		if remain := c.limit - int64(c.buf.Len()); remain > 0 {
+			if int64(n) > remain {
+				c.buf.Write(p[:remain])
+				c.truncated = true
+			} else {
+				c.buf.Write(p[:n])
+			}
+		} else {
+			c.truncated = true
+		}
+	}
+	if err != nil {
+		if err == io.EOF {
+			c.eof = true
+		} else {
+			c.err = err
+		}
+		c.done()
+	}
+	return n, err
+}
+
+func (c *captureBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.finished {
+		c.done()
+	}
+	return err
+}
+
+// done freezes the captured state and calls onDone, c.mu must be held
+func (c *captureBody) done() {
+	c.finished = true
+	if c.onDone != nil {
+		c.onDone(c)
+	}
+}
+
+// detach freezes the captured state without calling onDone, the body is still readable
+// It reports whether the body was done before, the state is incomplete otherwise
+func (c *captureBody) detach() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	done := c.finished
+	c.finished = true
+	return done
+}
+
+// Bytes returns the captured data
+func (c *captureBody) Bytes() []byte {
+	return c.buf.Bytes()
+}
@@ -0,0 +1,41 @@
+package betproxy
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func Test_CaptureBody(t *testing.T) {
+	done := 0
+	body := newCaptureBody(ioutil.NopCloser(strings.NewReader("hello world")), 5, func(c *captureBody) {
+		done++
+	})
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	if string(data) != "hello world" {
+		t.Errorf("data must be hello world, but got %s", data)
+	}
+	body.Close()
+
+	if done != 1 {
+		t.Errorf("onDone must be called once, but got %d", done)
+	}
+	if string(body.Bytes()) != "hello" || !body.truncated || body.size != 11 {
+		t.Errorf("captured must be hello truncated from 11, but got %s %v %d", body.Bytes(), body.truncated, body.size)
+	}
+}
+
+func Test_CaptureBodyClose(t *testing.T) {
+	done := 0
+	body := newCaptureBody(ioutil.NopCloser(strings.NewReader("hello")), 5, func(c *captureBody) {
+		done++
+	})
+	body.Close()
+	if done != 1 {
+		t.Errorf("onDone must be called on Close, but got %d", done)
+	}
+}
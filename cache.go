@@ -0,0 +1,506 @@
+package betproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxCacheBodySize is the max size of the responses stored by the Cache
+const DefaultMaxCacheBodySize = 10 << 20
+
+// maxCacheVariants is the max number of the Vary variants kept for a uri, the oldest ones are dropped
+const maxCacheVariants = 32
+
+// Cache is a shared HTTP cache following RFC 9111
+// https://www.rfc-editor.org/rfc/rfc9111
+type Cache struct {
+	storage     CacheStorage
+	maxBodySize int64
+	now         func() time.Time
+
+	mu         sync.Mutex
+	refreshing map[string]bool
+}
+
+// NewCache create a Cache instance which stores the responses in storage
+func NewCache(storage CacheStorage) *Cache {
+	return &Cache{
+		storage:     storage,
+		maxBodySize: DefaultMaxCacheBodySize,
+		now:         time.Now,
+		refreshing:  make(map[string]bool),
+	}
+}
+
+// SetMaxBodySize sets the max size of the responses to store, the larger ones are passed through
+func (c *Cache) SetMaxBodySize(size int64) {
+	c.maxBodySize = size
+}
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	Status       int               `json:"status"`
+	Header       http.Header       `json:"header"`
+	Body         []byte            `json:"body"`
+	Vary         map[string]string `json:"vary,omitempty"`
+	RequestTime  time.Time         `json:"requestTime"`
+	ResponseTime time.Time         `json:"responseTime"`
+	Variants     *cacheVariants    `json:"variants,omitempty"`
+}
+
+// cacheVariants is stored under the uri instead of the response when it has a Vary header
+// Every variant is stored under a key made of the uri and the normalized values of the Vary headers
+type cacheVariants struct {
+	Names []string `json:"names"`
+	Keys  []string `json:"keys"`
+}
+
+// Middleware serves the requests from the cache and stores the cacheable responses
+func (c *Cache) Middleware(next Client) Client {
+	return ClientFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method != http.MethodGet {
+			res, err := next.Do(req)
+			if err == nil && !isSafeMethod(req.Method) && res.StatusCode < 400 {
+				c.invalidate(req, res)
+			}
+			return res, err
+		}
+
+		reqCC := parseCacheControl(req.Header)
+		if _, ok := reqCC["no-store"]; ok {
+			return next.Do(req)
+		}
+
+		key := req.URL.String()
+		entry := c.load(key)
+		if entry != nil && entry.Variants != nil {
+			key = varyKey(key, entry.Variants.Names, req.Header)
+			entry = c.load(key)
+		}
+		if entry == nil || !entry.matchVary(req) {
+			return c.fetch(next, req)
+		}
+
+		age := entry.age(c.now())
+		lifetime := entry.freshnessLifetime()
+		resCC := parseCacheControl(entry.Header)
+		_, noCache := resCC["no-cache"]
+		_, reqNoCache := reqCC["no-cache"]
+		if req.Header.Get("Pragma") == "no-cache" && req.Header.Get("Cache-Control") == "" {
+			reqNoCache = true
+		}
+		if maxAge, ok := cacheControlSeconds(reqCC, "max-age"); ok && age > maxAge {
+			reqNoCache = true
+		}
+
+		if !noCache && !reqNoCache {
+			if age < lifetime {
+				return entry.response(req, age), nil
+			}
+			_, mustRevalidate := resCC["must-revalidate"]
+			_, proxyRevalidate := resCC["proxy-revalidate"]
+			if swr, ok := cacheControlSeconds(resCC, "stale-while-revalidate"); ok && !mustRevalidate && !proxyRevalidate && age < lifetime+swr {
+				res := entry.response(req, age)
+				c.refresh(next, key, req, entry)
+				return res, nil
+			}
+		}
+		return c.revalidate(next, key, req, entry)
+	})
+}
+
+// fetch forwards the request and stores the response when it's cacheable
+func (c *Cache) fetch(next Client, req *http.Request) (*http.Response, error) {
+	requestTime := c.now()
+	res, err := next.Do(req)
+	if err != nil {
+		return res, err
+	}
+	c.store(req, res, requestTime)
+	return res, nil
+}
+
+// revalidate sends a conditional request, a 304 response refreshes the stored entry
+func (c *Cache) revalidate(next Client, key string, req *http.Request, entry *cacheEntry) (*http.Response, error) {
+	conditional := req.Clone(req.Context())
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	requestTime := c.now()
+	res, err := next.Do(conditional)
+	if err != nil {
+		return res, err
+	}
+	if res.StatusCode != http.StatusNotModified {
+		c.store(req, res, requestTime)
+		return res, nil
+	}
+	res.Body.Close()
+
+	for name, values := range res.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range":
+			continue
+		}
+		entry.Header[name] = values
+	}
+	entry.RequestTime = requestTime
+	entry.ResponseTime = c.now()
+	c.save(key, entry)
+	return entry.response(req, entry.age(c.now())), nil
+}
+
+// refresh revalidates the stale entry in the background, at most once per key at a time
+func (c *Cache) refresh(next Client, key string, req *http.Request, entry *cacheEntry) {
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	c.mu.Unlock()
+
+	background := req.Clone(context.Background())
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, key)
+			c.mu.Unlock()
+		}()
+		res, err := c.revalidate(next, key, background, entry)
+		if err != nil {
+			return
+		}
+		// drain the body so the response is stored
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+}
+
+// store saves the response once its body is fully read
+func (c *Cache) store(req *http.Request, res *http.Response, requestTime time.Time) {
+	if !c.cacheable(req, res) {
+		return
+	}
+	if res.ContentLength > c.maxBodySize {
+		return
+	}
+
+	entry := &cacheEntry{
+		Status:       res.StatusCode,
+		Header:       res.Header.Clone(),
+		RequestTime:  requestTime,
+		ResponseTime: c.now(),
+	}
+	if entry.freshnessLifetime() <= 0 && entry.Header.Get("ETag") == "" && entry.Header.Get("Last-Modified") == "" {
+		return
+	}
+	var names []string
+	for _, value := range res.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if entry.Vary == nil {
+				entry.Vary = make(map[string]string)
+			}
+			if _, ok := entry.Vary[name]; !ok {
+				entry.Vary[name] = normalizeVaryValue(req.Header.Values(name))
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	res.Body = newCaptureBody(res.Body, c.maxBodySize, func(body *captureBody) {
+		if body.err != nil || body.truncated {
+			return
+		}
+		if res.ContentLength >= 0 && body.size != res.ContentLength {
+			return
+		}
+		entry.Body = body.Bytes()
+		entry.ResponseTime = c.now()
+		c.saveVariant(req.URL.String(), names, req.Header, entry)
+	})
+}
+
+// cacheable reports whether the response may be stored by a shared cache
+func (c *Cache) cacheable(req *http.Request, res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusPermanentRedirect, http.StatusNotFound, http.StatusMethodNotAllowed,
+		http.StatusGone, http.StatusRequestURITooLong, http.StatusNotImplemented:
+	default:
+		return false
+	}
+
+	cc := parseCacheControl(res.Header)
+	for _, directive := range []string{"no-store", "private"} {
+		if _, ok := cc[directive]; ok {
+			return false
+		}
+	}
+	if strings.TrimSpace(res.Header.Get("Vary")) == "*" {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" {
+		_, public := cc["public"]
+		_, sMaxAge := cc["s-maxage"]
+		_, mustRevalidate := cc["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return false
+		}
+	}
+	return true
+}
+
+// invalidate removes the entries of the target uri after an unsafe request
+func (c *Cache) invalidate(req *http.Request, res *http.Response) {
+	c.delete(req.URL.String())
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := res.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		location, err := req.URL.Parse(value)
+		if err != nil || location.Host != req.URL.Host {
+			continue
+		}
+		c.delete(location.String())
+	}
+}
+
+// saveVariant saves the entry of the uri, the variant is added to the list stored under the uri when names is not empty
+func (c *Cache) saveVariant(uri string, names []string, header http.Header, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stored := c.load(uri)
+	if len(names) == 0 {
+		if stored != nil && stored.Variants != nil {
+			c.deleteVariants(stored.Variants.Keys)
+		}
+		c.save(uri, entry)
+		return
+	}
+
+	variants := &cacheVariants{Names: names}
+	if stored != nil && stored.Variants != nil && equalStrings(stored.Variants.Names, names) {
+		variants = stored.Variants
+	} else if stored != nil && stored.Variants != nil {
+		c.deleteVariants(stored.Variants.Keys)
+	}
+	key := varyKey(uri, names, header)
+	keys := []string{key}
+	for _, k := range variants.Keys {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) > maxCacheVariants {
+		c.deleteVariants(keys[maxCacheVariants:])
+		keys = keys[:maxCacheVariants]
+	}
+	variants.Keys = keys
+
+	c.save(key, entry)
+	c.save(uri, &cacheEntry{Variants: variants})
+}
+
+// delete removes the entry of the uri with all its variants
+func (c *Cache) delete(uri string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stored := c.load(uri); stored != nil && stored.Variants != nil {
+		c.deleteVariants(stored.Variants.Keys)
+	}
+	c.storage.Delete(uri)
+}
+
+func (c *Cache) deleteVariants(keys []string) {
+	for _, key := range keys {
+		c.storage.Delete(key)
+	}
+}
+
+func (c *Cache) load(key string) *cacheEntry {
+	data, ok := c.storage.Get(key)
+	if !ok {
+		return nil
+	}
+	entry := new(cacheEntry)
+	if err := json.Unmarshal(data, entry); err != nil {
+		c.storage.Delete(key)
+		return nil
+	}
+	return entry
+}
+
+func (c *Cache) save(key string, entry *cacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	c.storage.Set(key, data)
+}
+
+// matchVary reports whether the request selects the stored variant
+func (e *cacheEntry) matchVary(req *http.Request) bool {
+	for name, value := range e.Vary {
+		if normalizeVaryValue(req.Header.Values(name)) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// age calculates the current age of the entry
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.2.3
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil && e.ResponseTime.After(date) {
+		apparentAge = e.ResponseTime.Sub(date)
+	}
+	ageValue := time.Duration(0)
+	if seconds, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(e.ResponseTime)
+}
+
+// freshnessLifetime calculates how long the entry is fresh
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.2.1
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if seconds, ok := cacheControlSeconds(cc, "s-maxage"); ok {
+		return seconds
+	}
+	if seconds, ok := cacheControlSeconds(cc, "max-age"); ok {
+		return seconds
+	}
+
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = e.ResponseTime
+	}
+	if expiresValue := e.Header.Get("Expires"); expiresValue != "" {
+		expires, err := http.ParseTime(expiresValue)
+		if err != nil || expires.Before(date) {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+
+	// heuristic freshness is 10% of the time since the last modification
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && date.After(lastModified) {
+		return date.Sub(lastModified) / 10
+	}
+	return 0
+}
+
+// response builds the response served from the entry
+func (e *cacheEntry) response(req *http.Request, age time.Duration) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	res := NewResponse(e.Status, header, bytes.NewReader(e.Body), req)
+	res.ContentLength = int64(len(e.Body))
+	return res
+}
+
+// parseCacheControl parses the Cache-Control header into lowercase directives
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, arg = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			directives[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	return directives
+}
+
+func cacheControlSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// varyKey returns the storage key of the variant selected by the header
+func varyKey(uri string, names []string, header http.Header) string {
+	var key strings.Builder
+	key.WriteString(uri)
+	for _, name := range names {
+		key.WriteString("\n")
+		key.WriteString(name)
+		key.WriteString(": ")
+		key.WriteString(normalizeVaryValue(header.Values(name)))
+	}
+	return key.String()
+}
+
+// normalizeVaryValue combines the header lines and trims the spaces around the list members
+// https://www.rfc-editor.org/rfc/rfc9111#section-4.1
+func normalizeVaryValue(values []string) string {
+	var members []string
+	for _, value := range values {
+		for _, member := range strings.Split(value, ",") {
+			if member = strings.TrimSpace(member); member != "" {
+				members = append(members, member)
+			}
+		}
+	}
+	return strings.Join(members, ",")
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
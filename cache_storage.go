@@ -0,0 +1,250 @@
+package betproxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStorage is the backend of the Cache
+type CacheStorage interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(key string)
+}
+
+// MemoryStorage is a CacheStorage keeping the least recently used entries in memory
+type MemoryStorage struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	value []byte
+}
+
+// NewMemoryStorage create a MemoryStorage instance holding at most maxSize bytes
+func NewMemoryStorage(maxSize int64) *MemoryStorage {
+	return &MemoryStorage{
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value and marks it as recently used
+func (m *MemoryStorage) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.ll.MoveToFront(elem)
+	return elem.Value.(*memoryItem).value, true
+}
+
+// Set stores the value and evicts the least recently used ones when it's full
+func (m *MemoryStorage) Set(key string, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if int64(len(value)) > m.maxSize {
+		m.remove(key)
+		return
+	}
+	if elem, ok := m.items[key]; ok {
+		item := elem.Value.(*memoryItem)
+		m.size += int64(len(value) - len(item.value))
+		item.value = value
+		m.ll.MoveToFront(elem)
+	} else {
+		m.items[key] = m.ll.PushFront(&memoryItem{key: key, value: value})
+		m.size += int64(len(value))
+	}
+	for m.size > m.maxSize {
+		m.remove(m.ll.Back().Value.(*memoryItem).key)
+	}
+}
+
+// Delete removes the value
+func (m *MemoryStorage) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+}
+
+// Len returns the number of the stored values
+func (m *MemoryStorage) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ll.Len()
+}
+
+func (m *MemoryStorage) remove(key string) {
+	elem, ok := m.items[key]
+	if !ok {
+		return
+	}
+	m.ll.Remove(elem)
+	delete(m.items, key)
+	m.size -= int64(len(elem.Value.(*memoryItem).value))
+}
+
+// DiskStorage is a CacheStorage keeping every entry in a file under the directory
+// The least recently used files are removed when the total size exceeds maxSize
+type DiskStorage struct {
+	dir     string
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+}
+
+type diskItem struct {
+	name string
+	size int64
+}
+
+// NewDiskStorage create a DiskStorage instance holding at most maxSize bytes, the directory is created if not exist
+// The files left in the directory are kept, the least recently modified ones are evicted first
+func NewDiskStorage(dir string, maxSize int64) (*DiskStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	d := &DiskStorage{
+		dir:     dir,
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(file.Name(), ".tmp-") {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		d.items[file.Name()] = d.ll.PushFront(&diskItem{name: file.Name(), size: file.Size()})
+		d.size += file.Size()
+	}
+	d.evict()
+	return d, nil
+}
+
+// Get reads the value from the file and marks it as recently used
+func (d *DiskStorage) Get(key string) ([]byte, bool) {
+	name := d.filename(key)
+	data, err := ioutil.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		return nil, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if elem, ok := d.items[name]; ok {
+		d.ll.MoveToFront(elem)
+		// the modification time keeps the order for the next NewDiskStorage
+		now := time.Now()
+		os.Chtimes(filepath.Join(d.dir, name), now, now)
+	}
+	return data, true
+}
+
+// Set writes the value to a temp file then renames it, so readers never see a partial file
+// The least recently used files are removed when it's full
+func (d *DiskStorage) Set(key string, value []byte) {
+	name := d.filename(key)
+	if int64(len(value)) > d.maxSize {
+		d.Delete(key)
+		return
+	}
+
+	file, err := ioutil.TempFile(d.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = file.Write(value)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(d.dir, name))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return
+	}
+	if elem, ok := d.items[name]; ok {
+		item := elem.Value.(*diskItem)
+		d.size += int64(len(value)) - item.size
+		item.size = int64(len(value))
+		d.ll.MoveToFront(elem)
+	} else {
+		d.items[name] = d.ll.PushFront(&diskItem{name: name, size: int64(len(value))})
+		d.size += int64(len(value))
+	}
+	d.evict()
+}
+
+// Delete removes the file
+func (d *DiskStorage) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remove(d.filename(key))
+}
+
+// Size returns the total size of the stored values
+func (d *DiskStorage) Size() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size
+}
+
+// evict removes the least recently used files until the size fits, d.mu must be held
+func (d *DiskStorage) evict() {
+	for d.size > d.maxSize && d.ll.Len() > 0 {
+		d.remove(d.ll.Back().Value.(*diskItem).name)
+	}
+}
+
+func (d *DiskStorage) remove(name string) {
+	os.Remove(filepath.Join(d.dir, name))
+	elem, ok := d.items[name]
+	if !ok {
+		return
+	}
+	d.ll.Remove(elem)
+	delete(d.items, name)
+	d.size -= elem.Value.(*diskItem).size
+}
+
+func (d *DiskStorage) filename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
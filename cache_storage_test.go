@@ -0,0 +1,90 @@
+package betproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_MemoryStorage(t *testing.T) {
+	storage := NewMemoryStorage(10)
+	storage.Set("a", []byte("aaaa"))
+	storage.Set("b", []byte("bbbb"))
+	storage.Get("a")
+	storage.Set("c", []byte("cccc"))
+
+	if _, ok := storage.Get("b"); ok {
+		t.Error("least recently used b must be evicted")
+	}
+	if value, ok := storage.Get("a"); !ok || string(value) != "aaaa" {
+		t.Errorf("a must be kept, but got %s", value)
+	}
+	if storage.Len() != 2 {
+		t.Errorf("Len must be 2, but got %d", storage.Len())
+	}
+
+	storage.Delete("a")
+	if _, ok := storage.Get("a"); ok {
+		t.Error("a must be deleted")
+	}
+	storage.Set("d", []byte("too large value"))
+	if _, ok := storage.Get("d"); ok {
+		t.Error("value larger than the storage must not be stored")
+	}
+}
+
+func Test_DiskStorage(t *testing.T) {
+	storage, err := NewDiskStorage(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	storage.Set("http://example.com/", []byte("value"))
+	if value, ok := storage.Get("http://example.com/"); !ok || string(value) != "value" {
+		t.Errorf("value must be value, but got %s", value)
+	}
+	storage.Delete("http://example.com/")
+	if _, ok := storage.Get("http://example.com/"); ok {
+		t.Error("value must be deleted")
+	}
+}
+
+func Test_DiskStorageEviction(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewDiskStorage(dir, 10)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	storage.Set("a", []byte("aaaa"))
+	storage.Set("b", []byte("bbbb"))
+	storage.Get("a")
+	storage.Set("c", []byte("cccc"))
+
+	if _, ok := storage.Get("b"); ok {
+		t.Error("least recently used b must be evicted")
+	}
+	if value, ok := storage.Get("a"); !ok || string(value) != "aaaa" {
+		t.Errorf("a must be kept, but got %s", value)
+	}
+	if storage.Size() != 8 {
+		t.Errorf("Size must be 8, but got %d", storage.Size())
+	}
+	storage.Set("d", []byte("too large value"))
+	if _, ok := storage.Get("d"); ok {
+		t.Error("value larger than the storage must not be stored")
+	}
+
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, storage.filename("c")), old, old)
+	storage, err = NewDiskStorage(dir, 6)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if _, ok := storage.Get("c"); ok {
+		t.Error("least recently modified c must be evicted on open")
+	}
+	if value, ok := storage.Get("a"); !ok || string(value) != "aaaa" || storage.Size() != 4 {
+		t.Errorf("a must be kept, but got %s %d", value, storage.Size())
+	}
+}
@@ -0,0 +1,263 @@
+package betproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Add(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func newTestCache() (*Cache, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cache := NewCache(NewMemoryStorage(1 << 20))
+	cache.now = clock.Now
+	return cache, clock
+}
+
+func cacheGet(t *testing.T, client Client, url string, header http.Header) (*http.Response, string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func Test_CacheFreshAndRevalidate(t *testing.T) {
+	cache, clock := newTestCache()
+	count := 0
+	client := cache.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		header := http.Header{}
+		header.Set("Date", clock.Now().Format(http.TimeFormat))
+		header.Set("Cache-Control", "max-age=60")
+		header.Set("ETag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return NewResponse(http.StatusNotModified, header, nil, req), nil
+		}
+		return HTTPText(http.StatusOK, header, fmt.Sprintf("body %d", count), req), nil
+	}))
+
+	_, body := cacheGet(t, client, "http://example.com/a", nil)
+	if body != "body 1" {
+		t.Errorf("body must be body 1, but got %s", body)
+	}
+
+	clock.Add(10 * time.Second)
+	res, body := cacheGet(t, client, "http://example.com/a", nil)
+	if count != 1 || body != "body 1" {
+		t.Errorf("response must be served from cache, but upstream called %d times", count)
+	}
+	if res.Header.Get("Age") != "10" {
+		t.Errorf("Age must be 10, but got %s", res.Header.Get("Age"))
+	}
+
+	clock.Add(60 * time.Second)
+	res, body = cacheGet(t, client, "http://example.com/a", nil)
+	if count != 2 || res.StatusCode != http.StatusOK || body != "body 1" {
+		t.Errorf("stale response must be revalidated, but got %d %s after %d calls", res.StatusCode, body, count)
+	}
+
+	clock.Add(10 * time.Second)
+	cacheGet(t, client, "http://example.com/a", nil)
+	if count != 2 {
+		t.Errorf("304 must refresh the entry, but upstream called %d times", count)
+	}
+
+	cacheGet(t, client, "http://example.com/a", http.Header{"Cache-Control": {"no-cache"}})
+	if count != 3 {
+		t.Errorf("request no-cache must revalidate, but upstream called %d times", count)
+	}
+}
+
+func Test_CacheNotStored(t *testing.T) {
+	cases := []http.Header{
+		{"Cache-Control": {"no-store, max-age=60"}},
+		{"Cache-Control": {"private, max-age=60"}},
+		{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+		{},
+	}
+	for _, header := range cases {
+		cache, _ := newTestCache()
+		count := 0
+		client := cache.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+			count++
+			return HTTPText(http.StatusOK, header.Clone(), "ok", req), nil
+		}))
+		cacheGet(t, client, "http://example.com/", nil)
+		cacheGet(t, client, "http://example.com/", nil)
+		if count != 2 {
+			t.Errorf("response with %v must not be stored, but upstream called %d times", header, count)
+		}
+	}
+}
+
+func Test_CacheExpiresAndHeuristic(t *testing.T) {
+	cache, clock := newTestCache()
+	count := 0
+	client := cache.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		header := http.Header{}
+		header.Set("Date", clock.Now().Format(http.TimeFormat))
+		if req.URL.Path == "/expires" {
+			header.Set("Expires", clock.Now().Add(time.Minute).Format(http.TimeFormat))
+		} else {
+			header.Set("Last-Modified", clock.Now().Add(-100*time.Minute).Format(http.TimeFormat))
+		}
+		return HTTPText(http.StatusOK, header, "ok", req), nil
+	}))
+
+	for _, path := range []string{"/expires", "/heuristic"} {
+		count = 0
+		cacheGet(t, client, "http://example.com"+path, nil)
+		clock.Add(30 * time.Second)
+		cacheGet(t, client, "http://example.com"+path, nil)
+		if count != 1 {
+			t.Errorf("%s must be fresh, but upstream called %d times", path, count)
+		}
+		clock.Add(20 * time.Minute)
+		cacheGet(t, client, "http://example.com"+path, nil)
+		if count != 2 {
+			t.Errorf("%s must be stale, but upstream called %d times", path, count)
+		}
+	}
+}
+
+func Test_CacheVary(t *testing.T) {
+	cache, _ := newTestCache()
+	count := 0
+	client := cache.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		header := http.Header{}
+		header.Set("Cache-Control", "max-age=60")
+		header.Set("Vary", "Accept-Language")
+		return HTTPText(http.StatusOK, header, req.Header.Get("Accept-Language"), req), nil
+	}))
+
+	_, body := cacheGet(t, client, "http://example.com/", http.Header{"Accept-Language": {"en"}})
+	if body != "en" {
+		t.Errorf("body must be en, but got %s", body)
+	}
+	_, body = cacheGet(t, client, "http://example.com/", http.Header{"Accept-Language": {"fr"}})
+	if body != "fr" || count != 2 {
+		t.Errorf("other variant must not be served, but got %s", body)
+	}
+	_, body = cacheGet(t, client, "http://example.com/", http.Header{"Accept-Language": {"fr"}})
+	if body != "fr" || count != 2 {
+		t.Errorf("latest variant must be served from cache, but upstream called %d times", count)
+	}
+}
+
+func Test_CacheVaryVariants(t *testing.T) {
+	cache, _ := newTestCache()
+	count := 0
+	client := cache.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		header := http.Header{}
+		header.Set("Cache-Control", "max-age=60")
+		header.Set("Vary", "Accept-Encoding")
+		return HTTPText(http.StatusOK, header, req.Header.Get("Accept-Encoding"), req), nil
+	}))
+
+	cacheGet(t, client, "http://example.com/", http.Header{"Accept-Encoding": {"gzip, br"}})
+	cacheGet(t, client, "http://example.com/", http.Header{"Accept-Encoding": {"identity"}})
+	for i := 0; i < 2; i++ {
+		_, body := cacheGet(t, client, "http://example.com/", http.Header{"Accept-Encoding": {"gzip,br"}})
+		if body != "gzip, br" {
+			t.Errorf("body must be gzip, br, but got %s", body)
+		}
+		_, body = cacheGet(t, client, "http://example.com/", http.Header{"Accept-Encoding": {"identity"}})
+		if body != "identity" {
+			t.Errorf("body must be identity, but got %s", body)
+		}
+	}
+	if count != 2 {
+		t.Errorf("every variant must be served from cache, but upstream called %d times", count)
+	}
+
+	req, _ := http.NewRequest("POST", "http://example.com/", nil)
+	client.Do(req)
+	cacheGet(t, client, "http://example.com/", http.Header{"Accept-Encoding": {"identity"}})
+	cacheGet(t, client, "http://example.com/", http.Header{"Accept-Encoding": {"gzip, br"}})
+	if count != 5 {
+		t.Errorf("unsafe request must invalidate every variant, but upstream called %d times", count)
+	}
+}
+
+func Test_CacheStaleWhileRevalidate(t *testing.T) {
+	cache, clock := newTestCache()
+	refreshed := make(chan struct{}, 1)
+	count := 0
+	client := cache.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		if count > 1 {
+			defer func() { refreshed <- struct{}{} }()
+		}
+		header := http.Header{}
+		header.Set("Date", clock.Now().Format(http.TimeFormat))
+		header.Set("Cache-Control", "max-age=10, stale-while-revalidate=60")
+		return HTTPText(http.StatusOK, header, fmt.Sprintf("body %d", count), req), nil
+	}))
+
+	cacheGet(t, client, "http://example.com/", nil)
+	clock.Add(30 * time.Second)
+	_, body := cacheGet(t, client, "http://example.com/", nil)
+	if body != "body 1" {
+		t.Errorf("stale body must be served, but got %s", body)
+	}
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("entry must be refreshed in the background")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	_, body = cacheGet(t, client, "http://example.com/", nil)
+	if body != "body 2" {
+		t.Errorf("refreshed body must be served, but got %s", body)
+	}
+}
+
+func Test_CacheInvalidate(t *testing.T) {
+	cache, _ := newTestCache()
+	count := 0
+	client := cache.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		header := http.Header{}
+		header.Set("Cache-Control", "max-age=60")
+		return HTTPText(http.StatusOK, header, "ok", req), nil
+	}))
+
+	cacheGet(t, client, "http://example.com/item", nil)
+	req, _ := http.NewRequest("DELETE", "http://example.com/item", nil)
+	client.Do(req)
+	cacheGet(t, client, "http://example.com/item", nil)
+	if count != 3 {
+		t.Errorf("unsafe request must invalidate the entry, but upstream called %d times", count)
+	}
+}
@@ -0,0 +1,106 @@
+package betproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	handshakeContextKey
+	sessionIDContextKey
+	clientAddrContextKey
+	tlsStateContextKey
+	serverNameContextKey
+	spanContextKey
+)
+
+// lastSessionID is increased for every session
+var lastSessionID uint64
+
+// UserFromContext returns the identity authenticated by the Authenticator
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userContextKey).(string)
+	return user, ok
+}
+
+// TLSHandshakeFromContext returns the time spent on the TLS handshake with the client
+func TLSHandshakeFromContext(ctx context.Context) (time.Duration, bool) {
+	handshake, ok := ctx.Value(handshakeContextKey).(time.Duration)
+	return handshake, ok
+}
+
+// SessionIDFromContext returns the id of the session, it's unique in the process
+func SessionIDFromContext(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(sessionIDContextKey).(uint64)
+	return id, ok
+}
+
+// ClientAddrFromContext returns the address of the downstream client
+func ClientAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(clientAddrContextKey).(net.Addr)
+	return addr, ok
+}
+
+// TLSStateFromContext returns the state of the intercepted TLS connection with the client
+func TLSStateFromContext(ctx context.Context) (*tls.ConnectionState, bool) {
+	state, ok := ctx.Value(tlsStateContextKey).(*tls.ConnectionState)
+	return state, ok
+}
+
+// ServerNameFromContext returns the SNI sent by the client
+func ServerNameFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(serverNameContextKey).(string)
+	return name, ok
+}
+
+// SpanFromContext returns the span of the request when the Tracer is set, middlewares can add attributes to it
+func SpanFromContext(ctx context.Context) (*Span, bool) {
+	span, ok := ctx.Value(spanContextKey).(*Span)
+	return span, ok
+}
+
+// context returns the session context, it's cancelled when the session is closed or the service shuts down
+// It must be called from the session goroutine
+func (s *Session) context() context.Context {
+	if s.ctx == nil {
+		s.id = atomic.AddUint64(&lastSessionID, 1)
+		ctx := context.WithValue(s.service.context(), sessionIDContextKey, s.id)
+		ctx = context.WithValue(ctx, clientAddrContextKey, s.conn.RemoteAddr())
+		s.ctx, s.cancel = context.WithCancel(ctx)
+	}
+	return s.ctx
+}
+
+// withSessionContext attaches the session values to the request context
+func (s *Session) withSessionContext(r *http.Request) *http.Request {
+	ctx := r.Context()
+	if s.user != "" {
+		ctx = context.WithValue(ctx, userContextKey, s.user)
+	}
+	if s.secure {
+		ctx = context.WithValue(ctx, handshakeContextKey, s.handshake)
+		state := s.tlsConn.ConnectionState()
+		ctx = context.WithValue(ctx, tlsStateContextKey, &state)
+	}
+	if s.serverName != "" {
+		ctx = context.WithValue(ctx, serverNameContextKey, s.serverName)
+	}
+	return r.WithContext(ctx)
+}
+
+// context returns the service context, it's cancelled when Shutdown aborts the sessions
+func (s *Service) context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
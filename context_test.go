@@ -0,0 +1,122 @@
+package betproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/faceair/betproxy/mitm"
+)
+
+func Test_SessionContextCancelOnClientClose(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	conn, session := newHookSession(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		close(started)
+		select {
+		case <-req.Context().Done():
+			cancelled <- req.Context().Err()
+		case <-time.After(time.Second):
+			cancelled <- nil
+		}
+		return nil, req.Context().Err()
+	}))
+
+	go session.handleLoop()
+
+	_, err := conn.Client.Write([]byte("GET /slow HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	<-started
+	conn.Client.Writer.Close()
+
+	if err = <-cancelled; err == nil {
+		t.Error("request context must be cancelled when the client closes")
+	}
+}
+
+func Test_SessionContextPipelined(t *testing.T) {
+	conn, session := newHookSession(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		time.Sleep(10 * time.Millisecond)
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		id, _ := SessionIDFromContext(req.Context())
+		addr, _ := ClientAddrFromContext(req.Context())
+		return HTTPText(http.StatusOK, nil, fmt.Sprintf("%d %s", id, addr), req), nil
+	}))
+
+	go session.handleLoop()
+
+	_, err := conn.Client.Write([]byte("GET /1 HTTP/1.1\r\nHost: example.com\r\n\r\nGET /2 HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+
+	reader := bufio.NewReader(conn.Client)
+	bodies := []string{}
+	for i := 0; i < 2; i++ {
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("StatusCode must be 200, but got %d %s", res.StatusCode, body)
+		}
+		bodies = append(bodies, string(body))
+	}
+	expect := fmt.Sprintf("%d 127.0.0.1:10086", session.id)
+	if bodies[0] != expect || bodies[1] != expect {
+		t.Errorf("bodies must be %s, but got %v", expect, bodies)
+	}
+}
+
+func Test_SessionContextTLS(t *testing.T) {
+	cacert, cakey, err := mitm.NewAuthority("betproxy", "faceair", 10*365*24*time.Hour)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	tlsCfg, err := mitm.NewConfig(cacert, cakey)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	conn, session := newHookSession(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		state, ok := TLSStateFromContext(req.Context())
+		if !ok {
+			return HTTPText(http.StatusOK, nil, "no tls state", req), nil
+		}
+		name, _ := ServerNameFromContext(req.Context())
+		return HTTPText(http.StatusOK, nil, fmt.Sprintf("%s %s", tls.VersionName(state.Version), name), req), nil
+	}))
+	session.service.tlsCfg = tlsCfg
+
+	go session.handleLoop()
+
+	reader := connectTunnel(t, conn.Client, "example.com:443")
+	if reader.Buffered() != 0 {
+		t.Errorf("no data must follow the CONNECT response")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cacert)
+	tlsConn := tls.Client(conn.Client, &tls.Config{ServerName: "example.com", RootCAs: roots, MaxVersion: tls.VersionTLS12})
+	if _, err = tlsConn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	res, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "TLS 1.2 example.com" {
+		t.Errorf("body must be TLS 1.2 example.com, but got %s", body)
+	}
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"encoding/pem"
-	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -25,6 +23,11 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if err = tlsCfg.SetLeafKeyAlgorithm(mitm.ECDSAP256); err != nil {
+		panic(err)
+	}
+	tlsCfg.EnableHTTP2(true)
+	tlsCfg.StartPruning(time.Minute)
 	service, err := betproxy.NewService(":3128", tlsCfg)
 	if err != nil {
 		panic(err)
@@ -40,38 +43,39 @@ func generateCA() error {
 		return err
 	}
 
-	cacert, cakey, err := mitm.NewAuthority("betproxy", "faceair", 10*365*24*time.Hour)
+	cacert, cakey, err := mitm.NewAuthorityWithAlgorithm("betproxy", "faceair", 10*365*24*time.Hour, mitm.ECDSAP256)
 	if err != nil {
 		return err
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, cacert, cacert, &cakey.PublicKey, cakey)
-	if err != nil {
-		return err
-	}
 	certOut, err := os.Create(BetProxyCAPath + "/ca_cert.pem")
 	if err != nil {
 		return err
 	}
-	if err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
+	if err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: cacert.Raw}); err != nil {
 		return err
 	}
 	if err = certOut.Close(); err != nil {
 		return err
 	}
 
+	derBytes, err := x509.MarshalPKCS8PrivateKey(cakey)
+	if err != nil {
+		return err
+	}
 	keyOut, err := os.OpenFile(BetProxyCAPath+"/ca_key.pem", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		log.Print("failed to open key.pem for writing:", err)
+		return err
 	}
-	if err = pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(cakey)}); err != nil {
+	if err = pem.Encode(keyOut, &pem.Block{Type: "PRIVATE KEY", Bytes: derBytes}); err != nil {
 		return err
 	}
 
 	return keyOut.Close()
 }
 
-func loadCA() (*x509.Certificate, *rsa.PrivateKey, error) {
+// loadCA loads the CA from ~/.betproxy, the key can be PKCS#8, PKCS#1 or EC
+func loadCA() (*x509.Certificate, crypto.Signer, error) {
 	BetProxyCAPath := os.Getenv("HOME") + "/.betproxy"
 	if _, err := os.Stat(BetProxyCAPath); os.IsNotExist(err) {
 		err := generateCA()
@@ -88,22 +92,5 @@ func loadCA() (*x509.Certificate, *rsa.PrivateKey, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	certBlock, _ := pem.Decode(cert)
-	if certBlock == nil {
-		return nil, nil, errors.New("Failed to decode ca certificate")
-	}
-	keyBlock, _ := pem.Decode(key)
-	if keyBlock == nil {
-		return nil, nil, errors.New("Failed to decode ca private key")
-	}
-	rawKey, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
-	if err != nil {
-		return nil, nil, err
-	}
-	rawCert, err := x509.ParseCertificate(certBlock.Bytes)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return rawCert, rawKey, nil
+	return mitm.LoadAuthority(cert, key)
 }
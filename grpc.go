@@ -0,0 +1,159 @@
+package betproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// maxGRPCMessage limits the size of a single gRPC message read by the interceptor
+const maxGRPCMessage = 32 << 20
+
+// GRPCMessage is a single length-prefixed message of a gRPC stream
+type GRPCMessage struct {
+	// Method is the full method path, e.g. /helloworld.Greeter/SayHello
+	Method string
+	// FromClient reports whether the message is sent by the client
+	FromClient bool
+	// Data is the uncompressed protobuf binary, modify it to replace the message
+	Data []byte
+	// JSON is the decoded message, it is only set when the DescriptorSet knows the message type
+	JSON []byte
+}
+
+// GRPCHandler is called with every gRPC message passing through the proxy
+type GRPCHandler func(r *http.Request, msg *GRPCMessage)
+
+// GRPCInterceptor splits the gRPC streams passing through the Client into messages
+type GRPCInterceptor struct {
+	handler     GRPCHandler
+	descriptors *DescriptorSet
+}
+
+// NewGRPCInterceptor create a GRPCInterceptor instance
+// The descriptors is optional, the messages are decoded into JSON when it is supplied
+func NewGRPCInterceptor(handler GRPCHandler, descriptors *DescriptorSet) *GRPCInterceptor {
+	return &GRPCInterceptor{handler: handler, descriptors: descriptors}
+}
+
+// Middleware wraps the request and response bodies of gRPC calls, other requests are passed through
+func (g *GRPCInterceptor) Middleware(next Client) Client {
+	return ClientFunc(func(req *http.Request) (*http.Response, error) {
+		if !isGRPC(req.Header) {
+			return next.Do(req)
+		}
+
+		input, output := "", ""
+		if g.descriptors != nil {
+			input, output, _ = g.descriptors.MethodTypes(req.URL.Path)
+		}
+
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = g.wrap(req, req.Body, req.Header.Get("Grpc-Encoding"), input, true)
+			req.ContentLength = -1
+			req.Header.Del("Content-Length")
+		}
+
+		res, err := next.Do(req)
+		if err != nil || !isGRPC(res.Header) {
+			return res, err
+		}
+		res.Body = g.wrap(req, res.Body, res.Header.Get("Grpc-Encoding"), output, false)
+		res.ContentLength = -1
+		res.Header.Del("Content-Length")
+		return res, nil
+	})
+}
+
+func (g *GRPCInterceptor) wrap(req *http.Request, body io.ReadCloser, encoding, typeName string, fromClient bool) io.ReadCloser {
+	return &grpcBody{
+		ReadCloser: body,
+		onMessage: func(compressed bool, data []byte) ([]byte, error) {
+			msg := &GRPCMessage{Method: req.URL.Path, FromClient: fromClient, Data: data}
+			if compressed {
+				if encoding != "gzip" {
+					// opaque message with unknown compression
+					g.handler(req, msg)
+					return nil, nil
+				}
+				zr, err := gzip.NewReader(bytes.NewReader(data))
+				if err != nil {
+					return nil, err
+				}
+				if msg.Data, err = ioutil.ReadAll(zr); err != nil {
+					return nil, err
+				}
+			}
+			if g.descriptors != nil && typeName != "" {
+				msg.JSON, _ = g.descriptors.DecodeJSON(typeName, msg.Data)
+			}
+
+			original := append([]byte(nil), msg.Data...)
+			g.handler(req, msg)
+			if bytes.Equal(original, msg.Data) {
+				return nil, nil
+			}
+			return msg.Data, nil
+		},
+	}
+}
+
+func isGRPC(h http.Header) bool {
+	contentType := h.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/grpc") && !strings.HasPrefix(contentType, "application/grpc-web")
+}
+
+// grpcBody calls onMessage with every message of the stream
+// If onMessage returns a replacement, the message is sent uncompressed instead of the original one
+type grpcBody struct {
+	io.ReadCloser
+	onMessage func(compressed bool, data []byte) ([]byte, error)
+	buf       bytes.Buffer
+	err       error
+}
+
+func (b *grpcBody) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.err = b.next()
+	}
+	return b.buf.Read(p)
+}
+
+func (b *grpcBody) next() error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(b.ReadCloser, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errors.New("truncated grpc message header")
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxGRPCMessage {
+		return errors.New("grpc message too large")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(b.ReadCloser, data); err != nil {
+		return errors.New("truncated grpc message")
+	}
+
+	replaced, err := b.onMessage(header[0]&1 == 1, data)
+	if err != nil {
+		return err
+	}
+	if replaced != nil {
+		header[0] = 0
+		binary.BigEndian.PutUint32(header[1:], uint32(len(replaced)))
+		data = replaced
+	}
+	b.buf.Write(header)
+	b.buf.Write(data)
+	return nil
+}
@@ -0,0 +1,112 @@
+package betproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func grpcFrame(data []byte) []byte {
+	frame := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+func newGRPCServer() *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		name := ""
+		walkFields(body[5:], func(num int32, wire int, v uint64, b []byte) error {
+			if num == 1 {
+				name = string(b)
+			}
+			return nil
+		})
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(grpcFrame(appendStringField(nil, 1, "hello "+name)))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	return server
+}
+
+func Test_GRPCInterceptor(t *testing.T) {
+	server := newGRPCServer()
+	defer server.Close()
+
+	set, err := NewDescriptorSet(testDescriptorSet())
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	var mu sync.Mutex
+	messages := []*GRPCMessage{}
+	interceptor := NewGRPCInterceptor(func(r *http.Request, msg *GRPCMessage) {
+		mu.Lock()
+		messages = append(messages, msg)
+		mu.Unlock()
+		if msg.FromClient {
+			msg.Data = appendStringField(nil, 1, "betproxy")
+		}
+	}, set)
+	client := interceptor.Middleware(server.Client())
+
+	req, _ := http.NewRequest("POST", server.URL+"/demo.Greeter/SayHello", bytes.NewReader(grpcFrame(appendStringField(nil, 1, "faceair"))))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	res.Body.Close()
+
+	if !bytes.Equal(body, grpcFrame(appendStringField(nil, 1, "hello betproxy"))) {
+		t.Errorf("response body not match, got %q", body)
+	}
+	if res.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("grpc-status trailer must be 0, but got %q", res.Trailer.Get("Grpc-Status"))
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("must intercept 2 messages, but got %d", len(messages))
+	}
+	if !messages[0].FromClient || string(messages[0].JSON) != `{"userName":"faceair"}` {
+		t.Errorf("request message not match, got %s", messages[0].JSON)
+	}
+	if messages[1].FromClient || string(messages[1].JSON) != `{"message":"hello betproxy"}` {
+		t.Errorf("response message not match, got %s", messages[1].JSON)
+	}
+	if messages[1].Method != "/demo.Greeter/SayHello" {
+		t.Errorf("method not match, got %s", messages[1].Method)
+	}
+}
+
+func Test_GRPCInterceptorPassThrough(t *testing.T) {
+	called := false
+	interceptor := NewGRPCInterceptor(func(r *http.Request, msg *GRPCMessage) {
+		called = true
+	}, nil)
+	client := interceptor.Middleware(echoClient())
+
+	req, _ := http.NewRequest("POST", "http://example.com/", bytes.NewReader(grpcFrame([]byte("data"))))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	if called {
+		t.Error("handler must not be called for non gRPC requests")
+	}
+}
@@ -0,0 +1,416 @@
+package betproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultMaxBodySize is the max size of the bodies kept by the recorders
+const DefaultMaxBodySize = 1 << 20
+
+// HAREntry is an exchange of the HTTP Archive 1.2
+// http://www.softwareishard.com/blog/har-12-spec/
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+// HARRequest is the request of HAREntry
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARResponse is the response of HAREntry
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARCookie is a cookie of the request or response
+type HARCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+// HARNameValue is a header or a query parameter
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARPostData is the request body
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARContent is the response body
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARTimings is the time spent on each phase in milliseconds, -1 means not applicable
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// HARRecorder records the exchanges passing through the Client as HAR entries
+type HARRecorder struct {
+	writer      *HARWriter
+	maxBodySize int64
+	logger      Logger
+}
+
+// NewHARRecorder create a HARRecorder instance which writes the entries to writer
+func NewHARRecorder(writer *HARWriter) *HARRecorder {
+	return &HARRecorder{writer: writer, maxBodySize: DefaultMaxBodySize, logger: defaultLogger{}}
+}
+
+// SetLogger sets the logger of the write failures, nil silences the logs
+func (h *HARRecorder) SetLogger(logger Logger) {
+	h.logger = logger
+}
+
+// SetMaxBodySize sets the max size of the bodies kept in the entries, the rest is truncated
+func (h *HARRecorder) SetMaxBodySize(size int64) {
+	h.maxBodySize = size
+}
+
+// Middleware records the exchange after the response body is read
+func (h *HARRecorder) Middleware(next Client) Client {
+	return ClientFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		entry := &HAREntry{
+			StartedDateTime: start,
+			Request:         newHARRequest(req),
+			Timings:         HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1},
+		}
+		if handshake, ok := TLSHandshakeFromContext(req.Context()); ok {
+			entry.Timings.SSL = milliseconds(handshake)
+		}
+
+		var reqBody *captureBody
+		contentType := req.Header.Get("Content-Type")
+		if req.Body != nil && req.Body != http.NoBody {
+			reqBody = newCaptureBody(req.Body, h.maxBodySize, func(c *captureBody) {
+				entry.Request.BodySize = c.size
+				entry.Request.PostData = newHARPostData(contentType, c)
+			})
+			req.Body = reqBody
+		}
+		// the transport may still be sending the request body when the response is done
+		// its state is frozen then, and the postData is marked incomplete
+		requestDone := func() {
+			if reqBody != nil && !reqBody.detach() {
+				entry.Request.BodySize = reqBody.size
+				entry.Request.PostData = newHARPostData(contentType, reqBody)
+			}
+		}
+
+		res, err := next.Do(req)
+		wait := time.Since(start)
+		entry.Timings.Wait = milliseconds(wait)
+
+		if err != nil {
+			requestDone()
+			entry.Time = entry.Timings.Wait
+			entry.Response = HARResponse{HTTPVersion: "unknown", Cookies: []HARCookie{}, Headers: []HARNameValue{}, HeadersSize: -1, BodySize: -1}
+			entry.Comment = err.Error()
+			h.writeEntry(req, entry)
+			return res, err
+		}
+
+		entry.Response = newHARResponse(res)
+		if res.StatusCode == http.StatusSwitchingProtocols {
+			// the body is the upgraded stream, wrapping it would hide the connection from the session
+			requestDone()
+			entry.Time = entry.Timings.Wait
+			entry.Response.Content = HARContent{MimeType: res.Header.Get("Content-Type")}
+			h.writeEntry(req, entry)
+			return res, nil
+		}
+		res.Body = newCaptureBody(res.Body, h.maxBodySize, func(c *captureBody) {
+			requestDone()
+			entry.Timings.Receive = milliseconds(time.Since(start) - wait)
+			entry.Time = entry.Timings.Wait + entry.Timings.Receive
+			entry.Response.BodySize = c.size
+			entry.Response.Content = newHARContent(res.Header.Get("Content-Type"), c)
+			h.writeEntry(req, entry)
+		})
+		return res, nil
+	})
+}
+
+func (h *HARRecorder) writeEntry(req *http.Request, entry *HAREntry) {
+	if err := h.writer.WriteEntry(entry); err != nil && h.logger != nil {
+		h.logger.Log(req.Context(), slog.LevelError, "write har entry failed", slog.String("url", entry.Request.URL), slog.Any("error", err))
+	}
+}
+
+func newHARRequest(req *http.Request) HARRequest {
+	cookies := []HARCookie{}
+	for _, c := range req.Cookies() {
+		cookies = append(cookies, HARCookie{Name: c.Name, Value: c.Value})
+	}
+	query := []HARNameValue{}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			query = append(query, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return HARRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     cookies,
+		Headers:     harHeaders(req.Header),
+		QueryString: query,
+		HeadersSize: -1,
+		BodySize:    0,
+	}
+}
+
+func newHARResponse(res *http.Response) HARResponse {
+	cookies := []HARCookie{}
+	for _, c := range res.Cookies() {
+		cookie := HARCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			expires := c.Expires
+			cookie.Expires = &expires
+		}
+		cookies = append(cookies, cookie)
+	}
+	return HARResponse{
+		Status:      res.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(res.Status, fmt.Sprint(res.StatusCode))),
+		HTTPVersion: res.Proto,
+		Cookies:     cookies,
+		Headers:     harHeaders(res.Header),
+		RedirectURL: res.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+}
+
+func newHARPostData(contentType string, c *captureBody) *HARPostData {
+	text, encoding := harText(contentType, c.Bytes())
+	data := &HARPostData{MimeType: contentType, Text: text, Encoding: encoding}
+	if c.truncated {
+		data.Comment = "truncated"
+	} else if !c.eof {
+		data.Comment = "incomplete"
+	}
+	return data
+}
+
+func newHARContent(contentType string, c *captureBody) HARContent {
+	text, encoding := harText(contentType, c.Bytes())
+	content := HARContent{Size: c.size, MimeType: contentType, Text: text, Encoding: encoding}
+	if c.truncated {
+		content.Comment = "truncated"
+	}
+	return content
+}
+
+// harText keeps the textual body as it is and encodes the others with base64
+func harText(contentType string, data []byte) (text, encoding string) {
+	if isTextual(contentType) && utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+func isTextual(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml") || strings.HasSuffix(mediaType, "javascript") ||
+		mediaType == "application/x-www-form-urlencoded"
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	headers := []HARNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// HARWriter streams the entries into HAR files, so the entries don't accumulate in memory
+type HARWriter struct {
+	mu         sync.Mutex
+	open       func() (io.WriteCloser, error)
+	out        io.WriteCloser
+	entries    int
+	maxEntries int
+	closed     bool
+}
+
+// NewHARWriter create a HARWriter which writes a single HAR log to w
+// The log is completed when the writer is closed
+func NewHARWriter(w io.Writer) *HARWriter {
+	out, ok := w.(io.WriteCloser)
+	if !ok {
+		out = nopWriteCloser{w}
+	}
+	return &HARWriter{
+		open: func() (io.WriteCloser, error) {
+			return out, nil
+		},
+	}
+}
+
+// NewRotatingHARWriter create a HARWriter which writes the entries into files under dir
+// A new file is created after every maxEntries entries
+func NewRotatingHARWriter(dir string, maxEntries int) (*HARWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// the sequence number keeps the names unique when the files are rotated within the same microsecond
+	var seq int
+	return &HARWriter{
+		maxEntries: maxEntries,
+		open: func() (io.WriteCloser, error) {
+			seq++
+			name := fmt.Sprintf("betproxy-%s-%d.har", time.Now().Format("20060102-150405.000000"), seq)
+			return os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		},
+	}, nil
+}
+
+const harHeader = `{"log":{"version":"1.2","creator":{"name":"betproxy","version":"1.0"},"entries":[`
+const harFooter = "\n]}}\n"
+
+// WriteEntry appends the entry to the current HAR file, it returns os.ErrClosed after Close
+func (w *HARWriter) WriteEntry(entry *HAREntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.out == nil {
+		if w.out, err = w.open(); err != nil {
+			return err
+		}
+		if _, err = io.WriteString(w.out, harHeader); err != nil {
+			return err
+		}
+	}
+
+	prefix := ",\n"
+	if w.entries == 0 {
+		prefix = "\n"
+	}
+	if _, err = io.WriteString(w.out, prefix); err != nil {
+		return err
+	}
+	if _, err = w.out.Write(data); err != nil {
+		return err
+	}
+	w.entries++
+
+	if w.maxEntries > 0 && w.entries >= w.maxEntries {
+		return w.finish()
+	}
+	return nil
+}
+
+// Close completes the current HAR file, the later entries are rejected
+func (w *HARWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.out == nil {
+		var err error
+		if w.out, err = w.open(); err != nil {
+			return err
+		}
+		if _, err = io.WriteString(w.out, harHeader); err != nil {
+			return err
+		}
+	}
+	return w.finish()
+}
+
+func (w *HARWriter) finish() error {
+	_, err := io.WriteString(w.out, harFooter)
+	if closeErr := w.out.Close(); err == nil {
+		err = closeErr
+	}
+	w.out = nil
+	w.entries = 0
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,289 @@
+package betproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Entries []HAREntry `json:"entries"`
+	} `json:"log"`
+}
+
+func decodeHAR(t *testing.T, data []byte) harLog {
+	var har harLog
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	return har
+}
+
+func Test_HARRecorder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := NewHARWriter(buf)
+	recorder := NewHARRecorder(writer)
+	client := recorder.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(req.Body)
+		header := http.Header{}
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		header.Set("Set-Cookie", "session=abc; Path=/")
+		return HTTPText(http.StatusOK, header, "echo "+string(body), req), nil
+	}))
+
+	req, _ := http.NewRequest("POST", "http://example.com/post?a=1", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.AddCookie(&http.Cookie{Name: "token", Value: "xyz"})
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if err = writer.Close(); err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+
+	har := decodeHAR(t, buf.Bytes())
+	if har.Log.Version != "1.2" {
+		t.Errorf("version must be 1.2, but got %s", har.Log.Version)
+	}
+	if len(har.Log.Entries) != 1 {
+		t.Fatalf("entries must be 1, but got %d", len(har.Log.Entries))
+	}
+	entry := har.Log.Entries[0]
+	if entry.Request.Method != "POST" || entry.Request.URL != "http://example.com/post?a=1" {
+		t.Errorf("request must be POST http://example.com/post?a=1, but got %s %s", entry.Request.Method, entry.Request.URL)
+	}
+	if len(entry.Request.QueryString) != 1 || entry.Request.QueryString[0].Value != "1" {
+		t.Errorf("queryString must be a=1, but got %v", entry.Request.QueryString)
+	}
+	if len(entry.Request.Cookies) != 1 || entry.Request.Cookies[0].Name != "token" {
+		t.Errorf("request cookies must be token, but got %v", entry.Request.Cookies)
+	}
+	if entry.Request.PostData == nil || entry.Request.PostData.Text != "hello" {
+		t.Errorf("postData must be hello, but got %v", entry.Request.PostData)
+	}
+	if entry.Response.Status != http.StatusOK || entry.Response.StatusText != "OK" {
+		t.Errorf("response must be 200 OK, but got %d %s", entry.Response.Status, entry.Response.StatusText)
+	}
+	if entry.Response.Content.Text != "echo hello" || entry.Response.Content.Encoding != "" {
+		t.Errorf("content must be echo hello, but got %s", entry.Response.Content.Text)
+	}
+	if len(entry.Response.Cookies) != 1 || entry.Response.Cookies[0].Value != "abc" {
+		t.Errorf("response cookies must be session=abc, but got %v", entry.Response.Cookies)
+	}
+	if entry.Timings.SSL != -1 {
+		t.Errorf("ssl must be -1 for plain http, but got %f", entry.Timings.SSL)
+	}
+}
+
+func Test_HARRecorderBinaryTruncated(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := NewHARWriter(buf)
+	recorder := NewHARRecorder(writer)
+	recorder.SetMaxBodySize(4)
+	payload := []byte{0, 1, 2, 3, 4, 5, 6, 7}
+	client := recorder.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("Content-Type", "application/octet-stream")
+		return NewResponse(http.StatusOK, header, bytes.NewReader(payload), req), nil
+	}))
+
+	req, _ := http.NewRequest("GET", "http://example.com/bin", nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if !bytes.Equal(body, payload) {
+		t.Errorf("body must not be changed, but got %v", body)
+	}
+	writer.Close()
+
+	entry := decodeHAR(t, buf.Bytes()).Log.Entries[0]
+	content := entry.Response.Content
+	if content.Encoding != "base64" || content.Text != base64.StdEncoding.EncodeToString(payload[:4]) {
+		t.Errorf("content must be the base64 of the first 4 bytes, but got %s", content.Text)
+	}
+	if content.Size != 8 || content.Comment != "truncated" {
+		t.Errorf("content must be truncated with size 8, but got %d %s", content.Size, content.Comment)
+	}
+}
+
+func Test_HARRecorderError(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := NewHARWriter(buf)
+	client := NewHARRecorder(writer).Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("dial failed")
+	}))
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if _, err := client.Do(req); err == nil {
+		t.Error("err must not be nil")
+	}
+	writer.Close()
+
+	entry := decodeHAR(t, buf.Bytes()).Log.Entries[0]
+	if entry.Response.Status != 0 || entry.Comment != "dial failed" {
+		t.Errorf("entry must record the error, but got %d %s", entry.Response.Status, entry.Comment)
+	}
+}
+
+func Test_HARRecorderEarlyResponse(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := NewHARWriter(buf)
+	responded, read := make(chan struct{}), make(chan []byte, 1)
+	client := NewHARRecorder(writer).Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		// the upstream answers before it has read the request body
+		go func() {
+			<-responded
+			body, _ := ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			read <- body
+		}()
+		return HTTPText(http.StatusOK, nil, "ok", req), nil
+	}))
+
+	req, _ := http.NewRequest("POST", "http://example.com/post", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "text/plain")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	close(responded)
+	if body := <-read; string(body) != "hello" {
+		t.Errorf("request body must not be changed, but got %s", body)
+	}
+	writer.Close()
+
+	entry := decodeHAR(t, buf.Bytes()).Log.Entries[0]
+	if postData := entry.Request.PostData; postData == nil || postData.Comment != "incomplete" || entry.Request.BodySize != 0 {
+		t.Errorf("postData must be marked incomplete, but got %+v %d", postData, entry.Request.BodySize)
+	}
+}
+
+func Test_HARWriterEmpty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := NewHARWriter(buf).Close(); err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	har := decodeHAR(t, buf.Bytes())
+	if len(har.Log.Entries) != 0 {
+		t.Errorf("entries must be empty, but got %d", len(har.Log.Entries))
+	}
+}
+
+func Test_RotatingHARWriter(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewRotatingHARWriter(dir, 2)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		if err = writer.WriteEntry(&HAREntry{Request: HARRequest{Method: "GET"}}); err != nil {
+			t.Errorf("err must be nil, but got %s", err.Error())
+		}
+	}
+	writer.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	if len(files) != 2 {
+		t.Fatalf("files must be 2, but got %d", len(files))
+	}
+	total := 0
+	for _, file := range files {
+		data, _ := ioutil.ReadFile(file)
+		total += len(decodeHAR(t, data).Log.Entries)
+	}
+	if total != 3 {
+		t.Errorf("entries must be 3, but got %d", total)
+	}
+}
+
+func Test_HARWriterClosed(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := NewHARWriter(buf)
+	var logs []string
+	recorder := NewHARRecorder(writer)
+	recorder.SetLogger(LoggerFunc(func(ctx context.Context, level slog.Level, msg string, args ...any) {
+		logs = append(logs, msg)
+	}))
+	client := recorder.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("dial failed")
+	}))
+	writer.Close()
+
+	if err := writer.WriteEntry(&HAREntry{}); err != os.ErrClosed {
+		t.Errorf("err must be os.ErrClosed, but got %v", err)
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	client.Do(req)
+	if len(logs) != 1 || logs[0] != "write har entry failed" {
+		t.Errorf("write failure must be logged, but got %v", logs)
+	}
+	if har := decodeHAR(t, buf.Bytes()); len(har.Log.Entries) != 0 {
+		t.Errorf("entries must be empty, but got %d", len(har.Log.Entries))
+	}
+}
+
+func Test_RotatingHARWriterSameTime(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewRotatingHARWriter(dir, 1)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	for i := 0; i < 20; i++ {
+		if err = writer.WriteEntry(&HAREntry{Request: HARRequest{Method: "GET"}}); err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.har")); len(files) != 20 {
+		t.Errorf("files must be 20, but got %d", len(files))
+	}
+}
+
+func Test_HARRecorderWebSocket(t *testing.T) {
+	server := newWebSocketEchoServer()
+	defer server.Close()
+
+	buf := &bytes.Buffer{}
+	writer := NewHARWriter(buf)
+	service := &Service{client: &http.Client{}}
+	service.Use(NewHARRecorder(writer).Middleware)
+	conn, reader, _ := dialWebSocket(t, &Session{service: service}, strings.TrimPrefix(server.URL, "http://"))
+	defer conn.Client.Close()
+
+	if _, err := writeWebSocketFrame(conn.Client, &WebSocketFrame{Fin: true, Opcode: WebSocketText, Payload: []byte("hello")}, true); err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	frame, err := readWebSocketFrame(reader)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if string(frame.Payload) != "hello" {
+		t.Errorf("echo frame must be hello, but got %s", frame.Payload)
+	}
+
+	if err = writer.Close(); err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	har := decodeHAR(t, buf.Bytes())
+	if len(har.Log.Entries) != 1 || har.Log.Entries[0].Response.Status != http.StatusSwitchingProtocols {
+		t.Errorf("upgrade must be recorded, but got %+v", har.Log.Entries)
+	}
+}
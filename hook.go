@@ -0,0 +1,137 @@
+package betproxy
+
+import "net/http"
+
+// ConnectHook is called with the CONNECT request before the tunnel is established
+// The request can be mutated, e.g. change r.Host to connect another destination
+// Returning a non-nil response rejects the tunnel and the response is sent to the client instead
+type ConnectHook interface {
+	OnConnect(r *http.Request) *http.Response
+}
+
+// RequestHook is called after the hop-by-hop headers are stripped and before the request is sent to the Client
+// It can return a new request to replace the original one, or a non-nil response to reply without calling the Client
+type RequestHook interface {
+	OnRequest(r *http.Request) (*http.Request, *http.Response)
+}
+
+// ResponseHook is called before the response is written to the client
+// It can mutate the response or return a new one to replace it, returning nil keeps the original response
+type ResponseHook interface {
+	OnResponse(res *http.Response) *http.Response
+}
+
+// ErrorHook is called when the Client fails to handle the request
+// Returning a non-nil response replaces the default 500 error response
+type ErrorHook interface {
+	OnError(r *http.Request, err error) *http.Response
+}
+
+// ConnectHookFunc is an adapter to allow the use of ordinary functions as ConnectHook
+type ConnectHookFunc func(r *http.Request) *http.Response
+
+// OnConnect calls f(r)
+func (f ConnectHookFunc) OnConnect(r *http.Request) *http.Response {
+	return f(r)
+}
+
+// RequestHookFunc is an adapter to allow the use of ordinary functions as RequestHook
+type RequestHookFunc func(r *http.Request) (*http.Request, *http.Response)
+
+// OnRequest calls f(r)
+func (f RequestHookFunc) OnRequest(r *http.Request) (*http.Request, *http.Response) {
+	return f(r)
+}
+
+// ResponseHookFunc is an adapter to allow the use of ordinary functions as ResponseHook
+type ResponseHookFunc func(res *http.Response) *http.Response
+
+// OnResponse calls f(res)
+func (f ResponseHookFunc) OnResponse(res *http.Response) *http.Response {
+	return f(res)
+}
+
+// ErrorHookFunc is an adapter to allow the use of ordinary functions as ErrorHook
+type ErrorHookFunc func(r *http.Request, err error) *http.Response
+
+// OnError calls f(r, err)
+func (f ErrorHookFunc) OnError(r *http.Request, err error) *http.Response {
+	return f(r, err)
+}
+
+type hooks struct {
+	connect   []ConnectHook
+	request   []RequestHook
+	response  []ResponseHook
+	error     []ErrorHook
+	websocket []WebSocketHook
+}
+
+// add registers the hook for every phase it implements
+func (h *hooks) add(hook interface{}) bool {
+	ok := false
+	if v, is := hook.(ConnectHook); is {
+		h.connect = append(h.connect, v)
+		ok = true
+	}
+	if v, is := hook.(RequestHook); is {
+		h.request = append(h.request, v)
+		ok = true
+	}
+	if v, is := hook.(ResponseHook); is {
+		h.response = append(h.response, v)
+		ok = true
+	}
+	if v, is := hook.(ErrorHook); is {
+		h.error = append(h.error, v)
+		ok = true
+	}
+	if v, is := hook.(WebSocketHook); is {
+		h.websocket = append(h.websocket, v)
+		ok = true
+	}
+	return ok
+}
+
+func (h *hooks) onConnect(r *http.Request) *http.Response {
+	for _, hook := range h.connect {
+		if res := hook.OnConnect(r); res != nil {
+			return res
+		}
+	}
+	return nil
+}
+
+func (h *hooks) onRequest(r *http.Request) (*http.Request, *http.Response) {
+	for _, hook := range h.request {
+		req, res := hook.OnRequest(r)
+		if req != nil {
+			r = req
+		}
+		if res != nil {
+			return r, res
+		}
+	}
+	return r, nil
+}
+
+func (h *hooks) onResponse(res *http.Response) *http.Response {
+	for _, hook := range h.response {
+		if v := hook.OnResponse(res); v != nil {
+			res = v
+		}
+	}
+	return res
+}
+
+func (h *hooks) onError(r *http.Request, err error) *http.Response {
+	for _, hook := range h.error {
+		if res := hook.OnError(r, err); res != nil {
+			return res
+		}
+	}
+	if isTimeout(err) {
+		return HTTPError(http.StatusGatewayTimeout, err.Error(), r)
+	}
+	return HTTPError(http.StatusInternalServerError, err.Error(), r)
+}
@@ -0,0 +1,150 @@
+package betproxy
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func newHookSession(client Client, hooks ...interface{}) (*FakeConn, *Session) {
+	conn := NewFakeConn()
+	service := &Service{client: client}
+	for _, hook := range hooks {
+		service.AddHook(hook)
+	}
+	return conn, &Session{service: service, conn: conn.Server}
+}
+
+func echoClient() Client {
+	return ClientFunc(func(req *http.Request) (*http.Response, error) {
+		return HTTPText(http.StatusOK, nil, req.URL.String(), req), nil
+	})
+}
+
+func Test_HookOnConnectReject(t *testing.T) {
+	conn, session := newHookSession(echoClient(), ConnectHookFunc(func(r *http.Request) *http.Response {
+		if r.Host == "blocked.com:443" {
+			return HTTPError(http.StatusForbidden, "blocked", r)
+		}
+		return nil
+	}))
+
+	go session.handleLoop()
+
+	_, err := conn.Client.Write([]byte("CONNECT blocked.com:443 HTTP/1.1\r\nHost: blocked.com:443\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("res.StatusCode must be 403, but got %d", res.StatusCode)
+	}
+}
+
+func Test_HookOnRequest(t *testing.T) {
+	conn, session := newHookSession(echoClient(), RequestHookFunc(func(r *http.Request) (*http.Request, *http.Response) {
+		if r.URL.Path == "/deny" {
+			return nil, HTTPError(http.StatusForbidden, "denied", r)
+		}
+		r.URL.Path = "/rewritten"
+		return r, nil
+	}))
+
+	go session.handleLoop()
+
+	reader := bufio.NewReader(conn.Client)
+	_, err := conn.Client.Write([]byte("GET /get HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "http://example.com/rewritten" {
+		t.Errorf("body must be http://example.com/rewritten, but got %s", body)
+	}
+
+	_, err = conn.Client.Write([]byte("GET /deny HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("res.StatusCode must be 403, but got %d", res.StatusCode)
+	}
+}
+
+func Test_HookOnResponse(t *testing.T) {
+	conn, session := newHookSession(echoClient(), ResponseHookFunc(func(res *http.Response) *http.Response {
+		res.Header.Set("X-Hooked", "1")
+		return nil
+	}))
+
+	go session.handleLoop()
+
+	_, err := conn.Client.Write([]byte("GET /get HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.Header.Get("X-Hooked") != "1" {
+		t.Error("response must be mutated by hook")
+	}
+}
+
+type errorHook struct {
+	errs []error
+}
+
+func (h *errorHook) OnError(r *http.Request, err error) *http.Response {
+	h.errs = append(h.errs, err)
+	return HTTPError(http.StatusBadGateway, err.Error(), r)
+}
+
+func Test_HookOnError(t *testing.T) {
+	hook := &errorHook{}
+	conn, session := newHookSession(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("upstream down")
+	}), hook)
+
+	go session.handleLoop()
+
+	_, err := conn.Client.Write([]byte("GET /get HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("res.StatusCode must be 502, but got %d", res.StatusCode)
+	}
+	if len(hook.errs) != 1 || hook.errs[0].Error() != "upstream down" {
+		t.Errorf("hook must receive the client error, but got %v", hook.errs)
+	}
+}
+
+func Test_ServiceAddHookInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("must panic, but got nil")
+		}
+	}()
+	service := &Service{}
+	service.AddHook(struct{}{})
+}
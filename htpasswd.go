@@ -0,0 +1,207 @@
+package betproxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Htpasswd verifies the passwords with an Apache htpasswd file
+// The MD5 ($apr1$) and SHA1 ({SHA}) formats are supported, bcrypt, crypt and other entries never match
+// Plain text entries are only accepted after EnablePlaintext
+type Htpasswd struct {
+	mu        sync.RWMutex
+	users     map[string]string
+	plaintext bool
+}
+
+// LoadHtpasswd reads the htpasswd file
+func LoadHtpasswd(filename string) (*Htpasswd, error) {
+	h := &Htpasswd{}
+	if err := h.Load(filename); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Load replaces the users with the htpasswd file
+func (h *Htpasswd) Load(filename string) error {
+	users := make(map[string]string)
+	err := readColonFile(filename, func(fields []string) error {
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid htpasswd line %q", strings.Join(fields, ":"))
+		}
+		users[fields[0]] = fields[1]
+		return nil
+	}, 2)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+	return nil
+}
+
+// EnablePlaintext accepts the entries without a known hash prefix as plain text passwords
+// A crypt entry is then matched by the hash itself, so only enable it for files without crypt entries
+func (h *Htpasswd) EnablePlaintext(enable bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.plaintext = enable
+}
+
+// Verify implements PasswordVerifier
+func (h *Htpasswd) Verify(username, password string) bool {
+	h.mu.RLock()
+	hash, ok := h.users[username]
+	plaintext := h.plaintext
+	h.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		computed = apr1(password, salt)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$") || !plaintext:
+		// bcrypt, crypt and other formats are not supported
+		return false
+	default:
+		computed = password
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// Htdigest looks up the HA1 of users with an Apache htdigest file
+type Htdigest struct {
+	realm string
+	users map[string]string
+}
+
+// LoadHtdigest reads the entries of the realm from the htdigest file
+func LoadHtdigest(filename, realm string) (*Htdigest, error) {
+	h := &Htdigest{realm: realm, users: make(map[string]string)}
+	err := readColonFile(filename, func(fields []string) error {
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid htdigest line %q", strings.Join(fields, ":"))
+		}
+		if fields[1] == realm {
+			h.users[fields[0]] = fields[2]
+		}
+		return nil
+	}, 3)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// HA1 returns the HA1 of the user, it can be used with NewDigestAuth
+func (h *Htdigest) HA1(username string) (string, bool) {
+	ha1, ok := h.users[username]
+	return ha1, ok
+}
+
+func readColonFile(filename string, fn func(fields []string) error, n int) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = fn(strings.SplitN(line, ":", n)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// apr1 computes the Apache variant of the MD5 crypt
+// https://svn.apache.org/viewvc/apr/apr/trunk/crypto/apr_md5.c
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alternate := md5.New()
+	alternate.Write(pw)
+	alternate.Write([]byte(salt))
+	alternate.Write(pw)
+	final := alternate.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(final)
+		} else {
+			ctx.Write(final[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final = ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var sb strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			sb.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+
+	return magic + salt + "$" + sb.String()
+}
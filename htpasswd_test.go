@@ -0,0 +1,86 @@
+package betproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, name, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	return filename
+}
+
+func Test_APR1(t *testing.T) {
+	if got := apr1("secret", "saltsalt"); got != "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0" {
+		t.Errorf("apr1 not match, got %s", got)
+	}
+	if got := apr1("", "ab"); got != "$apr1$ab$S8K6Sgp3W8c9Jb6LxgywZ." {
+		t.Errorf("apr1 not match, got %s", got)
+	}
+}
+
+func Test_Htpasswd(t *testing.T) {
+	filename := writeTempFile(t, "htpasswd", `# users
+md5:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0
+sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+plain:secret
+bcrypt:$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC
+crypt:rqXexS6ZhobKA
+`)
+	h, err := LoadHtpasswd(filename)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	for _, user := range []string{"md5", "sha"} {
+		if !h.Verify(user, "secret") {
+			t.Errorf("%s must be verified", user)
+		}
+		if h.Verify(user, "wrong") {
+			t.Errorf("%s must not be verified with wrong password", user)
+		}
+	}
+	if h.Verify("bcrypt", "secret") {
+		t.Error("bcrypt is not supported")
+	}
+	if h.Verify("crypt", "rqXexS6ZhobKA") || h.Verify("crypt", "secret") {
+		t.Error("crypt is not supported")
+	}
+	if h.Verify("plain", "secret") {
+		t.Error("plain text must not be verified by default")
+	}
+
+	h.EnablePlaintext(true)
+	if !h.Verify("plain", "secret") || h.Verify("plain", "wrong") {
+		t.Error("plain text must be verified when enabled")
+	}
+	if h.Verify("nobody", "secret") {
+		t.Error("unknown user must not be verified")
+	}
+
+	if _, err = LoadHtpasswd(writeTempFile(t, "invalid", "nopassword\n")); err == nil {
+		t.Error("must error, but got nil")
+	}
+	if _, err = LoadHtpasswd(filepath.Join(os.TempDir(), "not-exist-htpasswd")); err == nil {
+		t.Error("must error, but got nil")
+	}
+}
+
+func Test_Htdigest(t *testing.T) {
+	filename := writeTempFile(t, "htdigest", "faceair:betproxy:"+DigestHA1("faceair", "betproxy", "secret")+"\nother:realm:abc\n")
+	h, err := LoadHtdigest(filename, "betproxy")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if ha1, ok := h.HA1("faceair"); !ok || ha1 != DigestHA1("faceair", "betproxy", "secret") {
+		t.Errorf("ha1 not match, got %s", ha1)
+	}
+	if _, ok := h.HA1("other"); ok {
+		t.Error("users of other realm must be ignored")
+	}
+}
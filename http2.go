@@ -0,0 +1,136 @@
+package betproxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serveHTTP2 serves the multiplexed streams on the intercepted TLS connection
+// Every stream is handled by handleHTTP just like the HTTP/1.x requests
+func (s *Session) serveHTTP2() error {
+	listener := newConnListener(s.tlsConn)
+	options := s.service.options
+	server := &http.Server{
+		Handler:           http.HandlerFunc(s.serveStream),
+		ReadHeaderTimeout: options.ReadHeaderTimeout,
+		IdleTimeout:       options.IdleTimeout,
+		WriteTimeout:      options.WriteTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return s.context()
+		},
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateIdle:
+				// the connection without streams is closed by Shutdown like the idle HTTP/1.x sessions
+				if !s.service.setSessionIdle(s, true) {
+					conn.Close()
+				}
+			case http.StateActive:
+				s.service.setSessionIdle(s, false)
+			case http.StateClosed, http.StateHijacked:
+				listener.Close()
+			}
+		},
+	}
+
+	err := server.Serve(listener)
+	if err == errListenerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *Session) serveStream(rw http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	r.RemoteAddr = s.conn.RemoteAddr().String()
+	r.RequestURI = ""
+	r, span := s.startSpan(r, start)
+
+	w := s.handleHTTP(r)
+	defer w.Body.Close()
+	defer s.finishSpan(r, span, w.StatusCode)
+
+	header := rw.Header()
+	for key, values := range w.Header {
+		switch key {
+		case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade":
+			continue
+		}
+		header[key] = values
+	}
+	rw.WriteHeader(w.StatusCode)
+
+	write := traceWrite(span)
+	n, err := io.Copy(&flushWriter{rw}, w.Body)
+	finishChild(write, err)
+	if err != nil {
+		s.log(r.Context(), slog.LevelWarn, "write stream failed", slog.String("method", r.Method), slog.String("url", r.URL.String()), slog.Any("error", err))
+		return
+	}
+	// the trailer values are only available after the body is read
+	for key, values := range w.Trailer {
+		header[http.TrailerPrefix+key] = values
+	}
+
+	s.logAccess(r, w.StatusCode, w.Header, n, start)
+	s.service.metrics.observeRequest(r.URL.Hostname(), w.StatusCode, time.Since(start))
+	s.logRequest(r.Context(), r.Method, r.URL.String(), w.StatusCode, n, time.Since(start))
+}
+
+// flushWriter flushes after every write so that streaming responses are not delayed
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+var errListenerClosed = &net.OpError{Op: "accept", Net: "tcp", Err: net.ErrClosed}
+
+// connListener is a net.Listener which accepts the giving connection only once
+type connListener struct {
+	conn   net.Conn
+	addr   net.Addr
+	once   sync.Once
+	closed chan struct{}
+	mu     sync.Mutex
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, addr: conn.LocalAddr(), closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, errListenerClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
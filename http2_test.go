@@ -0,0 +1,97 @@
+package betproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/faceair/betproxy/mitm"
+)
+
+func Test_SessionHandleHTTP2(t *testing.T) {
+	cacert, cakey, err := mitm.NewAuthority("betproxy", "faceair", 10*365*24*time.Hour)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	tlsCfg, err := mitm.NewConfig(cacert, cakey)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	tlsCfg.EnableHTTP2(true)
+
+	conn := NewFakeConn()
+	session := &Session{
+		service: &Service{
+			client: ClientFunc(func(req *http.Request) (*http.Response, error) {
+				res := HTTPText(http.StatusOK, http.Header{"X-Proto": []string{req.Proto}}, req.URL.String(), req)
+				res.Trailer = http.Header{"Grpc-Status": []string{"0"}}
+				return res, nil
+			}),
+			tlsCfg: tlsCfg,
+		},
+		conn: conn.Server,
+	}
+
+	go session.handleLoop()
+
+	_, err = conn.Client.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("res.StatusCode must be 200, but got %d", res.StatusCode)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cacert)
+	tlsConn := tls.Client(conn.Client, &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    roots,
+		NextProtos: []string{"h2"},
+	})
+	if err = tlsConn.Handshake(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Fatalf("negotiated protocol must be h2, but got %s", proto)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return tlsConn, nil
+			},
+		},
+	}
+	for _, path := range []string{"/a", "/b"} {
+		res, err = client.Get("https://example.com" + path)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		if res.ProtoMajor != 2 {
+			t.Errorf("res.ProtoMajor must be 2, but got %d", res.ProtoMajor)
+		}
+		if res.Header.Get("X-Proto") != "HTTP/2.0" {
+			t.Errorf("client must receive HTTP/2.0 request, but got %s", res.Header.Get("X-Proto"))
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "https://example.com"+path {
+			t.Errorf("body must be https://example.com%s, but got %s", path, body)
+		}
+		if res.Trailer.Get("Grpc-Status") != "0" {
+			t.Errorf("trailer must be forwarded, but got %v", res.Trailer)
+		}
+	}
+}
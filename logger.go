@@ -0,0 +1,58 @@
+package betproxy
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Logger receives the structured logs, the args are alternating keys and values like slog
+// *slog.Logger implements it, so logs can be redirected with slog.New(handler)
+type Logger interface {
+	Log(ctx context.Context, level slog.Level, msg string, args ...any)
+}
+
+// LoggerFunc is an adapter to allow the use of ordinary functions as Logger
+type LoggerFunc func(ctx context.Context, level slog.Level, msg string, args ...any)
+
+// Log calls f(ctx, level, msg, args...)
+func (f LoggerFunc) Log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	f(ctx, level, msg, args...)
+}
+
+// defaultLogger writes to slog.Default at the time of logging, it writes through the log package unless it's replaced
+type defaultLogger struct{}
+
+func (defaultLogger) Log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	slog.Default().Log(ctx, level, msg, args...)
+}
+
+// SetLogger sets the logger of the sessions, nil silences the logs
+// The service logs to slog.Default if it's not set
+func (s *Service) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// log writes the logs with the session fields
+func (s *Session) log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if s.service.logger == nil {
+		return
+	}
+	fields := []any{
+		slog.Uint64("session", s.id),
+		slog.String("client", s.conn.RemoteAddr().String()),
+		slog.Bool("tls", s.secure),
+	}
+	s.service.logger.Log(ctx, level, msg, append(fields, args...)...)
+}
+
+// logRequest writes the access log of the request
+func (s *Session) logRequest(ctx context.Context, method, url string, status int, bytes int64, duration time.Duration) {
+	s.log(ctx, slog.LevelInfo, "request",
+		slog.String("method", method),
+		slog.String("url", url),
+		slog.Int("status", status),
+		slog.Int64("bytes", bytes),
+		slog.Duration("duration", duration),
+	)
+}
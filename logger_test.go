@@ -0,0 +1,153 @@
+package betproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type logRecord struct {
+	level slog.Level
+	msg   string
+	attrs map[string]slog.Value
+}
+
+func newRecordLogger() (Logger, chan logRecord) {
+	records := make(chan logRecord, 16)
+	return LoggerFunc(func(ctx context.Context, level slog.Level, msg string, args ...any) {
+		record := slog.NewRecord(time.Now(), level, msg, 0)
+		record.Add(args...)
+		attrs := make(map[string]slog.Value)
+		record.Attrs(func(attr slog.Attr) bool {
+			attrs[attr.Key] = attr.Value
+			return true
+		})
+		records <- logRecord{level: level, msg: msg, attrs: attrs}
+	}), records
+}
+
+func waitRecord(t *testing.T, records chan logRecord, msg string) logRecord {
+	for {
+		select {
+		case record := <-records:
+			if record.msg == msg {
+				return record
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("log %q must be written", msg)
+		}
+	}
+}
+
+func Test_LoggerRequest(t *testing.T) {
+	logger, records := newRecordLogger()
+	service := newMITMService(t, echoClient())
+	defer service.Close()
+	service.SetLogger(logger)
+	go service.Listen()
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET http://example.com/get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+
+	record := waitRecord(t, records, "request")
+	if record.level != slog.LevelInfo {
+		t.Errorf("level must be INFO, but got %s", record.level)
+	}
+	if record.attrs["session"].Uint64() == 0 {
+		t.Errorf("session id must be logged")
+	}
+	if record.attrs["client"].String() != conn.LocalAddr().String() {
+		t.Errorf("client must be %s, but got %s", conn.LocalAddr(), record.attrs["client"])
+	}
+	if record.attrs["tls"].Bool() {
+		t.Errorf("tls must be false")
+	}
+	if record.attrs["method"].String() != "GET" || record.attrs["url"].String() != "http://example.com/get" {
+		t.Errorf("request must be GET http://example.com/get, but got %s %s", record.attrs["method"], record.attrs["url"])
+	}
+	if record.attrs["status"].Int64() != http.StatusOK {
+		t.Errorf("status must be 200, but got %s", record.attrs["status"])
+	}
+	if record.attrs["bytes"].Int64() != int64(len("http://example.com/get")) {
+		t.Errorf("bytes must be %d, but got %s", len("http://example.com/get"), record.attrs["bytes"])
+	}
+	if record.attrs["duration"].Kind() != slog.KindDuration {
+		t.Errorf("duration must be logged")
+	}
+}
+
+func Test_LoggerChunkedBytes(t *testing.T) {
+	logger, records := newRecordLogger()
+	conn, session := newHookSession(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		return NewResponse(http.StatusOK, nil, strings.NewReader("hello world"), req), nil
+	}))
+	session.service.SetLogger(logger)
+	go session.handleLoop()
+
+	fmt.Fprint(conn.Client, "GET http://example.com/get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+
+	if record := waitRecord(t, records, "request"); record.attrs["bytes"].Int64() != int64(len("hello world")) {
+		t.Errorf("bytes of the chunked body must be %d, but got %s", len("hello world"), record.attrs["bytes"])
+	}
+}
+
+func Test_LoggerUpstreamError(t *testing.T) {
+	logger, records := newRecordLogger()
+	conn, session := newHookSession(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}))
+	session.service.SetLogger(logger)
+
+	go session.handleLoop()
+
+	fmt.Fprint(conn.Client, "GET http://example.com/get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+
+	record := waitRecord(t, records, "upstream error")
+	if record.level != slog.LevelWarn {
+		t.Errorf("level must be WARN, but got %s", record.level)
+	}
+	if !strings.Contains(record.attrs["error"].String(), "connection refused") {
+		t.Errorf("error must be logged, but got %s", record.attrs["error"])
+	}
+}
+
+func Test_LoggerSlog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	_, session := newHookSession(echoClient())
+	session.service.SetLogger(slog.New(slog.NewTextHandler(buf, nil)))
+	session.log(context.Background(), slog.LevelError, "failed", "key", "value")
+	if !strings.Contains(buf.String(), "level=ERROR msg=failed") || !strings.Contains(buf.String(), "tls=false key=value") {
+		t.Errorf("slog.Logger must be a Logger, but got %s", buf.String())
+	}
+
+	buf.Reset()
+	session.service.SetLogger(nil)
+	session.log(context.Background(), slog.LevelError, "failed")
+	if buf.Len() != 0 {
+		t.Errorf("nil logger must silence the logs, but got %s", buf.String())
+	}
+}
@@ -0,0 +1,389 @@
+package betproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/faceair/betproxy/mitm"
+)
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the request latency histogram
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricsPath is the path that the admin listener serves the metrics on
+const MetricsPath = "/metrics"
+
+// DefaultMaxHosts is the max number of hosts labelled in the request metrics
+const DefaultMaxHosts = 1000
+
+// OtherHosts is the host label of the requests to the hosts beyond the max hosts
+const OtherHosts = "other"
+
+// NewMetrics create a Metrics instance with the DefaultLatencyBuckets
+func NewMetrics() *Metrics {
+	return &Metrics{
+		buckets:    DefaultLatencyBuckets,
+		maxHosts:   DefaultMaxHosts,
+		handshakes: make(map[handshakeLabels]uint64),
+		requests:   make(map[requestLabels]*histogram),
+		hosts:      make(map[string]bool),
+	}
+}
+
+// Metrics collects the statistics of the service and exposes them in the Prometheus text format
+// A nil *Metrics is valid and collects nothing
+type Metrics struct {
+	activeSessions int64
+	accepted       uint64
+	connects       uint64
+	received       uint64
+	sent           uint64
+	buckets        []float64
+	maxHosts       int
+	certCache      *mitm.Config
+
+	mu         sync.Mutex
+	handshakes map[handshakeLabels]uint64
+	requests   map[requestLabels]*histogram
+	hosts      map[string]bool
+}
+
+type handshakeLabels struct {
+	result string
+	reason string
+}
+
+type requestLabels struct {
+	host   string
+	status int
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// SetLatencyBuckets sets the upper bounds in seconds of the request latency histogram
+// It must be called before any request is observed
+func (m *Metrics) SetLatencyBuckets(buckets []float64) {
+	m.buckets = append([]float64(nil), buckets...)
+	sort.Float64s(m.buckets)
+}
+
+// SetMaxHosts sets the max number of hosts labelled in the request metrics
+// The requests to the other hosts are counted with the host label OtherHosts
+// It must be called before any request is observed
+func (m *Metrics) SetMaxHosts(max int) {
+	m.maxHosts = max
+}
+
+// SetMetrics collects the statistics of the sessions into the metrics
+func (s *Service) SetMetrics(metrics *Metrics) {
+	if metrics != nil {
+		metrics.certCache = s.tlsCfg
+	}
+	s.metrics = metrics
+}
+
+// ListenAdmin serves the metrics at MetricsPath on the giving address
+// It blocks until the service is closed and then returns http.ErrServerClosed
+func (s *Service) ListenAdmin(address string) error {
+	if s.metrics == nil {
+		panic("must set metrics")
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, s.metrics)
+	server := &http.Server{Handler: mux}
+
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		listener.Close()
+		return http.ErrServerClosed
+	}
+	s.admin = server
+	s.mu.Unlock()
+
+	return server.Serve(listener)
+}
+
+// closeAdmin closes the admin listener if it is started
+func (s *Service) closeAdmin() {
+	s.mu.Lock()
+	admin := s.admin
+	s.admin = nil
+	s.mu.Unlock()
+	if admin != nil {
+		admin.Close()
+	}
+}
+
+func (m *Metrics) sessionOpened() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.accepted, 1)
+	atomic.AddInt64(&m.activeSessions, 1)
+}
+
+func (m *Metrics) sessionClosed() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.activeSessions, -1)
+}
+
+func (m *Metrics) connectRequest() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.connects, 1)
+}
+
+// handshake counts the result of the TLS handshake with the client
+func (m *Metrics) handshake(err error) {
+	if m == nil {
+		return
+	}
+	labels := handshakeLabels{result: "success"}
+	if err != nil {
+		labels = handshakeLabels{result: "failure", reason: handshakeFailureReason(err)}
+	}
+	m.mu.Lock()
+	m.handshakes[labels]++
+	m.mu.Unlock()
+}
+
+// observeRequest counts the request and its latency by host and status
+func (m *Metrics) observeRequest(host string, status int, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	seconds := latency.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.hosts[host] {
+		if len(m.hosts) >= m.maxHosts {
+			host = OtherHosts
+		} else {
+			m.hosts[host] = true
+		}
+	}
+	labels := requestLabels{host: host, status: status}
+	h, ok := m.requests[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.requests[labels] = h
+	}
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// countConn counts the bytes received from and sent to the client
+func (m *Metrics) countConn(conn net.Conn) net.Conn {
+	if m == nil {
+		return conn
+	}
+	return &countingConn{Conn: conn, metrics: m}
+}
+
+// handshakeFailureReason classifies the error of the TLS handshake
+func handshakeFailureReason(err error) string {
+	var recordErr tls.RecordHeaderError
+	switch {
+	case isTimeout(err):
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed), errors.Is(err, syscall.ECONNRESET):
+		return "client_closed"
+	case errors.As(err, &recordErr):
+		return "not_tls"
+	case strings.HasPrefix(err.Error(), "remote error: "):
+		// the client sends an alert when it doesn't trust the generated certificate
+		return "client_rejected"
+	}
+	return "other"
+}
+
+// countingConn is a net.Conn which counts the transferred bytes into the metrics
+type countingConn struct {
+	net.Conn
+	metrics *Metrics
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.metrics.received, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.metrics.sent, uint64(n))
+	return n, err
+}
+
+// CloseWrite shuts down the writing side of the wrapped connection so the tunnels can be half-closed
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// unwrapConn returns the accepted connection under the countingConn
+func unwrapConn(conn net.Conn) net.Conn {
+	if c, ok := conn.(*countingConn); ok {
+		return c.Conn
+	}
+	return conn
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	cw := &countWriter{w: bufio.NewWriter(w)}
+
+	writeHeader(cw, "betproxy_sessions_active", "gauge", "Number of the sessions being served.")
+	fmt.Fprintf(cw, "betproxy_sessions_active %d\n", atomic.LoadInt64(&m.activeSessions))
+	writeHeader(cw, "betproxy_connections_accepted_total", "counter", "Number of the accepted connections.")
+	fmt.Fprintf(cw, "betproxy_connections_accepted_total %d\n", atomic.LoadUint64(&m.accepted))
+	writeHeader(cw, "betproxy_connect_requests_total", "counter", "Number of the established tunnels.")
+	fmt.Fprintf(cw, "betproxy_connect_requests_total %d\n", atomic.LoadUint64(&m.connects))
+	writeHeader(cw, "betproxy_received_bytes_total", "counter", "Bytes received from the clients.")
+	fmt.Fprintf(cw, "betproxy_received_bytes_total %d\n", atomic.LoadUint64(&m.received))
+	writeHeader(cw, "betproxy_sent_bytes_total", "counter", "Bytes sent to the clients.")
+	fmt.Fprintf(cw, "betproxy_sent_bytes_total %d\n", atomic.LoadUint64(&m.sent))
+
+	if m.certCache != nil {
+		stats := m.certCache.CacheStats()
+		writeHeader(cw, "betproxy_cert_cache_hits_total", "counter", "Number of the certificates served from the cache.")
+		fmt.Fprintf(cw, "betproxy_cert_cache_hits_total %d\n", stats.Hits)
+		writeHeader(cw, "betproxy_cert_cache_misses_total", "counter", "Number of the generated certificates.")
+		fmt.Fprintf(cw, "betproxy_cert_cache_misses_total %d\n", stats.Misses)
+		writeHeader(cw, "betproxy_cert_cache_evictions_total", "counter", "Number of the certificates evicted from the full cache.")
+		fmt.Fprintf(cw, "betproxy_cert_cache_evictions_total %d\n", stats.Evictions)
+		writeHeader(cw, "betproxy_cert_cache_expirations_total", "counter", "Number of the expired certificates removed from the cache.")
+		fmt.Fprintf(cw, "betproxy_cert_cache_expirations_total %d\n", stats.Expirations)
+		writeHeader(cw, "betproxy_cert_cache_size", "gauge", "Number of the certificates in the cache.")
+		fmt.Fprintf(cw, "betproxy_cert_cache_size %d\n", stats.Size)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	handshakes := make([]handshakeLabels, 0, len(m.handshakes))
+	for labels := range m.handshakes {
+		handshakes = append(handshakes, labels)
+	}
+	sort.Slice(handshakes, func(i, j int) bool {
+		if handshakes[i].result != handshakes[j].result {
+			return handshakes[i].result < handshakes[j].result
+		}
+		return handshakes[i].reason < handshakes[j].reason
+	})
+	writeHeader(cw, "betproxy_mitm_handshakes_total", "counter", "Number of the TLS handshakes with the clients by result and failure reason.")
+	for _, labels := range handshakes {
+		if labels.reason == "" {
+			fmt.Fprintf(cw, "betproxy_mitm_handshakes_total{result=%q} %d\n", labels.result, m.handshakes[labels])
+		} else {
+			fmt.Fprintf(cw, "betproxy_mitm_handshakes_total{result=%q,reason=%q} %d\n", labels.result, labels.reason, m.handshakes[labels])
+		}
+	}
+
+	requests := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].host != requests[j].host {
+			return requests[i].host < requests[j].host
+		}
+		return requests[i].status < requests[j].status
+	})
+	writeHeader(cw, "betproxy_requests_total", "counter", "Number of the requests by host and status.")
+	for _, labels := range requests {
+		fmt.Fprintf(cw, "betproxy_requests_total{%s} %d\n", labels.String(), m.requests[labels].count)
+	}
+	writeHeader(cw, "betproxy_request_duration_seconds", "histogram", "Latency of the requests by host and status.")
+	for _, labels := range requests {
+		h := m.requests[labels]
+		for i, bound := range m.buckets {
+			fmt.Fprintf(cw, "betproxy_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels.String(), formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(cw, "betproxy_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels.String(), h.count)
+		fmt.Fprintf(cw, "betproxy_request_duration_seconds_sum{%s} %s\n", labels.String(), formatFloat(h.sum))
+		fmt.Fprintf(cw, "betproxy_request_duration_seconds_count{%s} %d\n", labels.String(), h.count)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+func (l requestLabels) String() string {
+	return fmt.Sprintf("host=\"%s\",status=\"%d\"", escapeLabel(l.host), l.status)
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// countWriter counts the written bytes and keeps the first error
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
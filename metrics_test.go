@@ -0,0 +1,226 @@
+package betproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_MetricsNil(t *testing.T) {
+	var metrics *Metrics
+	metrics.sessionOpened()
+	metrics.connectRequest()
+	metrics.handshake(nil)
+	metrics.observeRequest("example.com", http.StatusOK, time.Second)
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	if metrics.countConn(conn) != conn {
+		t.Errorf("nil metrics must not wrap the connection")
+	}
+	n, err := metrics.WriteTo(ioutil.Discard)
+	if n != 0 || err != nil {
+		t.Errorf("nil metrics must write nothing, but got %d %v", n, err)
+	}
+}
+
+func Test_MetricsWriteTo(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.SetLatencyBuckets([]float64{1, 0.1})
+	metrics.sessionOpened()
+	metrics.sessionOpened()
+	metrics.sessionClosed()
+	metrics.connectRequest()
+	metrics.handshake(nil)
+	metrics.handshake(io.EOF)
+	metrics.observeRequest("example.com", http.StatusOK, 50*time.Millisecond)
+	metrics.observeRequest("example.com", http.StatusOK, 500*time.Millisecond)
+	metrics.observeRequest(`a"b`, http.StatusNotFound, 2*time.Second)
+
+	buf := &bytes.Buffer{}
+	n, err := metrics.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("written bytes must be %d, but got %d", buf.Len(), n)
+	}
+
+	for _, line := range []string{
+		"# TYPE betproxy_sessions_active gauge",
+		"betproxy_sessions_active 1",
+		"betproxy_connections_accepted_total 2",
+		"betproxy_connect_requests_total 1",
+		`betproxy_mitm_handshakes_total{result="success"} 1`,
+		`betproxy_mitm_handshakes_total{result="failure",reason="client_closed"} 1`,
+		`betproxy_requests_total{host="example.com",status="200"} 2`,
+		`betproxy_requests_total{host="a\"b",status="404"} 1`,
+		"# TYPE betproxy_request_duration_seconds histogram",
+		`betproxy_request_duration_seconds_bucket{host="example.com",status="200",le="0.1"} 1`,
+		`betproxy_request_duration_seconds_bucket{host="example.com",status="200",le="1"} 2`,
+		`betproxy_request_duration_seconds_bucket{host="example.com",status="200",le="+Inf"} 2`,
+		`betproxy_request_duration_seconds_sum{host="example.com",status="200"} 0.55`,
+		`betproxy_request_duration_seconds_count{host="example.com",status="200"} 2`,
+		`betproxy_request_duration_seconds_bucket{host="a\"b",status="404",le="1"} 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metrics must contain %q, but got\n%s", line, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "betproxy_cert_cache") {
+		t.Errorf("cert cache metrics must be omitted without tls config")
+	}
+}
+
+func Test_MetricsHandshakeFailureReason(t *testing.T) {
+	cases := []struct {
+		err    error
+		reason string
+	}{
+		{&timeoutError{"timeout"}, "timeout"},
+		{io.EOF, "client_closed"},
+		{fmt.Errorf("read: %w", net.ErrClosed), "client_closed"},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, "not_tls"},
+		{errors.New("remote error: tls: unknown certificate authority"), "client_rejected"},
+		{errors.New("SNI not provided"), "other"},
+	}
+	for _, c := range cases {
+		if reason := handshakeFailureReason(c.err); reason != c.reason {
+			t.Errorf("reason of %q must be %s, but got %s", c.err.Error(), c.reason, reason)
+		}
+	}
+}
+
+func Test_MetricsService(t *testing.T) {
+	service := newMITMService(t, echoClient())
+	defer service.Close()
+	service.SetMetrics(NewMetrics())
+	go service.Listen()
+
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	adminAddr := admin.Addr().String()
+	admin.Close()
+	adminDone := make(chan error, 1)
+	go func() {
+		adminDone <- service.ListenAdmin(adminAddr)
+	}()
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status code must be 200, but got %d", res.StatusCode)
+	}
+
+	tlsConn := tls.Client(&peekedConn{conn, reader}, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	fmt.Fprint(tlsConn, "GET /get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err = http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+
+	var body string
+	for i := 0; i < 100; i++ {
+		res, err := http.Get("http://" + adminAddr + MetricsPath)
+		if err == nil {
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			body = string(b)
+			if strings.Contains(body, "betproxy_requests_total{") {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, line := range []string{
+		"betproxy_sessions_active 1",
+		"betproxy_connections_accepted_total 1",
+		"betproxy_connect_requests_total 1",
+		`betproxy_mitm_handshakes_total{result="success"} 1`,
+		"betproxy_cert_cache_misses_total 1",
+		"betproxy_cert_cache_size 1",
+		`betproxy_requests_total{host="example.com",status="200"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics must contain %q, but got\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "betproxy_received_bytes_total 0\n") || strings.Contains(body, "betproxy_sent_bytes_total 0\n") {
+		t.Errorf("transferred bytes must be counted, but got\n%s", body)
+	}
+
+	service.Close()
+	select {
+	case err := <-adminDone:
+		if err != http.ErrServerClosed {
+			t.Errorf("err must be http.ErrServerClosed, but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("admin listener must be closed with the service")
+	}
+}
+
+func Test_MetricsMaxHosts(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.SetMaxHosts(2)
+	for _, host := range []string{"a.com", "b.com", "c.com", "a.com", "d.com"} {
+		metrics.observeRequest(host, http.StatusOK, time.Millisecond)
+	}
+
+	buf := &bytes.Buffer{}
+	metrics.WriteTo(buf)
+	for _, line := range []string{
+		`betproxy_requests_total{host="a.com",status="200"} 2`,
+		`betproxy_requests_total{host="b.com",status="200"} 1`,
+		`betproxy_requests_total{host="other",status="200"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metrics must contain %q, but got\n%s", line, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "c.com") {
+		t.Errorf("hosts beyond the max must not be labelled, but got\n%s", buf.String())
+	}
+}
+
+func Test_MetricsCountingConnCloseWrite(t *testing.T) {
+	listener := newTCPServer(t, func(conn net.Conn) {
+		// reply after the client has finished writing
+		data, _ := ioutil.ReadAll(conn)
+		conn.Write(data)
+	})
+	defer listener.Close()
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	conn := NewMetrics().countConn(raw)
+	defer conn.Close()
+
+	conn.Write([]byte("hello"))
+	closeWrite(conn)
+	data, err := ioutil.ReadAll(conn)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("response must be read after half-close, but got %q %v", data, err)
+	}
+}
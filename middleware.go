@@ -0,0 +1,24 @@
+package betproxy
+
+import "net/http"
+
+// ClientFunc is an adapter to allow the use of ordinary functions as Client
+type ClientFunc func(req *http.Request) (*http.Response, error)
+
+// Do calls f(req)
+func (f ClientFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Middleware wraps a Client and returns a new Client
+// A middleware can handle the request by itself (e.g. return HTTPText or HTTPError) without calling next
+type Middleware func(next Client) Client
+
+// Chain composes the middlewares around client
+// The first middleware is the outermost one, so it sees the request first and the response last
+func Chain(client Client, middlewares ...Middleware) Client {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		client = middlewares[i](client)
+	}
+	return client
+}
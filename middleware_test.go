@@ -0,0 +1,119 @@
+package betproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func tagMiddleware(tag string, trace *[]string) Middleware {
+	return func(next Client) Client {
+		return ClientFunc(func(req *http.Request) (*http.Response, error) {
+			*trace = append(*trace, tag)
+			return next.Do(req)
+		})
+	}
+}
+
+func Test_Chain(t *testing.T) {
+	trace := []string{}
+	client := ClientFunc(func(req *http.Request) (*http.Response, error) {
+		trace = append(trace, "client")
+		return HTTPText(http.StatusOK, nil, "ok", req), nil
+	})
+
+	res, err := Chain(client, tagMiddleware("a", &trace), tagMiddleware("b", &trace)).Do(&http.Request{})
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode must be 200, but got %d", res.StatusCode)
+	}
+	if len(trace) != 3 || trace[0] != "a" || trace[1] != "b" || trace[2] != "client" {
+		t.Errorf("middlewares called in wrong order: %v", trace)
+	}
+}
+
+func Test_ChainShortCircuit(t *testing.T) {
+	called := false
+	client := ClientFunc(func(req *http.Request) (*http.Response, error) {
+		called = true
+		return HTTPText(http.StatusOK, nil, "ok", req), nil
+	})
+	deny := func(next Client) Client {
+		return ClientFunc(func(req *http.Request) (*http.Response, error) {
+			return HTTPError(http.StatusForbidden, "denied", req), nil
+		})
+	}
+
+	res, err := Chain(client, deny).Do(&http.Request{})
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("StatusCode must be 403, but got %d", res.StatusCode)
+	}
+	if called {
+		t.Error("client must not be called")
+	}
+}
+
+func Test_ServiceUse(t *testing.T) {
+	trace := []string{}
+	conn := NewFakeConn()
+	service := &Service{
+		client: ClientFunc(func(req *http.Request) (*http.Response, error) {
+			trace = append(trace, "client")
+			return HTTPText(http.StatusOK, nil, req.URL.String(), req), nil
+		}),
+	}
+	service.Use(tagMiddleware("a", &trace))
+	service.Use(tagMiddleware("b", &trace))
+	session := &Session{service: service, conn: conn.Server}
+
+	go session.handleLoop()
+
+	_, err := conn.Client.Write([]byte("GET /get HTTP/1.1\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "http://example.com/get" {
+		t.Errorf("body must be http://example.com/get, but got %s", body)
+	}
+	if len(trace) != 3 || trace[0] != "a" || trace[1] != "b" || trace[2] != "client" {
+		t.Errorf("middlewares called in wrong order: %v", trace)
+	}
+}
+
+func Test_ServiceChainBuiltOnce(t *testing.T) {
+	built := 0
+	counting := func(next Client) Client {
+		built++
+		return next
+	}
+	service := &Service{client: echoClient()}
+	service.Use(counting)
+
+	for i := 0; i < 3; i++ {
+		if _, err := service.handler().Do(&http.Request{URL: &url.URL{Path: "/"}}); err != nil {
+			t.Errorf("err must be nil, but got %s", err.Error())
+		}
+	}
+	if built != 1 {
+		t.Errorf("middleware must be built once, but got %d", built)
+	}
+
+	service.Use(tagMiddleware("a", &[]string{}))
+	service.handler()
+	if built != 2 {
+		t.Errorf("chain must be rebuilt after Use, but got %d", built)
+	}
+}
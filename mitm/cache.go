@@ -0,0 +1,226 @@
+package mitm
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the default maximum number of certificates kept in the
+// cache of a Config.
+const DefaultCacheSize = 1024
+
+// certCache is a LRU cache of the generated certificates. An entry expires
+// when its certificate is no longer valid or when it is older than ttl. It
+// is not safe for concurrent use, callers must hold Config.certmu.
+type certCache struct {
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+	// gen is increased by purge, so certificates generated with a dropped key
+	// are not added back.
+	gen uint64
+
+	evictions   uint64
+	expirations uint64
+}
+
+type cacheEntry struct {
+	host    string
+	tlsc    *tls.Certificate
+	expires time.Time
+}
+
+func newCertCache(size int) *certCache {
+	return &certCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the certificate of host and marks it as recently used. An
+// expired certificate is removed.
+func (cc *certCache) get(host string, now time.Time) (*tls.Certificate, bool) {
+	e, ok := cc.items[host]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		cc.remove(e)
+		cc.expirations++
+		return nil, false
+	}
+	cc.ll.MoveToFront(e)
+	return entry.tlsc, true
+}
+
+// add adds the certificate of host, evicting the least recently used
+// certificates if the cache is full.
+func (cc *certCache) add(host string, tlsc *tls.Certificate, now time.Time) {
+	expires := tlsc.Leaf.NotAfter
+	if cc.ttl > 0 && now.Add(cc.ttl).Before(expires) {
+		expires = now.Add(cc.ttl)
+	}
+
+	if e, ok := cc.items[host]; ok {
+		entry := e.Value.(*cacheEntry)
+		entry.tlsc, entry.expires = tlsc, expires
+		cc.ll.MoveToFront(e)
+		return
+	}
+	cc.items[host] = cc.ll.PushFront(&cacheEntry{host: host, tlsc: tlsc, expires: expires})
+	cc.shrink()
+}
+
+// shrink evicts the least recently used certificates until the cache fits in
+// its size.
+func (cc *certCache) shrink() {
+	for cc.size > 0 && cc.ll.Len() > cc.size {
+		cc.remove(cc.ll.Back())
+		cc.evictions++
+	}
+}
+
+// prune removes the expired certificates and returns how many were removed.
+func (cc *certCache) prune(now time.Time) int {
+	var n int
+	for e := cc.ll.Back(); e != nil; {
+		prev := e.Prev()
+		if !now.Before(e.Value.(*cacheEntry).expires) {
+			cc.remove(e)
+			n++
+		}
+		e = prev
+	}
+	cc.expirations += uint64(n)
+	return n
+}
+
+// purge removes all the certificates.
+func (cc *certCache) purge() {
+	cc.ll.Init()
+	cc.items = make(map[string]*list.Element)
+	cc.gen++
+}
+
+func (cc *certCache) remove(e *list.Element) {
+	cc.ll.Remove(e)
+	delete(cc.items, e.Value.(*cacheEntry).host)
+}
+
+// flight is a certificate being generated for a host.
+type flight struct {
+	wg   sync.WaitGroup
+	tlsc *tls.Certificate
+	err  error
+}
+
+// flightGroup makes sure only one certificate is generated at a time for a
+// host, the concurrent callers wait for and share the result.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// do calls fn unless a call for host is in flight, in which case it waits for
+// that call and returns its result. shared reports whether the result was
+// returned by the call of another caller.
+func (g *flightGroup) do(host string, fn func() (*tls.Certificate, error)) (tlsc *tls.Certificate, err error, shared bool) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[host]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+		return f.tlsc, f.err, true
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	g.flights[host] = f
+	g.mu.Unlock()
+
+	f.tlsc, f.err = fn()
+	f.wg.Done()
+
+	g.mu.Lock()
+	delete(g.flights, host)
+	g.mu.Unlock()
+	return f.tlsc, f.err, false
+}
+
+// SetCacheSize sets the maximum number of certificates kept in the cache, the
+// least recently used certificates are evicted once it's exceeded. A size of
+// 0 or less means the cache is unbounded. It defaults to DefaultCacheSize.
+func (c *Config) SetCacheSize(size int) {
+	c.certmu.Lock()
+	defer c.certmu.Unlock()
+	c.cache.size = size
+	c.cache.shrink()
+}
+
+// SetCacheTTL sets how long a certificate is kept in the cache. Certificates
+// are never served after they expire, so a ttl of 0 keeps them as long as
+// they are valid.
+func (c *Config) SetCacheTTL(ttl time.Duration) {
+	c.certmu.Lock()
+	defer c.certmu.Unlock()
+	c.cache.ttl = ttl
+}
+
+// PruneCache removes the expired certificates from the cache and returns how
+// many were removed.
+func (c *Config) PruneCache() int {
+	c.certmu.Lock()
+	defer c.certmu.Unlock()
+	return c.cache.prune(time.Now())
+}
+
+// StartPruning removes the expired certificates from the cache every interval
+// in the background until StopPruning is called. Calling it again restarts
+// the pruning with the new interval. An interval of 0 or less stops the
+// pruning.
+func (c *Config) StartPruning(interval time.Duration) {
+	c.prunemu.Lock()
+	defer c.prunemu.Unlock()
+	c.stopPruning()
+	if interval <= 0 {
+		return
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	c.pruneStop, c.pruneDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.PruneCache()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopPruning stops the background pruning started by StartPruning and waits
+// for it to exit.
+func (c *Config) StopPruning() {
+	c.prunemu.Lock()
+	defer c.prunemu.Unlock()
+	c.stopPruning()
+}
+
+func (c *Config) stopPruning() {
+	if c.pruneStop != nil {
+		close(c.pruneStop)
+		<-c.pruneDone
+		c.pruneStop, c.pruneDone = nil, nil
+	}
+}
@@ -0,0 +1,160 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestConfig(t *testing.T) *Config {
+	t.Helper()
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+	return c
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newTestConfig(t)
+	c.SetCacheSize(2)
+
+	certs := make(map[string]*tls.Certificate)
+	for _, host := range []string{"a.example.com", "b.example.com", "a.example.com", "c.example.com"} {
+		tlsc, err := c.cert(host)
+		if err != nil {
+			t.Fatalf("c.cert(%q): got %v, want no error", host, err)
+		}
+		certs[host] = tlsc
+	}
+
+	if got, want := c.CacheStats(), (CacheStats{Hits: 1, Misses: 3, Evictions: 1, Size: 2}); got != want {
+		t.Errorf("c.CacheStats(): got %+v, want %+v", got, want)
+	}
+	// b.example.com is the least recently used.
+	if tlsc, _ := c.cert("a.example.com"); tlsc != certs["a.example.com"] {
+		t.Error("c.cert(a.example.com): got new certificate, want cached certificate")
+	}
+	if tlsc, _ := c.cert("b.example.com"); tlsc == certs["b.example.com"] {
+		t.Error("c.cert(b.example.com): got cached certificate, want new certificate")
+	}
+
+	c.SetCacheSize(1)
+	if got, want := c.CacheStats().Size, 1; got != want {
+		t.Errorf("c.CacheStats().Size: got %d, want %d", got, want)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newTestConfig(t)
+	c.SetCacheTTL(time.Minute)
+
+	tlsc, err := c.cert("example.com")
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	if _, ok := c.cache.get("example.com", time.Now().Add(59*time.Second)); !ok {
+		t.Error("c.cache.get(): got expired, want cached certificate")
+	}
+	if n := c.cache.prune(time.Now().Add(time.Minute)); n != 1 {
+		t.Errorf("c.cache.prune(): got %d, want 1", n)
+	}
+
+	tlsc2, err := c.cert("example.com")
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	if tlsc == tlsc2 {
+		t.Error("c.cert(): got expired certificate, want new certificate")
+	}
+
+	// Certificates expire with the leaf even without a ttl.
+	c.SetCacheTTL(0)
+	c.cache.add("example.org", tlsc, time.Now())
+	if _, ok := c.cache.get("example.org", tlsc.Leaf.NotAfter); ok {
+		t.Error("c.cache.get(): got cached certificate, want expired")
+	}
+
+	if got, want := c.CacheStats(), (CacheStats{Misses: 2, Expirations: 2, Size: 1}); got != want {
+		t.Errorf("c.CacheStats(): got %+v, want %+v", got, want)
+	}
+}
+
+func TestStartPruning(t *testing.T) {
+	c := newTestConfig(t)
+	c.SetCacheTTL(time.Millisecond)
+	if _, err := c.cert("example.com"); err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+
+	c.StartPruning(5 * time.Millisecond)
+	defer c.StopPruning()
+	for i := 0; i < 100 && c.CacheStats().Size != 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got, want := c.CacheStats(), (CacheStats{Misses: 1, Expirations: 1}); got != want {
+		t.Errorf("c.CacheStats(): got %+v, want %+v", got, want)
+	}
+
+	c.StartPruning(time.Hour)
+	c.StopPruning()
+	c.StopPruning()
+
+	c.StartPruning(time.Hour)
+	c.StartPruning(0)
+	if c.pruneStop != nil {
+		t.Error("c.StartPruning(0): got pruning running, want stopped")
+	}
+	c.StartPruning(-time.Second)
+	c.StopPruning()
+}
+
+func TestCertSingleflight(t *testing.T) {
+	c := newTestConfig(t)
+
+	var wg sync.WaitGroup
+	certs := make([]*tls.Certificate, 10)
+	for i := range certs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tlsc, err := c.cert("example.com:443")
+			if err != nil {
+				t.Errorf("c.cert(): got %v, want no error", err)
+			}
+			certs[i] = tlsc
+		}(i)
+	}
+	wg.Wait()
+
+	for _, tlsc := range certs[1:] {
+		if tlsc != certs[0] {
+			t.Fatal("c.cert(): got different certificates, want one shared certificate")
+		}
+	}
+	stats := c.CacheStats()
+	if got, want := stats.Misses, uint64(1); got != want {
+		t.Errorf("c.CacheStats().Misses: got %d, want %d", got, want)
+	}
+	if got, want := stats.Hits+stats.Misses, uint64(len(certs)); got != want {
+		t.Errorf("c.CacheStats().Hits+Misses: got %d, want %d", got, want)
+	}
+}
+
+func TestSetLeafKeyAlgorithmPurgesCache(t *testing.T) {
+	c := newTestConfig(t)
+	if _, err := c.cert("example.com"); err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+	if err := c.SetLeafKeyAlgorithm(ECDSAP256); err != nil {
+		t.Fatalf("c.SetLeafKeyAlgorithm(): got %v, want no error", err)
+	}
+	if got := c.CacheStats().Size; got != 0 {
+		t.Errorf("c.CacheStats().Size: got %d, want 0", got)
+	}
+}
@@ -0,0 +1,156 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// KeyAlgorithm is the algorithm of a generated private key.
+type KeyAlgorithm int
+
+const (
+	// RSA2048 is a 2048-bit RSA key, it's the default and is accepted by all
+	// clients.
+	RSA2048 KeyAlgorithm = iota
+	// RSA3072 is a 3072-bit RSA key.
+	RSA3072
+	// RSA4096 is a 4096-bit RSA key.
+	RSA4096
+	// ECDSAP256 is an ECDSA key on the P-256 curve.
+	ECDSAP256
+	// ECDSAP384 is an ECDSA key on the P-384 curve.
+	ECDSAP384
+	// Ed25519 is an Ed25519 key. Most browsers don't accept Ed25519
+	// certificates yet, so only use it when the clients are known to allow
+	// it.
+	Ed25519
+)
+
+// String returns the name of the algorithm.
+func (a KeyAlgorithm) String() string {
+	switch a {
+	case RSA2048:
+		return "RSA-2048"
+	case RSA3072:
+		return "RSA-3072"
+	case RSA4096:
+		return "RSA-4096"
+	case ECDSAP256:
+		return "ECDSA-P256"
+	case ECDSAP384:
+		return "ECDSA-P384"
+	case Ed25519:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("KeyAlgorithm(%d)", int(a))
+}
+
+// GenerateKey generates a private key of the algorithm.
+func GenerateKey(alg KeyAlgorithm) (crypto.Signer, error) {
+	switch alg {
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case RSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case Ed25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("mitm: unknown key algorithm %s", alg)
+}
+
+// LoadAuthority parses a PEM encoded CA certificate and private key. The key
+// can be encoded in PKCS#8, PKCS#1 or SEC 1 (EC PRIVATE KEY).
+func LoadAuthority(certPEM, keyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, nil, errors.New("mitm: failed to decode CA certificate")
+	}
+	ca, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	priv, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !publicKeyEqual(ca.PublicKey, priv.Public()) {
+		return nil, nil, errors.New("mitm: private key does not match CA certificate")
+	}
+	return ca, priv, nil
+}
+
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, keyPEM = pem.Decode(keyPEM)
+		if block == nil {
+			return nil, errors.New("mitm: failed to decode CA private key")
+		}
+
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			// e.g. the EC PARAMETERS block written by openssl
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("mitm: unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// subjectKeyID returns the Subject Key Identifier of the public key.
+// https://www.ietf.org/rfc/rfc3280.txt (section 4.2.1.2)
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.New()
+	h.Write(pkixpub)
+	return h.Sum(nil), nil
+}
+
+// keyUsage returns the key usage of a certificate for the public key. Key
+// encipherment is only possible with RSA keys.
+func keyUsage(pub crypto.PublicKey) x509.KeyUsage {
+	usage := x509.KeyUsageDigitalSignature
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		usage |= x509.KeyUsageKeyEncipherment
+	}
+	return usage
+}
@@ -0,0 +1,217 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+)
+
+var algorithms = []KeyAlgorithm{RSA2048, RSA3072, RSA4096, ECDSAP256, ECDSAP384, Ed25519}
+
+func TestGenerateKey(t *testing.T) {
+	for _, alg := range algorithms {
+		priv, err := GenerateKey(alg)
+		if err != nil {
+			t.Fatalf("GenerateKey(%s): got %v, want no error", alg, err)
+		}
+		var ok bool
+		switch alg {
+		case RSA2048, RSA3072, RSA4096:
+			var key *rsa.PrivateKey
+			key, ok = priv.(*rsa.PrivateKey)
+			if ok {
+				ok = key.N.BitLen() == map[KeyAlgorithm]int{RSA2048: 2048, RSA3072: 3072, RSA4096: 4096}[alg]
+			}
+		case ECDSAP256, ECDSAP384:
+			var key *ecdsa.PrivateKey
+			key, ok = priv.(*ecdsa.PrivateKey)
+			if ok {
+				ok = key.Curve.Params().Name == map[KeyAlgorithm]string{ECDSAP256: "P-256", ECDSAP384: "P-384"}[alg]
+			}
+		case Ed25519:
+			_, ok = priv.(ed25519.PrivateKey)
+		}
+		if !ok {
+			t.Errorf("GenerateKey(%s): got %T, want a key of the algorithm", alg, priv)
+		}
+	}
+
+	if _, err := GenerateKey(KeyAlgorithm(100)); err == nil {
+		t.Error("GenerateKey(100): got nil, want error")
+	}
+}
+
+func TestKeyAlgorithms(t *testing.T) {
+	for _, alg := range algorithms {
+		ca, priv, err := NewAuthorityWithAlgorithm("martian.proxy", "Martian Authority", 24*time.Hour, alg)
+		if err != nil {
+			t.Fatalf("NewAuthorityWithAlgorithm(%s): got %v, want no error", alg, err)
+		}
+		if !publicKeyEqual(ca.PublicKey, priv.Public()) {
+			t.Errorf("%s: ca.PublicKey: got mismatched key, want public key of priv", alg)
+		}
+
+		c, err := NewConfig(ca, priv)
+		if err != nil {
+			t.Fatalf("NewConfig(%s): got %v, want no error", alg, err)
+		}
+		if err := c.SetLeafKeyAlgorithm(alg); err != nil {
+			t.Fatalf("c.SetLeafKeyAlgorithm(%s): got %v, want no error", alg, err)
+		}
+
+		tlsc, err := c.cert("example.com")
+		if err != nil {
+			t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		if _, err := tlsc.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots}); err != nil {
+			t.Errorf("%s: tlsc.Leaf.Verify(): got %v, want no error", alg, err)
+		}
+
+		_, isRSA := priv.(*rsa.PrivateKey)
+		for _, cert := range []*x509.Certificate{ca, tlsc.Leaf} {
+			if got := cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0; got != isRSA {
+				t.Errorf("%s: KeyUsageKeyEncipherment: got %t, want %t", alg, got, isRSA)
+			}
+			if cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+				t.Errorf("%s: KeyUsage: got nothing, want to include x509.KeyUsageDigitalSignature", alg)
+			}
+		}
+	}
+}
+
+func TestECDSAHandshake(t *testing.T) {
+	ca, priv, err := NewAuthorityWithAlgorithm("martian.proxy", "Martian Authority", 24*time.Hour, ECDSAP256)
+	if err != nil {
+		t.Fatalf("NewAuthorityWithAlgorithm(): got %v, want no error", err)
+	}
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+	if err := c.SetLeafKeyAlgorithm(ECDSAP256); err != nil {
+		t.Fatalf("c.SetLeafKeyAlgorithm(): got %v, want no error", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	server, client := net.Pipe()
+	defer client.Close()
+	go tls.Server(server, c.TLS()).Handshake()
+
+	conn := tls.Client(client, &tls.Config{ServerName: "example.com", RootCAs: roots})
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("conn.Handshake(): got %v, want no error", err)
+	}
+	if _, ok := conn.ConnectionState().PeerCertificates[0].PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Error("PeerCertificates[0].PublicKey: got non-ECDSA key, want *ecdsa.PublicKey")
+	}
+}
+
+func TestPerHostKeys(t *testing.T) {
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+	if err := c.SetLeafKeyAlgorithm(ECDSAP256); err != nil {
+		t.Fatalf("c.SetLeafKeyAlgorithm(): got %v, want no error", err)
+	}
+
+	key := func(host string) crypto.PublicKey {
+		tlsc, err := c.cert(host)
+		if err != nil {
+			t.Fatalf("c.cert(%q): got %v, want no error", host, err)
+		}
+		return tlsc.Leaf.PublicKey
+	}
+
+	if a, b := key("a.example.com"), key("b.example.com"); !publicKeyEqual(a, b) {
+		t.Error("leaf keys: got different keys, want the shared key")
+	}
+	c.EnablePerHostKeys(true)
+	if a, b := key("c.example.com"), key("d.example.com"); publicKeyEqual(a, b) {
+		t.Error("leaf keys: got the shared key, want a key per host")
+	}
+}
+
+func TestLoadAuthority(t *testing.T) {
+	for _, tc := range []struct {
+		alg       KeyAlgorithm
+		blockType string
+		marshal   func(crypto.Signer) ([]byte, error)
+	}{
+		{RSA2048, "RSA PRIVATE KEY", func(priv crypto.Signer) ([]byte, error) {
+			return x509.MarshalPKCS1PrivateKey(priv.(*rsa.PrivateKey)), nil
+		}},
+		{ECDSAP384, "EC PRIVATE KEY", func(priv crypto.Signer) ([]byte, error) {
+			return x509.MarshalECPrivateKey(priv.(*ecdsa.PrivateKey))
+		}},
+		{Ed25519, "PRIVATE KEY", func(priv crypto.Signer) ([]byte, error) {
+			return x509.MarshalPKCS8PrivateKey(priv)
+		}},
+	} {
+		ca, priv, err := NewAuthorityWithAlgorithm("martian.proxy", "Martian Authority", 24*time.Hour, tc.alg)
+		if err != nil {
+			t.Fatalf("NewAuthorityWithAlgorithm(%s): got %v, want no error", tc.alg, err)
+		}
+		der, err := tc.marshal(priv)
+		if err != nil {
+			t.Fatalf("marshal(%s): got %v, want no error", tc.alg, err)
+		}
+
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{6, 5, 43, 129, 4, 0, 34}})
+		keyPEM = append(keyPEM, pem.EncodeToMemory(&pem.Block{Type: tc.blockType, Bytes: der})...)
+
+		loaded, signer, err := LoadAuthority(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf("LoadAuthority(%s): got %v, want no error", tc.blockType, err)
+		}
+		if !loaded.Equal(ca) {
+			t.Errorf("LoadAuthority(%s): got another certificate, want the CA", tc.blockType)
+		}
+		if !publicKeyEqual(signer.Public(), priv.Public()) {
+			t.Errorf("LoadAuthority(%s): got another key, want the CA key", tc.blockType)
+		}
+		if _, err := NewConfig(loaded, signer); err != nil {
+			t.Errorf("NewConfig(%s): got %v, want no error", tc.blockType, err)
+		}
+	}
+
+	ca, _, err := NewAuthorityWithAlgorithm("martian.proxy", "Martian Authority", 24*time.Hour, ECDSAP256)
+	if err != nil {
+		t.Fatalf("NewAuthorityWithAlgorithm(): got %v, want no error", err)
+	}
+	other, _ := GenerateKey(ECDSAP256)
+	der, _ := x509.MarshalPKCS8PrivateKey(other)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if _, _, err := LoadAuthority(certPEM, keyPEM); err == nil {
+		t.Error("LoadAuthority(mismatched key): got nil, want error")
+	}
+	if _, _, err := LoadAuthority(certPEM, nil); err == nil {
+		t.Error("LoadAuthority(no key): got nil, want error")
+	}
+}
+
+func TestNewConfigNonSigner(t *testing.T) {
+	ca, _, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+	if _, err := NewConfig(ca, "key"); err == nil {
+		t.Error("NewConfig(non-signer): got nil, want error")
+	}
+}
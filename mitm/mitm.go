@@ -19,17 +19,19 @@ package mitm
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"errors"
+	"fmt"
 	"math/big"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -42,38 +44,68 @@ var MaxSerialNumber = big.NewInt(0).SetBytes(bytes.Repeat([]byte{255}, 20))
 // capable of MITM.
 type Config struct {
 	ca                     *x509.Certificate
-	capriv                 interface{}
-	priv                   *rsa.PrivateKey
+	capriv                 crypto.Signer
+	priv                   crypto.Signer
 	keyID                  []byte
+	leafAlg                KeyAlgorithm
+	perHostKeys            bool
 	validity               time.Duration
 	org                    string
 	getCertificate         func(*tls.ClientHelloInfo) (*tls.Certificate, error)
-	roots                  *x509.CertPool
 	skipVerify             bool
+	http2                  bool
 	handshakeErrorCallback func(*http.Request, error)
 
-	certmu sync.RWMutex
-	certs  map[string]*tls.Certificate
+	certmu  sync.RWMutex
+	cache   *certCache
+	flights flightGroup
+	hits    uint64
+	misses  uint64
+
+	prunemu   sync.Mutex
+	pruneStop chan struct{}
+	pruneDone chan struct{}
+}
+
+// CacheStats are the statistics of the generated certificate cache.
+type CacheStats struct {
+	// Hits is the number of certificates served from the cache.
+	Hits uint64
+	// Misses is the number of certificates generated.
+	Misses uint64
+	// Evictions is the number of certificates evicted to keep the cache in
+	// its size.
+	Evictions uint64
+	// Expirations is the number of expired certificates removed from the
+	// cache.
+	Expirations uint64
+	// Size is the number of certificates in the cache.
+	Size int
 }
 
 // NewAuthority creates a new CA certificate and associated
 // private key.
 func NewAuthority(name, organization string, validity time.Duration) (*x509.Certificate, *rsa.PrivateKey, error) {
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	ca, priv, err := NewAuthorityWithAlgorithm(name, organization, validity, RSA2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, priv.(*rsa.PrivateKey), nil
+}
+
+// NewAuthorityWithAlgorithm creates a new CA certificate and associated
+// private key of the algorithm.
+func NewAuthorityWithAlgorithm(name, organization string, validity time.Duration, alg KeyAlgorithm) (*x509.Certificate, crypto.Signer, error) {
+	priv, err := GenerateKey(alg)
 	if err != nil {
 		return nil, nil, err
 	}
 	pub := priv.Public()
 
-	// Subject Key Identifier support for end entity certificate.
-	// https://www.ietf.org/rfc/rfc3280.txt (section 4.2.1.2)
-	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
+	keyID, err := subjectKeyID(pub)
 	if err != nil {
 		return nil, nil, err
 	}
-	h := sha1.New()
-	h.Write(pkixpub)
-	keyID := h.Sum(nil)
 
 	// TODO: keep a map of used serial numbers to avoid potentially reusing a
 	// serial multiple times.
@@ -89,7 +121,7 @@ func NewAuthority(name, organization string, validity time.Duration) (*x509.Cert
 			Organization: []string{organization},
 		},
 		SubjectKeyId:          keyID,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              keyUsage(pub) | x509.KeyUsageCertSign,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		NotBefore:             time.Now().Add(-validity),
@@ -113,37 +145,57 @@ func NewAuthority(name, organization string, validity time.Duration) (*x509.Cert
 }
 
 // NewConfig creates a MITM config using the CA certificate and
-// private key to generate on-the-fly certificates.
+// private key to generate on-the-fly certificates. The private key must be a
+// crypto.Signer, e.g. one returned by LoadAuthority. The leaf certificates
+// share a 2048-bit RSA key unless SetLeafKeyAlgorithm or EnablePerHostKeys is
+// used.
 func NewConfig(ca *x509.Certificate, privateKey interface{}) (*Config, error) {
-	roots := x509.NewCertPool()
-	roots.AddCert(ca)
+	capriv, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("mitm: CA private key of type %T is not a crypto.Signer", privateKey)
+	}
 
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
+	c := &Config{
+		ca:       ca,
+		capriv:   capriv,
+		validity: time.Hour,
+		org:      ca.Subject.Organization[0],
+		cache:    newCertCache(DefaultCacheSize),
+	}
+	if err := c.SetLeafKeyAlgorithm(RSA2048); err != nil {
 		return nil, err
 	}
-	pub := priv.Public()
+	return c, nil
+}
 
-	// Subject Key Identifier support for end entity certificate.
-	// https://www.ietf.org/rfc/rfc3280.txt (section 4.2.1.2)
-	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
+// SetLeafKeyAlgorithm generates a new key of the algorithm for the leaf
+// certificates. The certificates generated with the previous key are dropped.
+func (c *Config) SetLeafKeyAlgorithm(alg KeyAlgorithm) error {
+	priv, err := GenerateKey(alg)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	keyID, err := subjectKeyID(priv.Public())
+	if err != nil {
+		return err
 	}
-	h := sha1.New()
-	h.Write(pkixpub)
-	keyID := h.Sum(nil)
 
-	return &Config{
-		ca:       ca,
-		capriv:   privateKey,
-		priv:     priv,
-		keyID:    keyID,
-		validity: time.Hour,
-		org:      ca.Subject.Organization[0],
-		certs:    make(map[string]*tls.Certificate),
-		roots:    roots,
-	}, nil
+	c.certmu.Lock()
+	defer c.certmu.Unlock()
+	c.leafAlg = alg
+	c.priv = priv
+	c.keyID = keyID
+	c.cache.purge()
+	return nil
+}
+
+// EnablePerHostKeys generates a new key for every leaf certificate instead of
+// sharing one key among the hosts. It's slower, especially for RSA keys, but
+// a leaked key only affects one host.
+func (c *Config) EnablePerHostKeys(enable bool) {
+	c.certmu.Lock()
+	defer c.certmu.Unlock()
+	c.perHostKeys = enable
 }
 
 // SetValidity sets the validity window around the current time that the
@@ -157,6 +209,11 @@ func (c *Config) SkipTLSVerify(skip bool) {
 	c.skipVerify = skip
 }
 
+// EnableHTTP2 advertises h2 in addition to http/1.1 through ALPN.
+func (c *Config) EnableHTTP2(enable bool) {
+	c.http2 = enable
+}
+
 // SetOrganization sets the organization of the certificate.
 func (c *Config) SetOrganization(org string) {
 	c.org = org
@@ -176,6 +233,19 @@ func (c *Config) HandshakeErrorCallback(r *http.Request, err error) {
 	}
 }
 
+// CacheStats returns the statistics of the certificate cache.
+func (c *Config) CacheStats() CacheStats {
+	c.certmu.RLock()
+	defer c.certmu.RUnlock()
+	return CacheStats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Evictions:   c.cache.evictions,
+		Expirations: c.cache.expirations,
+		Size:        c.cache.ll.Len(),
+	}
+}
+
 // TLS returns a *tls.Config that will generate certificates on-the-fly using
 // the SNI extension in the TLS ClientHello.
 func (c *Config) TLS() *tls.Config {
@@ -188,7 +258,7 @@ func (c *Config) TLS() *tls.Config {
 
 			return c.cert(clientHello.ServerName)
 		},
-		NextProtos: []string{"http/1.1"},
+		NextProtos: c.nextProtos(),
 	}
 }
 
@@ -205,8 +275,15 @@ func (c *Config) TLSForHost(hostname string) *tls.Config {
 
 			return c.cert(host)
 		},
-		NextProtos: []string{"http/1.1"},
+		NextProtos: c.nextProtos(),
+	}
+}
+
+func (c *Config) nextProtos() []string {
+	if c.http2 {
+		return []string{"h2", "http/1.1"}
 	}
+	return []string{"http/1.1"}
 }
 
 func (c *Config) cert(hostname string) (*tls.Certificate, error) {
@@ -216,19 +293,50 @@ func (c *Config) cert(hostname string) (*tls.Certificate, error) {
 		hostname = host
 	}
 
-	c.certmu.RLock()
-	tlsc, ok := c.certs[hostname]
-	c.certmu.RUnlock()
+	if tlsc, ok := c.cachedCert(hostname); ok {
+		return tlsc, nil
+	}
 
-	if ok {
-		// Check validity of the certificate for hostname match, expiry, etc. In
-		// particular, if the cached certificate has expired, create a new one.
-		if _, err := tlsc.Leaf.Verify(x509.VerifyOptions{
-			DNSName: hostname,
-			Roots:   c.roots,
-		}); err == nil {
+	// Concurrent handshakes for the same host share one certificate, the
+	// callers waiting for it are counted as hits.
+	tlsc, err, shared := c.flights.do(hostname, func() (*tls.Certificate, error) {
+		if tlsc, ok := c.cachedCert(hostname); ok {
 			return tlsc, nil
 		}
+		return c.newCert(hostname)
+	})
+	if shared && err == nil {
+		atomic.AddUint64(&c.hits, 1)
+	}
+	return tlsc, err
+}
+
+// cachedCert returns the cached certificate of hostname if it hasn't expired.
+func (c *Config) cachedCert(hostname string) (*tls.Certificate, bool) {
+	c.certmu.Lock()
+	tlsc, ok := c.cache.get(hostname, time.Now())
+	c.certmu.Unlock()
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	}
+	return tlsc, ok
+}
+
+// newCert generates a certificate for hostname and adds it to the cache.
+func (c *Config) newCert(hostname string) (*tls.Certificate, error) {
+	atomic.AddUint64(&c.misses, 1)
+
+	c.certmu.RLock()
+	priv, keyID, alg, perHostKeys, gen := c.priv, c.keyID, c.leafAlg, c.perHostKeys, c.cache.gen
+	c.certmu.RUnlock()
+	var err error
+	if perHostKeys {
+		if priv, err = GenerateKey(alg); err != nil {
+			return nil, err
+		}
+		if keyID, err = subjectKeyID(priv.Public()); err != nil {
+			return nil, err
+		}
 	}
 
 	serial, err := rand.Int(rand.Reader, MaxSerialNumber)
@@ -242,8 +350,8 @@ func (c *Config) cert(hostname string) (*tls.Certificate, error) {
 			CommonName:   hostname,
 			Organization: []string{c.org},
 		},
-		SubjectKeyId:          c.keyID,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		SubjectKeyId:          keyID,
+		KeyUsage:              keyUsage(priv.Public()),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		NotBefore:             time.Now().Add(-c.validity),
@@ -256,7 +364,7 @@ func (c *Config) cert(hostname string) (*tls.Certificate, error) {
 		tmpl.DNSNames = []string{hostname}
 	}
 
-	raw, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca, c.priv.Public(), c.capriv)
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca, priv.Public(), c.capriv)
 	if err != nil {
 		return nil, err
 	}
@@ -267,14 +375,17 @@ func (c *Config) cert(hostname string) (*tls.Certificate, error) {
 		return nil, err
 	}
 
-	tlsc = &tls.Certificate{
+	tlsc := &tls.Certificate{
 		Certificate: [][]byte{raw, c.ca.Raw},
-		PrivateKey:  c.priv,
+		PrivateKey:  priv,
 		Leaf:        x509c,
 	}
 
 	c.certmu.Lock()
-	c.certs[hostname] = tlsc
+	// Don't cache a certificate of the key dropped by SetLeafKeyAlgorithm.
+	if c.cache.gen == gen {
+		c.cache.add(hostname, tlsc, time.Now())
+	}
 	c.certmu.Unlock()
 
 	return tlsc, nil
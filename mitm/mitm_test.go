@@ -104,6 +104,33 @@ func TestMITM(t *testing.T) {
 	}
 }
 
+func TestEnableHTTP2(t *testing.T) {
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+	c.EnableHTTP2(true)
+
+	protos := []string{"h2", "http/1.1"}
+	if got := c.TLS().NextProtos; !reflect.DeepEqual(got, protos) {
+		t.Errorf("c.TLS().NextProtos: got %v, want %v", got, protos)
+	}
+	if got := c.TLSForHost("example.com").NextProtos; !reflect.DeepEqual(got, protos) {
+		t.Errorf("c.TLSForHost().NextProtos: got %v, want %v", got, protos)
+	}
+
+	c.EnableHTTP2(false)
+	protos = []string{"http/1.1"}
+	if got := c.TLS().NextProtos; !reflect.DeepEqual(got, protos) {
+		t.Errorf("c.TLS().NextProtos: got %v, want %v", got, protos)
+	}
+}
+
 func TestCert(t *testing.T) {
 	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
 	if err != nil {
@@ -203,3 +230,25 @@ func TestCert(t *testing.T) {
 		t.Fatalf("x509c.IPAddresses: got %v, want %v", got, want)
 	}
 }
+
+func TestCacheStats(t *testing.T) {
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+
+	for _, host := range []string{"example.com", "example.com:443", "example.org"} {
+		if _, err := c.cert(host); err != nil {
+			t.Fatalf("c.cert(%q): got %v, want no error", host, err)
+		}
+	}
+
+	if got, want := c.CacheStats(), (CacheStats{Hits: 1, Misses: 2, Size: 2}); got != want {
+		t.Errorf("c.CacheStats(): got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+package betproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServiceOptions are the timeouts of the session phases, zero means no timeout
+type ServiceOptions struct {
+	// ReadHeaderTimeout is the time to read the request line and headers, the client gets 408 when it expires
+	ReadHeaderTimeout time.Duration
+	// IdleTimeout is the time to wait for the next request on a keep-alive connection
+	IdleTimeout time.Duration
+	// TLSHandshakeTimeout is the time to complete the handshake of the intercepted TLS connection
+	TLSHandshakeTimeout time.Duration
+	// WriteTimeout is the time to write a response to the client
+	WriteTimeout time.Duration
+	// UpstreamTimeout is the time for the client to return the response headers, the client gets 504 when it expires
+	UpstreamTimeout time.Duration
+	// DialTimeout is the time to connect to the destination of the tunnels
+	DialTimeout time.Duration
+}
+
+// SetOptions sets the timeouts of the sessions
+func (s *Service) SetOptions(options ServiceOptions) {
+	s.options = options
+}
+
+// timeoutError is returned when the upstream timeout expires
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+var errUpstreamTimeout error = &timeoutError{"upstream timeout"}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// readRequest reads the next request with the idle and header timeouts
+// It returns a nil request without error when the idle connection should be closed
+func (s *Session) readRequest(first bool, watching <-chan struct{}) (*http.Request, error) {
+	options := s.service.options
+	conn := s.transport()
+
+	if !first && options.IdleTimeout > 0 {
+		conn.SetReadDeadline(deadline(options.IdleTimeout))
+	}
+	if watching != nil {
+		<-watching
+	}
+	if !first && options.IdleTimeout > 0 {
+		if _, err := s.reader.Peek(1); err != nil {
+			if isTimeout(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	conn.SetReadDeadline(deadline(options.ReadHeaderTimeout))
+	r, err := http.ReadRequest(s.reader)
+	if err != nil {
+		if isTimeout(err) && options.ReadHeaderTimeout > 0 {
+			w := HTTPError(http.StatusRequestTimeout, http.StatusText(http.StatusRequestTimeout), nil)
+			w.Close = true
+			s.writeResponse(w)
+			return nil, nil
+		}
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return r, nil
+}
+
+// doUpstream calls the client with the upstream timeout
+// The timeout covers the response headers only, so the body can be streamed as long as it takes
+func (s *Session) doUpstream(r *http.Request) (*http.Response, error) {
+	timeout := s.service.options.UpstreamTimeout
+	if timeout <= 0 {
+		return s.service.handler().Do(r)
+	}
+
+	ctx, cancel := context.WithCancelCause(r.Context())
+	// once makes sure the timer doesn't cancel the context after Do has returned
+	var once sync.Once
+	timer := time.AfterFunc(timeout, func() {
+		once.Do(func() { cancel(errUpstreamTimeout) })
+	})
+	res, err := s.service.handler().Do(r.WithContext(ctx))
+	once.Do(func() {})
+	timer.Stop()
+	// only a failed call is a timeout, the response returned meanwhile is kept
+	if err != nil {
+		cancel(nil)
+		if errors.Is(context.Cause(ctx), errUpstreamTimeout) {
+			return nil, errUpstreamTimeout
+		}
+		return nil, err
+	}
+	if res.Body == nil {
+		cancel(nil)
+		return res, nil
+	}
+	// the body is read under the context, it's cancelled once the body is closed
+	res.Body = newCancelBody(res.Body, func() { cancel(nil) })
+	return res, nil
+}
+
+// newCancelBody calls cancel after closing the body, the upgraded body stays writable
+func newCancelBody(body io.ReadCloser, cancel func()) io.ReadCloser {
+	wrapped := &cancelBody{ReadCloser: body, cancel: cancel}
+	if w, ok := body.(io.Writer); ok {
+		return struct {
+			*cancelBody
+			io.Writer
+		}{wrapped, w}
+	}
+	return wrapped
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// writeTimeout applies the write timeout to the connection until the returned function is called
+func (s *Session) writeTimeout() func() {
+	timeout := s.service.options.WriteTimeout
+	if timeout <= 0 {
+		return func() {}
+	}
+	conn := s.transport()
+	conn.SetWriteDeadline(deadline(timeout))
+	return func() {
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,218 @@
+package betproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/faceair/betproxy/mitm"
+)
+
+func newOptionsService(t *testing.T, client Client, options ServiceOptions) *Service {
+	service := newMITMService(t, client)
+	service.SetOptions(options)
+	go service.Listen()
+	return service
+}
+
+// newMITMService returns a service with a generated CA, it's not listening yet
+func newMITMService(t *testing.T, client Client) *Service {
+	cacert, cakey, err := mitm.NewAuthority("betproxy", "faceair", 10*365*24*time.Hour)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	tlsCfg, err := mitm.NewConfig(cacert, cakey)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	service, err := NewService("127.0.0.1:0", tlsCfg)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	service.SetClient(client)
+	return service
+}
+
+func Test_OptionsReadHeaderTimeout(t *testing.T) {
+	service := newOptionsService(t, echoClient(), ServiceOptions{ReadHeaderTimeout: 50 * time.Millisecond})
+	defer service.Close()
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	fmt.Fprint(conn, "GET /get HTTP/1.1\r\nHost: example.com\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("status code must be 408, but got %d", res.StatusCode)
+	}
+	if !res.Close {
+		t.Errorf("connection must be closed")
+	}
+}
+
+func Test_OptionsIdleTimeout(t *testing.T) {
+	service := newOptionsService(t, echoClient(), ServiceOptions{IdleTimeout: 50 * time.Millisecond})
+	defer service.Close()
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "GET /get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+
+	start := time.Now()
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatalf("idle connection must be closed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("idle connection must be closed after the timeout, but took %s", elapsed)
+	}
+}
+
+func Test_OptionsUpstreamTimeout(t *testing.T) {
+	client := ClientFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+	service := newOptionsService(t, client, ServiceOptions{UpstreamTimeout: 50 * time.Millisecond})
+	defer service.Close()
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	fmt.Fprint(conn, "GET /get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status code must be 504, but got %d", res.StatusCode)
+	}
+}
+
+func Test_OptionsUpstreamTimeoutBody(t *testing.T) {
+	contexts := make(chan context.Context, 1)
+	client := ClientFunc(func(req *http.Request) (*http.Response, error) {
+		contexts <- req.Context()
+		// the body is streamed after the timeout
+		reader, writer := io.Pipe()
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			if req.Context().Err() != nil {
+				writer.CloseWithError(req.Context().Err())
+				return
+			}
+			writer.Write([]byte("finished"))
+			writer.Close()
+		}()
+		return NewResponse(http.StatusOK, nil, reader, req), nil
+	})
+	service := newOptionsService(t, client, ServiceOptions{UpstreamTimeout: 50 * time.Millisecond})
+	defer service.Close()
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	fmt.Fprint(conn, "GET /get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "finished" {
+		t.Errorf("body must be streamed after the timeout, but got %d %s", res.StatusCode, body)
+	}
+	<-contexts
+
+	_, session := newHookSession(client)
+	session.service.SetOptions(ServiceOptions{UpstreamTimeout: time.Second})
+	req, _ := http.NewRequest("GET", "http://example.com/get", nil)
+	if res, err = session.doUpstream(req); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ctx := <-contexts
+	if ctx.Err() != nil {
+		t.Errorf("upstream context must not be cancelled before the body is closed")
+	}
+	res.Body.Close()
+	if ctx.Err() == nil {
+		t.Errorf("upstream context must be cancelled once the body is closed")
+	}
+}
+
+func Test_OptionsTLSHandshakeTimeout(t *testing.T) {
+	service := newOptionsService(t, echoClient(), ServiceOptions{TLSHandshakeTimeout: 50 * time.Millisecond})
+	defer service.Close()
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status code must be 200, but got %d", res.StatusCode)
+	}
+
+	// the start of a TLS record without the rest of the ClientHello
+	conn.Write([]byte{0x16, 0x03, 0x01})
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatalf("stalled handshake must be closed")
+	}
+}
+
+func Test_OptionsWriteTimeout(t *testing.T) {
+	body := make([]byte, 1<<20)
+	client := ClientFunc(func(req *http.Request) (*http.Response, error) {
+		return HTTPText(http.StatusOK, nil, string(body), req), nil
+	})
+	server, client2 := net.Pipe()
+	defer client2.Close()
+
+	service, err := NewService("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	defer service.Close()
+	service.SetClient(client)
+	service.SetOptions(ServiceOptions{WriteTimeout: 50 * time.Millisecond})
+	session := &Session{service: service, conn: server}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.serve()
+	}()
+
+	// the response is never read, so the write must time out
+	fmt.Fprint(client2, "GET http://example.com/get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	select {
+	case err := <-done:
+		if err == nil || !isTimeout(err) {
+			t.Errorf("err must be a timeout, but got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("write must time out")
+	}
+}
@@ -0,0 +1,57 @@
+package betproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SO_ORIGINAL_DST from linux/netfilter_ipv4.h, it is the same for IP6T_SO_ORIGINAL_DST
+const soOriginalDst = 80
+
+// OriginalDst returns the destination of a connection redirected by iptables REDIRECT or DNAT
+func OriginalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("original destination is only available on tcp connections")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+
+	var address string
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if ipv6 {
+			// IPv6MTUInfo starts with a sockaddr_in6
+			var info *syscall.IPv6MTUInfo
+			info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if sockErr == nil {
+				// the port is stored in network byte order
+				port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, info.Addr.Port))
+				address = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port)))
+			}
+			return
+		}
+		// IPv6Mreq has the same size as sockaddr_in
+		var mreq *syscall.IPv6Mreq
+		mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if sockErr == nil {
+			b := mreq.Multiaddr
+			port := binary.BigEndian.Uint16(b[2:4])
+			address = net.JoinHostPort(net.IP(b[4:8]).String(), strconv.Itoa(int(port)))
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return address, sockErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package betproxy
+
+import (
+	"errors"
+	"net"
+)
+
+// OriginalDst returns the destination of a connection redirected by iptables REDIRECT or DNAT
+// It is only supported on linux
+func OriginalDst(conn net.Conn) (string, error) {
+	return "", errors.New("original destination is not supported on this platform")
+}
@@ -0,0 +1,502 @@
+package betproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PACPath is the path of the PAC file served by the proxy
+const PACPath = "/proxy.pac"
+
+// isPACRequest reports whether the request asks the proxy itself for the PAC file
+func (s *Session) isPACRequest(r *http.Request) bool {
+	return s.service.pac && !s.tunnel && r.Method == "GET" && r.URL.Path == PACPath && !r.URL.IsAbs()
+}
+
+// servePAC replies the PAC file pointing to the address the client used to reach the proxy
+func (s *Session) servePAC(r *http.Request) *http.Response {
+	proxy := r.Host
+	// the Host is put into the script, so anything but host[:port] is replaced
+	if !isHostPort(proxy) {
+		proxy = s.conn.LocalAddr().String()
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	return HTTPText(http.StatusOK, header, s.service.pacScript(proxy), r)
+}
+
+// isHostPort reports whether the value is a host name or an IP address with an optional port
+func isHostPort(value string) bool {
+	host := value
+	if h, port, err := net.SplitHostPort(value); err == nil {
+		if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+			return false
+		}
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if host == "" {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// pacScript generates the PAC file, the hosts matched by the Passthrough are connected directly
+func (s *Service) pacScript(proxy string) string {
+	b := &strings.Builder{}
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	for _, condition := range s.passthrough.pacConditions() {
+		fmt.Fprintf(b, "  if (%s) return \"DIRECT\";\n", condition)
+	}
+	fmt.Fprintf(b, "  return \"PROXY %s; DIRECT\";\n", proxy)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// pacConditions returns the rules as PAC expressions, the match func can't be expressed so it's ignored
+func (p *Passthrough) pacConditions() []string {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	nets, patterns := p.nets, p.patterns
+	p.mu.Unlock()
+
+	var conditions []string
+	for _, ipnet := range nets {
+		if ip4 := ipnet.IP.To4(); ip4 != nil && len(ipnet.Mask) == net.IPv4len {
+			conditions = append(conditions, fmt.Sprintf("isInNet(host, %q, %q)", ip4.String(), net.IP(ipnet.Mask).String()))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("isInNetEx(host, %q)", ipnet.String()))
+		}
+	}
+	for _, pattern := range patterns {
+		conditions = append(conditions, fmt.Sprintf("shExpMatch(host, %q)", pattern))
+	}
+	for _, host := range p.Learned() {
+		conditions = append(conditions, fmt.Sprintf("host == %q", host))
+	}
+	return conditions
+}
+
+// PAC is a ProxySelector evaluating FindProxyForURL of a PAC file
+// The script is run by a restricted evaluator supporting the common subset of JavaScript used by PAC files
+// The concurrent calls are evaluated by separate interpreters, so the global variables are not shared between them
+type PAC struct {
+	program []pacNode
+	now     func() time.Time
+	lookup  func(host string) ([]net.IP, error)
+	myIP    func() net.IP
+	scripts sync.Pool
+}
+
+// NewPAC create a PAC instance from the script
+func NewPAC(script string) (*PAC, error) {
+	program, err := parsePACScript(script)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := newPACScript(program)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := compiled.global.get("FindProxyForURL"); !ok {
+		return nil, fmt.Errorf("pac: FindProxyForURL is not defined")
+	}
+	pac := &PAC{program: program, now: time.Now, lookup: net.LookupIP, myIP: outboundIP}
+	pac.scripts.Put(compiled)
+	return pac, nil
+}
+
+// LoadPAC create a PAC instance from the file
+func LoadPAC(filename string) (*PAC, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewPAC(string(data))
+}
+
+// FindProxyForURL calls the function of the script
+// The DNS lookups of a call don't block the other calls
+func (p *PAC) FindProxyForURL(rawurl, host string) (string, error) {
+	script, ok := p.scripts.Get().(*pacScript)
+	if !ok {
+		var err error
+		if script, err = newPACScript(p.program); err != nil {
+			return "", err
+		}
+	}
+	defer p.scripts.Put(script)
+	script.now, script.lookup, script.myIP = p.now, p.lookup, p.myIP
+
+	fn, _ := script.global.get("FindProxyForURL")
+	result, err := script.call(fn, []pacValue{rawurl, host})
+	if err != nil {
+		return "", err
+	}
+	return pacToString(result), nil
+}
+
+// Proxy returns the first supported proxy of the script result
+// The https urls are stripped to the origin like browsers do
+func (p *PAC) Proxy(req *http.Request) (*url.URL, error) {
+	target := *req.URL
+	if target.Host == "" {
+		target.Host = req.Host
+	}
+	if target.Scheme == "" || req.Method == http.MethodConnect {
+		target.Scheme = "https"
+	}
+	if target.Scheme == "https" {
+		target = url.URL{Scheme: target.Scheme, Host: target.Host, Path: "/"}
+	}
+
+	result, err := p.FindProxyForURL(target.String(), strings.ToLower(target.Hostname()))
+	if err != nil {
+		return nil, err
+	}
+	return parsePACResult(result)
+}
+
+// parsePACResult parses results like "PROXY 10.0.0.1:3128; SOCKS5 10.0.0.2:1080; DIRECT"
+func parsePACResult(result string) (*url.URL, error) {
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		scheme := ""
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return nil, nil
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		return &url.URL{Scheme: scheme, Host: fields[1]}, nil
+	}
+	return nil, fmt.Errorf("pac: no supported proxy in %q", result)
+}
+
+// defineHelpers defines the standard PAC functions
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file
+func (p *pacScript) defineHelpers() {
+	str := func(args []pacValue, i int) string {
+		return pacToString(pacArg(args, i))
+	}
+	helpers := map[string]pacBuiltin{
+		"isPlainHostName": func(args []pacValue) (pacValue, error) {
+			return !strings.Contains(str(args, 0), "."), nil
+		},
+		"dnsDomainIs": func(args []pacValue) (pacValue, error) {
+			return strings.HasSuffix(strings.ToLower(str(args, 0)), strings.ToLower(str(args, 1))), nil
+		},
+		"localHostOrDomainIs": func(args []pacValue) (pacValue, error) {
+			host, hostdom := strings.ToLower(str(args, 0)), strings.ToLower(str(args, 1))
+			if host == hostdom {
+				return true, nil
+			}
+			return !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."), nil
+		},
+		"isResolvable": func(args []pacValue) (pacValue, error) {
+			return p.resolve(str(args, 0), true) != nil, nil
+		},
+		"isResolvableEx": func(args []pacValue) (pacValue, error) {
+			return p.resolve(str(args, 0), false) != nil, nil
+		},
+		"isInNet": func(args []pacValue) (pacValue, error) {
+			ip := p.resolve(str(args, 0), true)
+			pattern, mask := net.ParseIP(str(args, 1)).To4(), net.ParseIP(str(args, 2)).To4()
+			if ip == nil || pattern == nil || mask == nil {
+				return false, nil
+			}
+			return ip.To4().Mask(net.IPMask(mask)).Equal(pattern.Mask(net.IPMask(mask))), nil
+		},
+		"isInNetEx": func(args []pacValue) (pacValue, error) {
+			_, ipnet, err := net.ParseCIDR(str(args, 1))
+			if err != nil {
+				return false, nil
+			}
+			ip := p.resolve(str(args, 0), ipnet.IP.To4() != nil)
+			return ip != nil && ipnet.Contains(ip), nil
+		},
+		"dnsResolve": func(args []pacValue) (pacValue, error) {
+			if ip := p.resolve(str(args, 0), true); ip != nil {
+				return ip.String(), nil
+			}
+			return nil, nil
+		},
+		"dnsResolveEx": func(args []pacValue) (pacValue, error) {
+			ips, _ := p.lookupIP(str(args, 0))
+			parts := make([]string, len(ips))
+			for i, ip := range ips {
+				parts[i] = ip.String()
+			}
+			return strings.Join(parts, ";"), nil
+		},
+		"myIpAddress": func(args []pacValue) (pacValue, error) {
+			if ip := p.myIP(); ip != nil && ip.To4() != nil {
+				return ip.String(), nil
+			}
+			return "127.0.0.1", nil
+		},
+		"myIpAddressEx": func(args []pacValue) (pacValue, error) {
+			if ip := p.myIP(); ip != nil {
+				return ip.String(), nil
+			}
+			return "", nil
+		},
+		"dnsDomainLevels": func(args []pacValue) (pacValue, error) {
+			return float64(strings.Count(str(args, 0), ".")), nil
+		},
+		"convert_addr": func(args []pacValue) (pacValue, error) {
+			ip := net.ParseIP(str(args, 0)).To4()
+			if ip == nil {
+				return math.NaN(), nil
+			}
+			return float64(uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])), nil
+		},
+		"shExpMatch": func(args []pacValue) (pacValue, error) {
+			return p.shExpMatch(str(args, 0), str(args, 1)), nil
+		},
+		"weekdayRange": func(args []pacValue) (pacValue, error) {
+			return pacWeekdayRange(p.now(), args), nil
+		},
+		"dateRange": func(args []pacValue) (pacValue, error) {
+			return pacDateRange(p.now(), args), nil
+		},
+		"timeRange": func(args []pacValue) (pacValue, error) {
+			return pacTimeRange(p.now(), args), nil
+		},
+		"alert": func(args []pacValue) (pacValue, error) {
+			return pacUndefined, nil
+		},
+		"parseInt": func(args []pacValue) (pacValue, error) {
+			s := strings.TrimSpace(str(args, 0))
+			end := 0
+			for end < len(s) && (isASCIIDigit(s[end]) || (end == 0 && (s[end] == '-' || s[end] == '+'))) {
+				end++
+			}
+			n, err := strconv.ParseInt(s[:end], 10, 64)
+			if err != nil {
+				return math.NaN(), nil
+			}
+			return float64(n), nil
+		},
+	}
+	for name, fn := range helpers {
+		p.global.declare(name, fn)
+	}
+}
+
+func (p *pacScript) lookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return p.lookup(host)
+}
+
+// resolve returns the first address of the host, only IPv4 ones if ipv4 is set
+func (p *pacScript) resolve(host string, ipv4 bool) net.IP {
+	ips, err := p.lookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if !ipv4 || ip.To4() != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// shExpMatch matches the shell expression where * and ? are the only wildcards
+func (p *pacScript) shExpMatch(s, shexp string) bool {
+	re, ok := p.shExp[shexp]
+	if !ok {
+		b := &strings.Builder{}
+		b.WriteString("^")
+		for _, r := range shexp {
+			switch r {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		b.WriteString("$")
+		re = regexp.MustCompile(b.String())
+		p.shExp[shexp] = re
+	}
+	return re.MatchString(s)
+}
+
+// outboundIP returns the local address used to reach the internet, no packet is sent
+func outboundIP() net.IP {
+	conn, err := net.Dial("udp", "198.51.100.1:53")
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// pacTimeArgs strips the trailing "GMT" and converts the time accordingly
+func pacTimeArgs(now time.Time, args []pacValue) (time.Time, []pacValue) {
+	if n := len(args); n > 0 && strings.EqualFold(pacToString(args[n-1]), "GMT") {
+		return now.UTC(), args[:n-1]
+	}
+	return now.Local(), args
+}
+
+var pacWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+var pacMonths = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+func pacIndexOfName(names []string, name string) int {
+	for i, candidate := range names {
+		if strings.EqualFold(candidate, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pacInRange reports whether v is in [lo, hi], the range wraps around when lo > hi
+func pacInRange(v, lo, hi int) bool {
+	if lo <= hi {
+		return lo <= v && v <= hi
+	}
+	return v >= lo || v <= hi
+}
+
+func pacWeekdayRange(now time.Time, args []pacValue) bool {
+	now, args = pacTimeArgs(now, args)
+	if len(args) == 0 {
+		return false
+	}
+	lo := pacIndexOfName(pacWeekdays, pacToString(args[0]))
+	hi := lo
+	if len(args) > 1 {
+		hi = pacIndexOfName(pacWeekdays, pacToString(args[1]))
+	}
+	if lo < 0 || hi < 0 {
+		return false
+	}
+	return pacInRange(int(now.Weekday()), lo, hi)
+}
+
+func pacTimeRange(now time.Time, args []pacValue) bool {
+	now, args = pacTimeArgs(now, args)
+	n := make([]int, len(args))
+	for i, arg := range args {
+		n[i] = int(pacToNumber(arg))
+	}
+	seconds := now.Hour()*3600 + now.Minute()*60 + now.Second()
+	switch len(n) {
+	case 1:
+		return now.Hour() == n[0]
+	case 2:
+		return pacInRange(now.Hour(), n[0], n[1])
+	case 4:
+		return pacInRange(seconds, n[0]*3600+n[1]*60, n[2]*3600+n[3]*60+59)
+	case 6:
+		return pacInRange(seconds, n[0]*3600+n[1]*60+n[2], n[3]*3600+n[4]*60+n[5])
+	}
+	return false
+}
+
+// pacDateRange supports a single day, month or year, and ranges of them or their combinations
+func pacDateRange(now time.Time, args []pacValue) bool {
+	now, args = pacTimeArgs(now, args)
+	if len(args) == 0 || len(args) > 6 {
+		return false
+	}
+
+	type field struct {
+		kind  int // 0 day, 1 month, 2 year
+		value int
+	}
+	fields := make([]field, len(args))
+	for i, arg := range args {
+		if month := pacIndexOfName(pacMonths, pacToString(arg)); month >= 0 {
+			fields[i] = field{kind: 1, value: month}
+			continue
+		}
+		value := int(pacToNumber(arg))
+		if value > 31 {
+			fields[i] = field{kind: 2, value: value}
+		} else {
+			fields[i] = field{kind: 0, value: value}
+		}
+	}
+
+	current := func(kind int) int {
+		switch kind {
+		case 0:
+			return now.Day()
+		case 1:
+			return int(now.Month()) - 1
+		}
+		return now.Year()
+	}
+	key := func(fields []field, values func(kind int) int) int {
+		// combine the fields by significance, year > month > day
+		k := 0
+		for _, kind := range []int{2, 1, 0} {
+			for _, f := range fields {
+				if f.kind == kind {
+					k = k*10000 + values(kind)
+				}
+			}
+		}
+		return k
+	}
+	valueOf := func(fields []field) func(kind int) int {
+		return func(kind int) int {
+			for _, f := range fields {
+				if f.kind == kind {
+					return f.value
+				}
+			}
+			return 0
+		}
+	}
+
+	if len(fields) == 1 {
+		return current(fields[0].kind) == fields[0].value
+	}
+	if len(fields)%2 != 0 {
+		return false
+	}
+	lo, hi := fields[:len(fields)/2], fields[len(fields)/2:]
+	cur := key(lo, current)
+	return pacInRange(cur, key(lo, valueOf(lo)), key(hi, valueOf(hi)))
+}
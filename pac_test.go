@@ -0,0 +1,216 @@
+package betproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPACScript = `
+// route internal hosts directly
+function FindProxyForURL(url, host) {
+  if (isPlainHostName(host) || dnsDomainIs(host, ".corp.example.com")) {
+    return "DIRECT";
+  }
+  if (isInNet(host, "10.0.0.0", "255.0.0.0")) {
+    return "DIRECT";
+  }
+  if (shExpMatch(url, "https://*.socks.com/*")) {
+    return "SOCKS5 127.0.0.1:1080; DIRECT";
+  }
+  return "PROXY proxy.example.com:3128; DIRECT";
+}
+`
+
+func newTestPAC(t *testing.T, script string) *PAC {
+	pac, err := NewPAC(script)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	pac.lookup = func(host string) ([]net.IP, error) {
+		if host == "db.internal.net" {
+			return []net.IP{net.ParseIP("10.1.2.3")}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	return pac
+}
+
+func Test_PACProxy(t *testing.T) {
+	pac := newTestPAC(t, testPACScript)
+
+	cases := map[string]string{
+		"http://intranet/":              "",
+		"http://wiki.corp.example.com/": "",
+		"http://db.internal.net/":       "",
+		"https://www.socks.com/path":    "socks5://127.0.0.1:1080",
+		"http://www.google.com/":        "http://proxy.example.com:3128",
+	}
+	for target, expect := range cases {
+		req, _ := http.NewRequest("GET", target, nil)
+		proxy, err := pac.Proxy(req)
+		if err != nil {
+			t.Errorf("err must be nil, but got %s", err.Error())
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != expect {
+			t.Errorf("proxy of %s must be %q, but got %q", target, expect, got)
+		}
+	}
+}
+
+func Test_PACWithUpstream(t *testing.T) {
+	upstream := NewUpstream()
+	upstream.SetSelector(newTestPAC(t, testPACScript))
+
+	req, _ := http.NewRequest("GET", "http://www.google.com/", nil)
+	proxy, err := upstream.Proxy(req)
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	if proxy == nil || proxy.Host != "proxy.example.com:3128" {
+		t.Errorf("proxy must come from the pac, but got %v", proxy)
+	}
+}
+
+func Test_PACInvalid(t *testing.T) {
+	if _, err := NewPAC(`function Other() { return "DIRECT"; }`); err == nil {
+		t.Error("script without FindProxyForURL must be rejected")
+	}
+	if _, err := NewPAC(`function FindProxyForURL(url, host) { return "DIRECT"`); err == nil {
+		t.Error("invalid script must be rejected")
+	}
+	if _, err := parsePACResult("SOCKS4 127.0.0.1:1080"); err == nil {
+		t.Error("unsupported result must be rejected")
+	}
+}
+
+func Test_PACTimeHelpers(t *testing.T) {
+	pac := newTestPAC(t, `function FindProxyForURL(url, host) {
+  var result = [];
+  result.push(weekdayRange("MON", "FRI", "GMT"));
+  result.push(weekdayRange("SAT", "GMT"));
+  result.push(timeRange(9, 17, "GMT"));
+  result.push(timeRange(10, 30, 10, 45, "GMT"));
+  result.push(dateRange("JAN", "MAR", "GMT"));
+  result.push(dateRange(15, "GMT"));
+  result.push(dateRange(1, "FEB", 2020, 28, "FEB", 2020, "GMT"));
+  result.push(dateRange("DEC", "JAN", "GMT"));
+  return result.join(",");
+}`)
+	// Wednesday
+	pac.now = func() time.Time {
+		return time.Date(2020, 2, 12, 10, 40, 0, 0, time.UTC)
+	}
+
+	result, err := pac.FindProxyForURL("http://example.com/", "example.com")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if result != "true,false,true,true,true,false,true,false" {
+		t.Errorf("result must be true,false,true,true,true,false,true,false, but got %s", result)
+	}
+}
+
+func Test_ServicePAC(t *testing.T) {
+	passthrough, _ := NewPassthrough("*.apple.com", "10.0.0.0/8")
+	conn, session := newHookSession(echoClient())
+	session.service.SetPassthrough(passthrough)
+	session.service.EnablePAC(true)
+	session.service.SetAuthenticator(NewBasicAuth("betproxy", verifyFaceair))
+
+	go session.handleLoop()
+
+	_, err := conn.Client.Write([]byte("GET /proxy.pac HTTP/1.1\r\nHost: 192.168.1.2:3128\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode must be 200, but got %d", res.StatusCode)
+	}
+	if !strings.Contains(string(body), `return "PROXY 192.168.1.2:3128; DIRECT"`) {
+		t.Errorf("pac must point to the proxy, but got %s", body)
+	}
+
+	pac := newTestPAC(t, string(body))
+	cases := map[string]string{
+		"https://www.apple.com/": "",
+		"http://10.0.0.1/":       "",
+		"http://example.com/":    "http://192.168.1.2:3128",
+	}
+	for target, expect := range cases {
+		req, _ := http.NewRequest("GET", target, nil)
+		proxy, _ := pac.Proxy(req)
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != expect {
+			t.Errorf("proxy of %s must be %q, but got %q", target, expect, got)
+		}
+	}
+}
+
+func Test_ServicePACInvalidHost(t *testing.T) {
+	conn, session := newHookSession(echoClient())
+	session.service.EnablePAC(true)
+	go session.handleLoop()
+
+	reader := bufio.NewReader(conn.Client)
+	for _, host := range []string{`evil"; alert(1); "`, "a.com;PROXY b.com", "a.com:99999"} {
+		fmt.Fprintf(conn.Client, "GET /proxy.pac HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if !strings.Contains(string(body), `return "PROXY 127.0.0.1:10086; DIRECT"`) {
+			t.Errorf("pac must point to the local address for host %q, but got %s", host, body)
+		}
+	}
+}
+
+func Test_PACConcurrentLookup(t *testing.T) {
+	pac := newTestPAC(t, `function FindProxyForURL(url, host) {
+  if (isResolvable(host)) return "DIRECT";
+  return "PROXY proxy.example.com:3128";
+}`)
+	started, release := make(chan struct{}), make(chan struct{})
+	pac.lookup = func(host string) ([]net.IP, error) {
+		if host == "slow.example.com" {
+			close(started)
+			<-release
+		}
+		return []net.IP{net.ParseIP("10.1.2.3")}, nil
+	}
+	defer close(release)
+
+	go pac.FindProxyForURL("http://slow.example.com/", "slow.example.com")
+	<-started
+	result := make(chan string, 1)
+	go func() {
+		proxy, _ := pac.FindProxyForURL("http://fast.example.com/", "fast.example.com")
+		result <- proxy
+	}()
+	select {
+	case proxy := <-result:
+		if proxy != "DIRECT" {
+			t.Errorf("result must be DIRECT, but got %s", proxy)
+		}
+	case <-time.After(time.Second):
+		t.Error("slow lookup must not block the other calls")
+	}
+}
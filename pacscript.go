@@ -0,0 +1,1614 @@
+package betproxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The PAC evaluator supports only the subset of JavaScript used by PAC files in practice,
+// the scripts using anything else fail to compile or to run and should be served by a real engine:
+//   - statements: function declarations, var/let/const (function scoped), if/else, for(;;), while,
+//     return, break, continue and blocks
+//   - expressions: function expressions, ?:, = += -=, ++ --, || && == != === !==, < <= > >=,
+//     + - * / %, ! typeof and unary + -, calls, indexing and array literals
+//   - values: numbers, strings, booleans, null, undefined, arrays and functions
+//   - methods: length, toLowerCase, toUpperCase, trim, toString, indexOf, lastIndexOf, charAt,
+//     substring, substr, slice, split, replace (first occurrence of a string), startsWith,
+//     endsWith and includes of strings, length, push, indexOf and join of arrays
+//   - the standard PAC helpers, shExpMatch has only the * and ? wildcards
+// Objects, regexp literals, new, switch, do-while, exceptions and closures over loop variables are not supported.
+// A call runs at most pacMaxSteps steps with pacMaxDepth nested function calls.
+
+const (
+	pacMaxSteps = 1000000
+	pacMaxDepth = 200
+)
+
+var errPACSteps = errors.New("pac: script runs too long")
+
+type pacValue interface{}
+
+type pacUndefinedType struct{}
+
+var pacUndefined = pacUndefinedType{}
+
+type pacArray struct {
+	elems []pacValue
+}
+
+type pacFunction struct {
+	name   string
+	params []string
+	body   []pacNode
+	scope  *pacScope
+}
+
+type pacBuiltin func(args []pacValue) (pacValue, error)
+
+type pacScope struct {
+	vars   map[string]pacValue
+	parent *pacScope
+}
+
+func newPACScope(parent *pacScope) *pacScope {
+	return &pacScope{vars: make(map[string]pacValue), parent: parent}
+}
+
+func (s *pacScope) get(name string) (pacValue, bool) {
+	for scope := s; scope != nil; scope = scope.parent {
+		if value, ok := scope.vars[name]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func (s *pacScope) declare(name string, value pacValue) {
+	s.vars[name] = value
+}
+
+// set assigns the declared variable, undeclared ones become global like sloppy mode JavaScript
+func (s *pacScope) set(name string, value pacValue) {
+	scope := s
+	for ; scope.parent != nil; scope = scope.parent {
+		if _, ok := scope.vars[name]; ok {
+			break
+		}
+	}
+	scope.vars[name] = value
+}
+
+// pacScript is a compiled PAC file with its global scope
+type pacScript struct {
+	global  *pacScope
+	steps   int
+	depth   int
+	now     func() time.Time
+	lookup  func(host string) ([]net.IP, error)
+	myIP    func() net.IP
+	shExp   map[string]*regexp.Regexp
+	program []pacNode
+}
+
+func compilePACScript(src string) (*pacScript, error) {
+	program, err := parsePACScript(src)
+	if err != nil {
+		return nil, err
+	}
+	return newPACScript(program)
+}
+
+// parsePACScript parses the source, the program is not modified by the evaluation so it can be shared
+func parsePACScript(src string) ([]pacNode, error) {
+	tokens, err := lexPAC(src)
+	if err != nil {
+		return nil, err
+	}
+	parser := &pacParser{tokens: tokens}
+	return parser.parseProgram()
+}
+
+// newPACScript runs the top level statements of the program in a new global scope
+func newPACScript(program []pacNode) (*pacScript, error) {
+	script := &pacScript{
+		global:  newPACScope(nil),
+		now:     time.Now,
+		lookup:  net.LookupIP,
+		myIP:    outboundIP,
+		shExp:   make(map[string]*regexp.Regexp),
+		program: program,
+	}
+	script.defineHelpers()
+	if _, err := script.execBlock(program, script.global); err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+// call invokes the function with a fresh step budget
+func (p *pacScript) call(fn pacValue, args []pacValue) (pacValue, error) {
+	p.steps = 0
+	p.depth = 0
+	return p.invoke(fn, args)
+}
+
+func (p *pacScript) invoke(fn pacValue, args []pacValue) (pacValue, error) {
+	switch fn := fn.(type) {
+	case pacBuiltin:
+		return fn(args)
+	case *pacFunction:
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > pacMaxDepth {
+			return nil, errors.New("pac: call stack too deep")
+		}
+		scope := newPACScope(fn.scope)
+		for i, param := range fn.params {
+			if i < len(args) {
+				scope.declare(param, args[i])
+			} else {
+				scope.declare(param, pacUndefined)
+			}
+		}
+		scope.declare("arguments", &pacArray{elems: args})
+		result, err := p.execBlock(fn.body, scope)
+		if err != nil {
+			return nil, err
+		}
+		if result.kind == pacReturn {
+			return result.value, nil
+		}
+		return pacUndefined, nil
+	}
+	return nil, fmt.Errorf("pac: %s is not a function", pacToString(fn))
+}
+
+// lexer
+
+type pacTokenKind int
+
+const (
+	pacTokenEOF pacTokenKind = iota
+	pacTokenIdent
+	pacTokenNumber
+	pacTokenString
+	pacTokenPunct
+)
+
+type pacToken struct {
+	kind pacTokenKind
+	text string
+	num  float64
+	pos  int
+}
+
+var pacPuncts = []string{
+	"===", "!==", "==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=",
+	"{", "}", "(", ")", "[", "]", ";", ",", ".", "?", ":", "!", "<", ">", "+", "-", "*", "/", "%", "=",
+}
+
+func lexPAC(src string) ([]pacToken, error) {
+	var tokens []pacToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("pac: unterminated comment at %d", i)
+			}
+			i += end + 4
+		case c == '_' || c == '$' || isASCIILetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] == '$' || isASCIILetter(src[i]) || isASCIIDigit(src[i])) {
+				i++
+			}
+			tokens = append(tokens, pacToken{kind: pacTokenIdent, text: src[start:i], pos: start})
+		case isASCIIDigit(c) || (c == '.' && i+1 < len(src) && isASCIIDigit(src[i+1])):
+			start := i
+			if strings.HasPrefix(src[i:], "0x") || strings.HasPrefix(src[i:], "0X") {
+				i += 2
+				for i < len(src) && strings.IndexByte("0123456789abcdefABCDEF", src[i]) >= 0 {
+					i++
+				}
+				n, err := strconv.ParseUint(src[start+2:i], 16, 64)
+				if err != nil {
+					return nil, fmt.Errorf("pac: invalid number at %d", start)
+				}
+				tokens = append(tokens, pacToken{kind: pacTokenNumber, num: float64(n), pos: start})
+				continue
+			}
+			for i < len(src) && (isASCIIDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				for i < len(src) && isASCIIDigit(src[i]) {
+					i++
+				}
+			}
+			n, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("pac: invalid number at %d", start)
+			}
+			tokens = append(tokens, pacToken{kind: pacTokenNumber, num: n, pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			text, n, err := lexPACString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("pac: %s at %d", err.Error(), start)
+			}
+			i += n
+			tokens = append(tokens, pacToken{kind: pacTokenString, text: text, pos: start})
+		default:
+			matched := false
+			for _, punct := range pacPuncts {
+				if strings.HasPrefix(src[i:], punct) {
+					tokens = append(tokens, pacToken{kind: pacTokenPunct, text: punct, pos: i})
+					i += len(punct)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("pac: unexpected character %q at %d", c, i)
+			}
+		}
+	}
+	return append(tokens, pacToken{kind: pacTokenEOF, pos: len(src)}), nil
+}
+
+func lexPACString(src string) (string, int, error) {
+	quote := src[0]
+	b := &strings.Builder{}
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\n':
+			return "", 0, errors.New("unterminated string")
+		case c == '\\' && i+1 < len(src):
+			i++
+			switch e := src[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'v':
+				b.WriteByte('\v')
+			case '0':
+				b.WriteByte(0)
+			case 'x', 'u':
+				size := 2
+				if e == 'u' {
+					size = 4
+				}
+				if i+size >= len(src) {
+					return "", 0, errors.New("invalid escape")
+				}
+				r, err := strconv.ParseUint(src[i+1:i+1+size], 16, 32)
+				if err != nil {
+					return "", 0, errors.New("invalid escape")
+				}
+				b.WriteRune(rune(r))
+				i += size
+			case '\n':
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isASCIIDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parser
+
+type pacNode interface{}
+
+type (
+	pacFuncDecl struct {
+		name   string
+		params []string
+		body   []pacNode
+	}
+	pacVarStmt struct {
+		names []string
+		inits []pacNode
+	}
+	pacIfStmt struct {
+		cond      pacNode
+		then, els pacNode
+	}
+	pacForStmt struct {
+		init, cond, post pacNode
+		body             pacNode
+	}
+	pacReturnStmt struct {
+		value pacNode
+	}
+	pacBlockStmt struct {
+		list []pacNode
+	}
+	pacExprStmt struct {
+		expr pacNode
+	}
+	pacBreakStmt    struct{}
+	pacContinueStmt struct{}
+
+	pacLiteral struct {
+		value pacValue
+	}
+	pacIdent struct {
+		name string
+	}
+	pacArrayLit struct {
+		elems []pacNode
+	}
+	pacFuncLit struct {
+		decl *pacFuncDecl
+	}
+	pacUnary struct {
+		op      string
+		operand pacNode
+	}
+	pacUpdate struct {
+		op     string
+		prefix bool
+		target pacNode
+	}
+	pacBinary struct {
+		op          string
+		left, right pacNode
+	}
+	pacConditional struct {
+		cond, then, els pacNode
+	}
+	pacAssign struct {
+		op     string
+		target pacNode
+		value  pacNode
+	}
+	pacCall struct {
+		callee pacNode
+		args   []pacNode
+	}
+	pacMember struct {
+		object pacNode
+		name   string
+	}
+	pacIndex struct {
+		object, index pacNode
+	}
+)
+
+type pacParser struct {
+	tokens []pacToken
+	pos    int
+}
+
+func (p *pacParser) peek() pacToken {
+	return p.tokens[p.pos]
+}
+
+func (p *pacParser) next() pacToken {
+	token := p.tokens[p.pos]
+	if token.kind != pacTokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *pacParser) is(text string) bool {
+	token := p.peek()
+	return (token.kind == pacTokenPunct || token.kind == pacTokenIdent) && token.text == text
+}
+
+func (p *pacParser) accept(text string) bool {
+	if p.is(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *pacParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected(text)
+	}
+	return nil
+}
+
+func (p *pacParser) unexpected(want string) error {
+	token := p.peek()
+	got := token.text
+	switch token.kind {
+	case pacTokenEOF:
+		got = "end of script"
+	case pacTokenNumber:
+		got = "number"
+	case pacTokenString:
+		got = "string"
+	}
+	return fmt.Errorf("pac: expect %s but got %s at %d", want, got, token.pos)
+}
+
+func (p *pacParser) ident() (string, error) {
+	token := p.peek()
+	if token.kind != pacTokenIdent {
+		return "", p.unexpected("identifier")
+	}
+	p.pos++
+	return token.text, nil
+}
+
+func (p *pacParser) parseProgram() ([]pacNode, error) {
+	var list []pacNode
+	for p.peek().kind != pacTokenEOF {
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, stmt)
+	}
+	return list, nil
+}
+
+func (p *pacParser) parseStatement() (pacNode, error) {
+	switch {
+	case p.accept(";"):
+		return &pacBlockStmt{}, nil
+	case p.accept("{"):
+		var list []pacNode
+		for !p.accept("}") {
+			if p.peek().kind == pacTokenEOF {
+				return nil, p.unexpected("}")
+			}
+			stmt, err := p.parseStatement()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, stmt)
+		}
+		return &pacBlockStmt{list: list}, nil
+	case p.accept("function"):
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		return p.parseFunction(name)
+	case p.is("var") || p.is("let") || p.is("const"):
+		p.next()
+		stmt, err := p.parseVar()
+		if err != nil {
+			return nil, err
+		}
+		p.accept(";")
+		return stmt, nil
+	case p.accept("if"):
+		stmt := &pacIfStmt{}
+		var err error
+		if stmt.cond, err = p.parseParenExpr(); err != nil {
+			return nil, err
+		}
+		if stmt.then, err = p.parseStatement(); err != nil {
+			return nil, err
+		}
+		if p.accept("else") {
+			if stmt.els, err = p.parseStatement(); err != nil {
+				return nil, err
+			}
+		}
+		return stmt, nil
+	case p.accept("while"):
+		stmt := &pacForStmt{}
+		var err error
+		if stmt.cond, err = p.parseParenExpr(); err != nil {
+			return nil, err
+		}
+		if stmt.body, err = p.parseStatement(); err != nil {
+			return nil, err
+		}
+		return stmt, nil
+	case p.accept("for"):
+		return p.parseFor()
+	case p.accept("return"):
+		stmt := &pacReturnStmt{}
+		if !p.is(";") && !p.is("}") && p.peek().kind != pacTokenEOF {
+			var err error
+			if stmt.value, err = p.parseExpression(); err != nil {
+				return nil, err
+			}
+		}
+		p.accept(";")
+		return stmt, nil
+	case p.accept("break"):
+		p.accept(";")
+		return &pacBreakStmt{}, nil
+	case p.accept("continue"):
+		p.accept(";")
+		return &pacContinueStmt{}, nil
+	}
+
+	expr, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	p.accept(";")
+	return &pacExprStmt{expr: expr}, nil
+}
+
+func (p *pacParser) parseFunction(name string) (*pacFuncDecl, error) {
+	decl := &pacFuncDecl{name: name}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.accept(")") {
+		if len(decl.params) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		param, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		decl.params = append(decl.params, param)
+	}
+	if !p.is("{") {
+		return nil, p.unexpected("{")
+	}
+	body, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	decl.body = body.(*pacBlockStmt).list
+	return decl, nil
+}
+
+func (p *pacParser) parseVar() (*pacVarStmt, error) {
+	stmt := &pacVarStmt{}
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		var init pacNode
+		if p.accept("=") {
+			if init, err = p.parseAssignment(); err != nil {
+				return nil, err
+			}
+		}
+		stmt.names = append(stmt.names, name)
+		stmt.inits = append(stmt.inits, init)
+		if !p.accept(",") {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *pacParser) parseFor() (pacNode, error) {
+	stmt := &pacForStmt{}
+	var err error
+	if err = p.expect("("); err != nil {
+		return nil, err
+	}
+	if !p.is(";") {
+		if p.is("var") || p.is("let") || p.is("const") {
+			p.next()
+			stmt.init, err = p.parseVar()
+		} else {
+			stmt.init, err = p.parseExpression()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(";") {
+		if stmt.cond, err = p.parseExpression(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(")") {
+		if stmt.post, err = p.parseExpression(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expect(")"); err != nil {
+		return nil, err
+	}
+	if stmt.body, err = p.parseStatement(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (p *pacParser) parseParenExpr() (pacNode, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return expr, p.expect(")")
+}
+
+func (p *pacParser) parseExpression() (pacNode, error) {
+	expr, err := p.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(",") {
+		right, err := p.parseAssignment()
+		if err != nil {
+			return nil, err
+		}
+		expr = &pacBinary{op: ",", left: expr, right: right}
+	}
+	return expr, nil
+}
+
+func (p *pacParser) parseAssignment() (pacNode, error) {
+	left, err := p.parseConditional()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "+=", "-="} {
+		if p.accept(op) {
+			switch left.(type) {
+			case *pacIdent, *pacIndex:
+			default:
+				return nil, fmt.Errorf("pac: invalid assignment target at %d", p.peek().pos)
+			}
+			value, err := p.parseAssignment()
+			if err != nil {
+				return nil, err
+			}
+			return &pacAssign{op: op, target: left, value: value}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *pacParser) parseConditional() (pacNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return cond, nil
+	}
+	then, err := p.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expect(":"); err != nil {
+		return nil, err
+	}
+	els, err := p.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+	return &pacConditional{cond: cond, then: then, els: els}, nil
+}
+
+var pacBinaryLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"===", "!==", "==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *pacParser) parseBinary(level int) (pacNode, error) {
+	if level == len(pacBinaryLevels) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range pacBinaryLevels[level] {
+			if p.peek().kind == pacTokenPunct && p.peek().text == candidate {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &pacBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *pacParser) parseUnary() (pacNode, error) {
+	for _, op := range []string{"!", "-", "+", "typeof"} {
+		if p.accept(op) {
+			operand, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &pacUnary{op: op, operand: operand}, nil
+		}
+	}
+	for _, op := range []string{"++", "--"} {
+		if p.accept(op) {
+			target, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &pacUpdate{op: op, prefix: true, target: target}, nil
+		}
+	}
+
+	expr, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"++", "--"} {
+		if p.accept(op) {
+			return &pacUpdate{op: op, target: expr}, nil
+		}
+	}
+	return expr, nil
+}
+
+func (p *pacParser) parsePostfix() (pacNode, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			expr = &pacMember{object: expr, name: name}
+		case p.accept("["):
+			index, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			expr = &pacIndex{object: expr, index: index}
+		case p.accept("("):
+			call := &pacCall{callee: expr}
+			for !p.accept(")") {
+				if len(call.args) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				arg, err := p.parseAssignment()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, arg)
+			}
+			expr = call
+		default:
+			return expr, nil
+		}
+	}
+}
+
+func (p *pacParser) parsePrimary() (pacNode, error) {
+	token := p.peek()
+	switch token.kind {
+	case pacTokenNumber:
+		p.next()
+		return &pacLiteral{value: token.num}, nil
+	case pacTokenString:
+		p.next()
+		return &pacLiteral{value: token.text}, nil
+	case pacTokenIdent:
+		p.next()
+		switch token.text {
+		case "true":
+			return &pacLiteral{value: true}, nil
+		case "false":
+			return &pacLiteral{value: false}, nil
+		case "null":
+			return &pacLiteral{value: nil}, nil
+		case "undefined":
+			return &pacLiteral{value: pacUndefined}, nil
+		case "function":
+			name := ""
+			if p.peek().kind == pacTokenIdent {
+				name = p.next().text
+			}
+			decl, err := p.parseFunction(name)
+			if err != nil {
+				return nil, err
+			}
+			return &pacFuncLit{decl: decl}, nil
+		}
+		return &pacIdent{name: token.text}, nil
+	}
+
+	switch {
+	case p.accept("("):
+		expr, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	case p.accept("["):
+		array := &pacArrayLit{}
+		for !p.accept("]") {
+			if len(array.elems) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+				if p.accept("]") {
+					break
+				}
+			}
+			elem, err := p.parseAssignment()
+			if err != nil {
+				return nil, err
+			}
+			array.elems = append(array.elems, elem)
+		}
+		return array, nil
+	}
+	return nil, p.unexpected("expression")
+}
+
+// evaluator
+
+type pacCompletionKind int
+
+const (
+	pacNormal pacCompletionKind = iota
+	pacReturn
+	pacBreak
+	pacContinue
+)
+
+type pacCompletion struct {
+	kind  pacCompletionKind
+	value pacValue
+}
+
+func (p *pacScript) execBlock(list []pacNode, scope *pacScope) (pacCompletion, error) {
+	// function declarations are hoisted
+	for _, stmt := range list {
+		if decl, ok := stmt.(*pacFuncDecl); ok {
+			scope.declare(decl.name, &pacFunction{name: decl.name, params: decl.params, body: decl.body, scope: scope})
+		}
+	}
+	for _, stmt := range list {
+		result, err := p.exec(stmt, scope)
+		if err != nil || result.kind != pacNormal {
+			return result, err
+		}
+	}
+	return pacCompletion{}, nil
+}
+
+func (p *pacScript) exec(stmt pacNode, scope *pacScope) (pacCompletion, error) {
+	p.steps++
+	if p.steps > pacMaxSteps {
+		return pacCompletion{}, errPACSteps
+	}
+
+	switch stmt := stmt.(type) {
+	case *pacFuncDecl:
+		return pacCompletion{}, nil
+	case *pacBlockStmt:
+		return p.execBlock(stmt.list, scope)
+	case *pacVarStmt:
+		for i, name := range stmt.names {
+			var value pacValue = pacUndefined
+			if stmt.inits[i] != nil {
+				var err error
+				if value, err = p.eval(stmt.inits[i], scope); err != nil {
+					return pacCompletion{}, err
+				}
+			} else if existing, ok := scope.vars[name]; ok {
+				value = existing
+			}
+			scope.declare(name, value)
+		}
+		return pacCompletion{}, nil
+	case *pacIfStmt:
+		cond, err := p.eval(stmt.cond, scope)
+		if err != nil {
+			return pacCompletion{}, err
+		}
+		if pacTruthy(cond) {
+			return p.exec(stmt.then, scope)
+		}
+		if stmt.els != nil {
+			return p.exec(stmt.els, scope)
+		}
+		return pacCompletion{}, nil
+	case *pacForStmt:
+		if stmt.init != nil {
+			if _, err := p.exec(&pacExprStmt{expr: stmt.init}, scope); err != nil {
+				return pacCompletion{}, err
+			}
+		}
+		for {
+			if stmt.cond != nil {
+				cond, err := p.eval(stmt.cond, scope)
+				if err != nil {
+					return pacCompletion{}, err
+				}
+				if !pacTruthy(cond) {
+					return pacCompletion{}, nil
+				}
+			}
+			result, err := p.exec(stmt.body, scope)
+			if err != nil {
+				return pacCompletion{}, err
+			}
+			if result.kind == pacReturn {
+				return result, nil
+			}
+			if result.kind == pacBreak {
+				return pacCompletion{}, nil
+			}
+			if stmt.post != nil {
+				if _, err = p.eval(stmt.post, scope); err != nil {
+					return pacCompletion{}, err
+				}
+			}
+		}
+	case *pacReturnStmt:
+		var value pacValue = pacUndefined
+		if stmt.value != nil {
+			var err error
+			if value, err = p.eval(stmt.value, scope); err != nil {
+				return pacCompletion{}, err
+			}
+		}
+		return pacCompletion{kind: pacReturn, value: value}, nil
+	case *pacBreakStmt:
+		return pacCompletion{kind: pacBreak}, nil
+	case *pacContinueStmt:
+		return pacCompletion{kind: pacContinue}, nil
+	case *pacExprStmt:
+		if vars, ok := stmt.expr.(*pacVarStmt); ok {
+			return p.exec(vars, scope)
+		}
+		_, err := p.eval(stmt.expr, scope)
+		return pacCompletion{}, err
+	}
+	return pacCompletion{}, fmt.Errorf("pac: unknown statement %T", stmt)
+}
+
+func (p *pacScript) eval(expr pacNode, scope *pacScope) (pacValue, error) {
+	switch expr := expr.(type) {
+	case *pacLiteral:
+		return expr.value, nil
+	case *pacIdent:
+		value, ok := scope.get(expr.name)
+		if !ok {
+			return nil, fmt.Errorf("pac: %s is not defined", expr.name)
+		}
+		return value, nil
+	case *pacArrayLit:
+		array := &pacArray{elems: make([]pacValue, 0, len(expr.elems))}
+		for _, elem := range expr.elems {
+			value, err := p.eval(elem, scope)
+			if err != nil {
+				return nil, err
+			}
+			array.elems = append(array.elems, value)
+		}
+		return array, nil
+	case *pacFuncLit:
+		return &pacFunction{name: expr.decl.name, params: expr.decl.params, body: expr.decl.body, scope: scope}, nil
+	case *pacUnary:
+		operand, err := p.eval(expr.operand, scope)
+		if err != nil {
+			return nil, err
+		}
+		switch expr.op {
+		case "!":
+			return !pacTruthy(operand), nil
+		case "-":
+			return -pacToNumber(operand), nil
+		case "+":
+			return pacToNumber(operand), nil
+		default:
+			return pacTypeof(operand), nil
+		}
+	case *pacUpdate:
+		old, err := p.eval(expr.target, scope)
+		if err != nil {
+			return nil, err
+		}
+		n := pacToNumber(old)
+		updated := n + 1
+		if expr.op == "--" {
+			updated = n - 1
+		}
+		if err = p.assign(expr.target, updated, scope); err != nil {
+			return nil, err
+		}
+		if expr.prefix {
+			return updated, nil
+		}
+		return n, nil
+	case *pacBinary:
+		return p.evalBinary(expr, scope)
+	case *pacConditional:
+		cond, err := p.eval(expr.cond, scope)
+		if err != nil {
+			return nil, err
+		}
+		if pacTruthy(cond) {
+			return p.eval(expr.then, scope)
+		}
+		return p.eval(expr.els, scope)
+	case *pacAssign:
+		value, err := p.eval(expr.value, scope)
+		if err != nil {
+			return nil, err
+		}
+		if expr.op != "=" {
+			old, err := p.eval(expr.target, scope)
+			if err != nil {
+				return nil, err
+			}
+			op := "+"
+			if expr.op == "-=" {
+				op = "-"
+			}
+			value = pacArithmetic(op, old, value)
+		}
+		return value, p.assign(expr.target, value, scope)
+	case *pacCall:
+		callee, err := p.eval(expr.callee, scope)
+		if err != nil {
+			return nil, err
+		}
+		args := make([]pacValue, 0, len(expr.args))
+		for _, arg := range expr.args {
+			value, err := p.eval(arg, scope)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, value)
+		}
+		p.steps++
+		if p.steps > pacMaxSteps {
+			return nil, errPACSteps
+		}
+		return p.invoke(callee, args)
+	case *pacMember:
+		object, err := p.eval(expr.object, scope)
+		if err != nil {
+			return nil, err
+		}
+		return pacMemberOf(object, expr.name)
+	case *pacIndex:
+		object, err := p.eval(expr.object, scope)
+		if err != nil {
+			return nil, err
+		}
+		index, err := p.eval(expr.index, scope)
+		if err != nil {
+			return nil, err
+		}
+		return pacIndexOf(object, index)
+	}
+	return nil, fmt.Errorf("pac: unknown expression %T", expr)
+}
+
+func (p *pacScript) evalBinary(expr *pacBinary, scope *pacScope) (pacValue, error) {
+	left, err := p.eval(expr.left, scope)
+	if err != nil {
+		return nil, err
+	}
+	switch expr.op {
+	case "&&":
+		if !pacTruthy(left) {
+			return left, nil
+		}
+		return p.eval(expr.right, scope)
+	case "||":
+		if pacTruthy(left) {
+			return left, nil
+		}
+		return p.eval(expr.right, scope)
+	}
+
+	right, err := p.eval(expr.right, scope)
+	if err != nil {
+		return nil, err
+	}
+	switch expr.op {
+	case ",":
+		return right, nil
+	case "===":
+		return pacStrictEqual(left, right), nil
+	case "!==":
+		return !pacStrictEqual(left, right), nil
+	case "==":
+		return pacLooseEqual(left, right), nil
+	case "!=":
+		return !pacLooseEqual(left, right), nil
+	case "<", ">", "<=", ">=":
+		return pacCompare(expr.op, left, right), nil
+	}
+	return pacArithmetic(expr.op, left, right), nil
+}
+
+func (p *pacScript) assign(target pacNode, value pacValue, scope *pacScope) error {
+	switch target := target.(type) {
+	case *pacIdent:
+		scope.set(target.name, value)
+		return nil
+	case *pacIndex:
+		object, err := p.eval(target.object, scope)
+		if err != nil {
+			return err
+		}
+		index, err := p.eval(target.index, scope)
+		if err != nil {
+			return err
+		}
+		array, ok := object.(*pacArray)
+		if !ok {
+			return errors.New("pac: only array elements can be assigned")
+		}
+		i := pacToNumber(index)
+		if i < 0 || i != math.Trunc(i) || i > float64(len(array.elems)+pacMaxSteps) {
+			return errors.New("pac: invalid array index")
+		}
+		for int(i) >= len(array.elems) {
+			array.elems = append(array.elems, pacUndefined)
+		}
+		array.elems[int(i)] = value
+		return nil
+	}
+	return errors.New("pac: invalid assignment target")
+}
+
+func pacArithmetic(op string, left, right pacValue) pacValue {
+	if op == "+" {
+		_, ls := left.(string)
+		_, rs := right.(string)
+		_, la := left.(*pacArray)
+		_, ra := right.(*pacArray)
+		if ls || rs || la || ra {
+			return pacToString(left) + pacToString(right)
+		}
+	}
+	l, r := pacToNumber(left), pacToNumber(right)
+	switch op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		return l / r
+	default:
+		return math.Mod(l, r)
+	}
+}
+
+func pacCompare(op string, left, right pacValue) bool {
+	ls, lok := left.(string)
+	rs, rok := right.(string)
+	if lok && rok {
+		switch op {
+		case "<":
+			return ls < rs
+		case ">":
+			return ls > rs
+		case "<=":
+			return ls <= rs
+		default:
+			return ls >= rs
+		}
+	}
+	l, r := pacToNumber(left), pacToNumber(right)
+	switch op {
+	case "<":
+		return l < r
+	case ">":
+		return l > r
+	case "<=":
+		return l <= r
+	default:
+		return l >= r
+	}
+}
+
+func pacStrictEqual(left, right pacValue) bool {
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		return ok && l == r
+	case string:
+		r, ok := right.(string)
+		return ok && l == r
+	case bool:
+		r, ok := right.(bool)
+		return ok && l == r
+	case nil:
+		return right == nil
+	case pacUndefinedType:
+		_, ok := right.(pacUndefinedType)
+		return ok
+	case *pacArray:
+		r, ok := right.(*pacArray)
+		return ok && l == r
+	case *pacFunction:
+		r, ok := right.(*pacFunction)
+		return ok && l == r
+	}
+	return false
+}
+
+func pacLooseEqual(left, right pacValue) bool {
+	if pacStrictEqual(left, right) {
+		return true
+	}
+	lNullish := left == nil || left == pacValue(pacUndefined)
+	rNullish := right == nil || right == pacValue(pacUndefined)
+	if lNullish || rNullish {
+		return lNullish && rNullish
+	}
+	switch left.(type) {
+	case float64, string, bool:
+	default:
+		return false
+	}
+	switch right.(type) {
+	case float64, string, bool:
+	default:
+		return false
+	}
+	return pacToNumber(left) == pacToNumber(right)
+}
+
+func pacTruthy(value pacValue) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	case nil, pacUndefinedType:
+		return false
+	}
+	return true
+}
+
+func pacToNumber(value pacValue) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case nil:
+		return 0
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return 0
+		}
+		if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+			if n, err := strconv.ParseUint(s[2:], 16, 64); err == nil {
+				return float64(n)
+			}
+			return math.NaN()
+		}
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n
+		}
+	}
+	return math.NaN()
+}
+
+func pacToString(value pacValue) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		if math.IsNaN(v) {
+			return "NaN"
+		}
+		if math.IsInf(v, 0) {
+			if v > 0 {
+				return "Infinity"
+			}
+			return "-Infinity"
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return "null"
+	case pacUndefinedType:
+		return "undefined"
+	case *pacArray:
+		parts := make([]string, len(v.elems))
+		for i, elem := range v.elems {
+			if elem != nil && elem != pacValue(pacUndefined) {
+				parts[i] = pacToString(elem)
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+	return "function"
+}
+
+func pacTypeof(value pacValue) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case pacUndefinedType:
+		return "undefined"
+	case *pacFunction, pacBuiltin:
+		return "function"
+	}
+	return "object"
+}
+
+func pacIndexOf(object, index pacValue) (pacValue, error) {
+	if name, ok := index.(string); ok {
+		if _, err := strconv.Atoi(name); err != nil {
+			return pacMemberOf(object, name)
+		}
+	}
+	i := pacToNumber(index)
+	switch v := object.(type) {
+	case string:
+		if i >= 0 && i < float64(len(v)) && i == math.Trunc(i) {
+			return v[int(i) : int(i)+1], nil
+		}
+		return pacUndefined, nil
+	case *pacArray:
+		if i >= 0 && i < float64(len(v.elems)) && i == math.Trunc(i) {
+			return v.elems[int(i)], nil
+		}
+		return pacUndefined, nil
+	case nil, pacUndefinedType:
+		return nil, fmt.Errorf("pac: cannot read index of %s", pacToString(object))
+	}
+	return pacUndefined, nil
+}
+
+func pacArg(args []pacValue, i int) pacValue {
+	if i < len(args) {
+		return args[i]
+	}
+	return pacUndefined
+}
+
+// pacMemberOf returns the property or the bound method of strings and arrays
+func pacMemberOf(object pacValue, name string) (pacValue, error) {
+	switch v := object.(type) {
+	case string:
+		return pacStringMember(v, name), nil
+	case *pacArray:
+		return pacArrayMember(v, name), nil
+	case nil, pacUndefinedType:
+		return nil, fmt.Errorf("pac: cannot read property %s of %s", name, pacToString(object))
+	}
+	return pacUndefined, nil
+}
+
+func pacStringMember(s, name string) pacValue {
+	method := func(fn func(args []pacValue) pacValue) pacValue {
+		return pacBuiltin(func(args []pacValue) (pacValue, error) {
+			return fn(args), nil
+		})
+	}
+	clamp := func(value pacValue, def int) int {
+		if value == pacValue(pacUndefined) {
+			return def
+		}
+		n := pacToNumber(value)
+		if math.IsNaN(n) || n < 0 {
+			return 0
+		}
+		if n > float64(len(s)) {
+			return len(s)
+		}
+		return int(n)
+	}
+
+	switch name {
+	case "length":
+		return float64(len(s))
+	case "toLowerCase":
+		return method(func(args []pacValue) pacValue { return strings.ToLower(s) })
+	case "toUpperCase":
+		return method(func(args []pacValue) pacValue { return strings.ToUpper(s) })
+	case "trim":
+		return method(func(args []pacValue) pacValue { return strings.TrimSpace(s) })
+	case "toString":
+		return method(func(args []pacValue) pacValue { return s })
+	case "indexOf":
+		return method(func(args []pacValue) pacValue {
+			start := clamp(pacArg(args, 1), 0)
+			i := strings.Index(s[start:], pacToString(pacArg(args, 0)))
+			if i < 0 {
+				return float64(-1)
+			}
+			return float64(i + start)
+		})
+	case "lastIndexOf":
+		return method(func(args []pacValue) pacValue {
+			return float64(strings.LastIndex(s, pacToString(pacArg(args, 0))))
+		})
+	case "charAt":
+		return method(func(args []pacValue) pacValue {
+			i := clamp(pacArg(args, 0), 0)
+			if i >= len(s) {
+				return ""
+			}
+			return s[i : i+1]
+		})
+	case "substring":
+		return method(func(args []pacValue) pacValue {
+			start, end := clamp(pacArg(args, 0), 0), clamp(pacArg(args, 1), len(s))
+			if start > end {
+				start, end = end, start
+			}
+			return s[start:end]
+		})
+	case "substr":
+		return method(func(args []pacValue) pacValue {
+			start := pacToNumber(pacArg(args, 0))
+			if start < 0 {
+				start = math.Max(0, float64(len(s))+start)
+			}
+			begin := clamp(start, 0)
+			length := len(s) - begin
+			if arg := pacArg(args, 1); arg != pacValue(pacUndefined) {
+				length = int(math.Max(0, math.Min(pacToNumber(arg), float64(length))))
+			}
+			return s[begin : begin+length]
+		})
+	case "slice":
+		return method(func(args []pacValue) pacValue {
+			index := func(value pacValue, def int) int {
+				if value == pacValue(pacUndefined) {
+					return def
+				}
+				n := pacToNumber(value)
+				if n < 0 {
+					n += float64(len(s))
+				}
+				return clamp(n, def)
+			}
+			start, end := index(pacArg(args, 0), 0), index(pacArg(args, 1), len(s))
+			if start >= end {
+				return ""
+			}
+			return s[start:end]
+		})
+	case "split":
+		return method(func(args []pacValue) pacValue {
+			array := &pacArray{}
+			if pacArg(args, 0) == pacValue(pacUndefined) {
+				array.elems = append(array.elems, s)
+				return array
+			}
+			for _, part := range strings.Split(s, pacToString(pacArg(args, 0))) {
+				array.elems = append(array.elems, part)
+			}
+			return array
+		})
+	case "replace":
+		return method(func(args []pacValue) pacValue {
+			return strings.Replace(s, pacToString(pacArg(args, 0)), pacToString(pacArg(args, 1)), 1)
+		})
+	case "startsWith":
+		return method(func(args []pacValue) pacValue { return strings.HasPrefix(s, pacToString(pacArg(args, 0))) })
+	case "endsWith":
+		return method(func(args []pacValue) pacValue { return strings.HasSuffix(s, pacToString(pacArg(args, 0))) })
+	case "includes":
+		return method(func(args []pacValue) pacValue { return strings.Contains(s, pacToString(pacArg(args, 0))) })
+	}
+	return pacUndefined
+}
+
+func pacArrayMember(a *pacArray, name string) pacValue {
+	switch name {
+	case "length":
+		return float64(len(a.elems))
+	case "push":
+		return pacBuiltin(func(args []pacValue) (pacValue, error) {
+			if len(a.elems)+len(args) > pacMaxSteps {
+				return nil, errPACSteps
+			}
+			a.elems = append(a.elems, args...)
+			return float64(len(a.elems)), nil
+		})
+	case "indexOf":
+		return pacBuiltin(func(args []pacValue) (pacValue, error) {
+			for i, elem := range a.elems {
+				if pacStrictEqual(elem, pacArg(args, 0)) {
+					return float64(i), nil
+				}
+			}
+			return float64(-1), nil
+		})
+	case "join":
+		return pacBuiltin(func(args []pacValue) (pacValue, error) {
+			sep := ","
+			if arg := pacArg(args, 0); arg != pacValue(pacUndefined) {
+				sep = pacToString(arg)
+			}
+			parts := make([]string, len(a.elems))
+			for i, elem := range a.elems {
+				if elem != nil && elem != pacValue(pacUndefined) {
+					parts[i] = pacToString(elem)
+				}
+			}
+			return strings.Join(parts, sep), nil
+		})
+	}
+	return pacUndefined
+}
@@ -0,0 +1,203 @@
+package betproxy
+
+import (
+	"testing"
+)
+
+func evalPAC(t *testing.T, script string) string {
+	compiled, err := compilePACScript(script)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	fn, ok := compiled.global.get("main")
+	if !ok {
+		t.Fatal("main must be defined")
+	}
+	result, err := compiled.call(fn, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	return pacToString(result)
+}
+
+func Test_PACScriptLanguage(t *testing.T) {
+	cases := map[string]string{
+		`function main() { return 1 + 2 * 3; }`:                                                              "7",
+		`function main() { return "a" + 1 + 2; }`:                                                            "a12",
+		`function main() { var x = 5; x += 2; x++; return x; }`:                                              "8",
+		`function main() { return 1 == "1" && 1 !== "1" && null == undefined; }`:                             "true",
+		`function main() { return typeof main + typeof "" + typeof 1; }`:                                     "functionstringnumber",
+		`function main() { return "Example.COM".toLowerCase().indexOf("com"); }`:                             "8",
+		`function main() { return "a.b.c".split(".").length; }`:                                              "3",
+		`function main() { return "hello".substring(1, 3) + "hello".substr(-3, 2); }`:                        "elll",
+		`function main() { return 0 ? "yes" : "no"; }`:                                                       "no",
+		`function main() { return "" || "default"; }`:                                                        "default",
+		`function main() { var a = [1, 2]; a[3] = 4; return a.join("-"); }`:                                  "1-2--4",
+		`/* comment */ var g = 'g\'s'; function main() { return g; }`:                                        "g's",
+		`function main() { return helper(3); } function helper(n) { return n < 1 ? 0 : n + helper(n - 1); }`: "6",
+		`function main() {
+			var s = 0;
+			for (var i = 0; i < 10; i++) {
+				if (i % 2 == 0) continue;
+				if (i > 7) break;
+				s += i;
+			}
+			while (s < 100) s = s * 2;
+			return s;
+		}`: "128",
+		`function main() { var f = function(x) { return x * 2; }; return f(21); }`: "42",
+	}
+	for script, expect := range cases {
+		if got := evalPAC(t, script); got != expect {
+			t.Errorf("%s must return %s, but got %s", script, expect, got)
+		}
+	}
+}
+
+func Test_PACScriptErrors(t *testing.T) {
+	scripts := []string{
+		`function main() { return undefinedVariable; }`,
+		`function main() { while (true) {} }`,
+		`function main() { return main(); }`,
+		`function main() { return null.length; }`,
+		`function main() { return "x"(); }`,
+	}
+	for _, script := range scripts {
+		compiled, err := compilePACScript(script)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		fn, _ := compiled.global.get("main")
+		if _, err = compiled.call(fn, nil); err == nil {
+			t.Errorf("%s must fail", script)
+		}
+	}
+
+	for _, script := range []string{`function (`, `var = 1`, `"unterminated`, `1 = 2`, `@`} {
+		if _, err := compilePACScript(script); err == nil {
+			t.Errorf("%s must not compile", script)
+		}
+	}
+}
+
+func Test_PACScriptGrammar(t *testing.T) {
+	cases := map[string]string{
+		// loops
+		`function main() {
+			var s = "";
+			for (let i = 0; i < 3; i++) {
+				for (var j = 0; j < 3; j++) {
+					if (j == i) break;
+					s += i + "" + j + ",";
+				}
+			}
+			return s;
+		}`: "10,20,21,",
+		`function main() { var i = 0, n = 0; for (;;) { if (++i > 5) break; if (i % 2) continue; n += i; } return n; }`: "6",
+		`function main() { var i = 3; while (i--) {} return i; }`:                                                       "-1",
+		`function main() { var a = ["x", "y"]; var s = ""; for (var i = 0; i < a.length; i++) s += a[i]; return s; }`:   "xy",
+		// statements and expressions
+		`function main() { var x = 2; if (x > 2) return "a"; else if (x == 2) return "b"; else return "c"; }`: "b",
+		`function main() { const x = 10; var y = x; y -= 3; return y + -x + +"5"; }`:                          "2",
+		`function main() { return !0 + "," + !"" + "," + typeof undefined + "," + typeof null; }`:             "true,true,undefined,object",
+		`function main() { return 7 % 3 + "," + 7 / 2 + "," + (1 < 2 ? 3 > 2 : false); }`:                     "1,3.5,true",
+		`function main() { return "a\tb\n".length + "\x41B"; }`:                                               "4AB",
+		`var counter = 0; function main() { counter++; counter++; return counter; }`:                          "2",
+		// string and array methods
+		`function main() { return " Mixed ".trim().toUpperCase() + "a.b.a".lastIndexOf("a") + "abc".charAt(1); }`:                  "MIXED4b",
+		`function main() { return "example.com".slice(-3) + "example.com".replace("e", "E"); }`:                                    "comExample.com",
+		`function main() { var h = "www.example.com"; return h.startsWith("www.") && h.endsWith(".com") && h.includes("ample"); }`: "true",
+		`function main() { var a = []; var n = a.push("x", "y"); return n + a.indexOf("y") + a.indexOf("z"); }`:                    "2",
+		// PAC helpers
+		`function main() { return dnsDomainLevels("a.b.c") + "," + localHostOrDomainIs("www", "www.example.com") + "," + isPlainHostName("www"); }`: "2,true,true",
+		`function main() { return isInNet("10.1.2.3", "10.0.0.0", "255.0.0.0") + "," + isInNet("11.1.2.3", "10.0.0.0", "255.0.0.0"); }`:             "true,false",
+		`function main() { return convert_addr("1.2.3.4"); }`: "16909060",
+	}
+	for script, expect := range cases {
+		if got := evalPAC(t, script); got != expect {
+			t.Errorf("%s must return %s, but got %s", script, expect, got)
+		}
+	}
+}
+
+func Test_PACScriptShExpMatch(t *testing.T) {
+	cases := []struct {
+		s, shexp string
+		match    bool
+	}{
+		{"www.example.com", "*.example.com", true},
+		{"example.com", "*.example.com", false},
+		{"", "*", true},
+		{"a", "?", true},
+		{"ab", "?", false},
+		{"axb", "a.b", false},
+		{"a.b", "a.b", true},
+		{"a+b", "a+b", true},
+		{"[abc]", "[abc]", true},
+		{"a", "[abc]", false},
+		{"Example.com", "example.com", false},
+		{"http://host/path?q=1", "http://host/*", true},
+	}
+	script, err := compilePACScript("")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	fn, _ := script.global.get("shExpMatch")
+	for _, c := range cases {
+		result, err := script.call(fn, []pacValue{c.s, c.shexp})
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		if result != c.match {
+			t.Errorf("shExpMatch(%q, %q) must be %v, but got %v", c.s, c.shexp, c.match, result)
+		}
+	}
+}
+
+func Test_PACScriptLimits(t *testing.T) {
+	limits := map[string]error{
+		`function main() { for (var i = 0; ; i++) {} }`:                                errPACSteps,
+		`function main() { var s = 0; while (s >= 0) s++; return s; }`:                 errPACSteps,
+		`function main() { return deep(0); } function deep(n) { return deep(n + 1); }`: nil,
+		`function main() { var a = []; a[100000000] = 1; return a.length; }`:           nil,
+	}
+	for script, expect := range limits {
+		compiled, err := compilePACScript(script)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		fn, _ := compiled.global.get("main")
+		if _, err = compiled.call(fn, nil); err == nil || (expect != nil && err != expect) {
+			t.Errorf("%s must fail with %v, but got %v", script, expect, err)
+		}
+	}
+
+	// the budget is reset for every call
+	compiled, _ := compilePACScript(`function main() { for (var i = 0; i < 100000; i++) {} return i; }`)
+	fn, _ := compiled.global.get("main")
+	for i := 0; i < 20; i++ {
+		if _, err := compiled.call(fn, nil); err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+	}
+}
+
+func Test_PACScriptUnsupported(t *testing.T) {
+	for _, script := range []string{
+		`function main() { return /a+/.test("aa"); }`,
+		`function main() { var o = {a: 1}; return o.a; }`,
+		`function main() { try { return 1; } catch (e) { return 2; } }`,
+		`function main() { switch (1) { case 1: return 1; } }`,
+		`function main() { do { } while (false); }`,
+		`function main() { return new Date(); }`,
+	} {
+		compiled, err := compilePACScript(script)
+		if err != nil {
+			continue
+		}
+		fn, _ := compiled.global.get("main")
+		if _, err = compiled.call(fn, nil); err == nil {
+			t.Errorf("%s must be rejected", script)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package betproxy
+
+import (
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLearnThreshold is the number of failed handshakes after which a host is tunnelled without MITM
+const DefaultLearnThreshold = 3
+
+// failureWindow is how long a failed handshake counts towards the threshold
+const failureWindow = 10 * time.Minute
+
+// maxFailures is the max number of hosts whose failed handshakes are remembered
+const maxFailures = 4096
+
+// Passthrough decides which CONNECT requests are tunnelled to the destination without MITM
+// Apps with certificate pinning reject the forged certificates, so their hosts should be passed through
+type Passthrough struct {
+	mu        sync.Mutex
+	patterns  []string
+	nets      []*net.IPNet
+	matchFunc func(host string) bool
+	threshold int
+	failures  map[string]*handshakeFailures
+	learned   map[string]bool
+}
+
+// handshakeFailures counts the failed handshakes of a host since first
+type handshakeFailures struct {
+	count int
+	first time.Time
+}
+
+// NewPassthrough create a Passthrough instance
+// Every rule is either a CIDR (10.0.0.0/8), an IP, or a host pattern (*.apple.com) matched by path.Match
+func NewPassthrough(rules ...string) (*Passthrough, error) {
+	p := &Passthrough{
+		threshold: DefaultLearnThreshold,
+		failures:  make(map[string]*handshakeFailures),
+		learned:   make(map[string]bool),
+	}
+	for _, rule := range rules {
+		if err := p.Add(rule); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Add appends a rule, see NewPassthrough for the rule format
+// It is safe to add rules while the service is running
+func (p *Passthrough) Add(rule string) error {
+	if strings.Contains(rule, "/") {
+		_, ipnet, err := net.ParseCIDR(rule)
+		if err != nil {
+			return err
+		}
+		p.addNet(ipnet)
+		return nil
+	}
+	if ip := net.ParseIP(rule); ip != nil {
+		p.addNet(&net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		return nil
+	}
+	rule = strings.ToLower(rule)
+	if _, err := path.Match(rule, ""); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.patterns = append(p.patterns, rule)
+	return nil
+}
+
+func (p *Passthrough) addNet(ipnet *net.IPNet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nets = append(p.nets, ipnet)
+}
+
+// SetMatchFunc sets a callback which is consulted after the rules
+func (p *Passthrough) SetMatchFunc(fn func(host string) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.matchFunc = fn
+}
+
+// SetLearnThreshold sets the number of failed handshakes after which the host is passed through
+// Zero disables the learning
+func (p *Passthrough) SetLearnThreshold(threshold int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.threshold = threshold
+}
+
+// Match reports whether the host should be passed through, the host may contain a port
+func (p *Passthrough) Match(host string) bool {
+	if p == nil {
+		return false
+	}
+	host = strings.ToLower(stripPort(host))
+	if p.matchRules(host) {
+		return true
+	}
+
+	p.mu.Lock()
+	matchFunc := p.matchFunc
+	p.mu.Unlock()
+	// the callback is called without the lock, so it can use the Passthrough
+	return matchFunc != nil && matchFunc(host)
+}
+
+// matchRules matches the host against the rules and the learned hosts
+func (p *Passthrough) matchRules(host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipnet := range p.nets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, pattern := range p.patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return p.learned[host]
+}
+
+// Learned returns the hosts added by failed handshakes
+func (p *Passthrough) Learned() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hosts := make([]string, 0, len(p.learned))
+	for host := range p.learned {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Forget removes the host from the learned hosts
+func (p *Passthrough) Forget(host string) {
+	host = strings.ToLower(stripPort(host))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.learned, host)
+	delete(p.failures, host)
+}
+
+func (p *Passthrough) handshakeFailed(host string) {
+	if p == nil {
+		return
+	}
+	host = strings.ToLower(stripPort(host))
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.threshold <= 0 {
+		return
+	}
+	f := p.failures[host]
+	if f == nil || now.Sub(f.first) > failureWindow {
+		if f == nil && len(p.failures) >= maxFailures {
+			p.evictFailures(now)
+		}
+		f = &handshakeFailures{first: now}
+		p.failures[host] = f
+	}
+	f.count++
+	if f.count >= p.threshold {
+		p.learned[host] = true
+		delete(p.failures, host)
+	}
+}
+
+// evictFailures drops the expired failures, and the oldest one if there are still too many
+func (p *Passthrough) evictFailures(now time.Time) {
+	var oldest string
+	for host, f := range p.failures {
+		if now.Sub(f.first) > failureWindow {
+			delete(p.failures, host)
+		} else if oldest == "" || f.first.Before(p.failures[oldest].first) {
+			oldest = host
+		}
+	}
+	if len(p.failures) >= maxFailures {
+		delete(p.failures, oldest)
+	}
+}
+
+func (p *Passthrough) handshakeSucceeded(host string) {
+	if p == nil {
+		return
+	}
+	host = strings.ToLower(stripPort(host))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.failures, host)
+}
+
+func stripPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.Trim(hostport, "[]")
+}
@@ -0,0 +1,224 @@
+package betproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/faceair/betproxy/mitm"
+)
+
+func Test_NewPassthrough(t *testing.T) {
+	_, err := NewPassthrough("10.0.0.0/33")
+	if err == nil {
+		t.Error("must error, but got nil")
+	}
+	_, err = NewPassthrough("[")
+	if err == nil {
+		t.Error("must error, but got nil")
+	}
+
+	p, err := NewPassthrough("10.0.0.0/8", "::1", "*.apple.com", "pinned.com")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	p.SetMatchFunc(func(host string) bool {
+		return host == "callback.com"
+	})
+
+	cases := map[string]bool{
+		"10.1.2.3:443":      true,
+		"[::1]:443":         true,
+		"11.0.0.1:443":      false,
+		"api.apple.com":     true,
+		"API.Apple.com:443": true,
+		"apple.com:443":     false,
+		"pinned.com:443":    true,
+		"callback.com:443":  true,
+		"example.com:443":   false,
+	}
+	for host, want := range cases {
+		if got := p.Match(host); got != want {
+			t.Errorf("Match(%s) must be %v, but got %v", host, want, got)
+		}
+	}
+
+	var nilPassthrough *Passthrough
+	if nilPassthrough.Match("example.com") {
+		t.Error("nil passthrough must not match")
+	}
+}
+
+func Test_PassthroughLearn(t *testing.T) {
+	p, err := NewPassthrough()
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	p.SetLearnThreshold(2)
+
+	p.handshakeFailed("pinned.com:443")
+	p.handshakeSucceeded("pinned.com:443")
+	p.handshakeFailed("pinned.com:443")
+	if p.Match("pinned.com:443") {
+		t.Error("host must not be learned before threshold")
+	}
+	p.handshakeFailed("pinned.com:443")
+	if !p.Match("pinned.com:443") {
+		t.Error("host must be learned after threshold")
+	}
+	if got := p.Learned(); !reflect.DeepEqual(got, []string{"pinned.com"}) {
+		t.Errorf("learned hosts not match, got %v", got)
+	}
+
+	p.Forget("pinned.com")
+	if p.Match("pinned.com:443") {
+		t.Error("host must be forgotten")
+	}
+}
+
+func Test_PassthroughFailuresExpire(t *testing.T) {
+	p, err := NewPassthrough()
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	p.SetLearnThreshold(2)
+
+	p.handshakeFailed("pinned.com:443")
+	p.failures["pinned.com"].first = time.Now().Add(-2 * failureWindow)
+	p.handshakeFailed("pinned.com:443")
+	if p.Match("pinned.com:443") {
+		t.Error("expired failures must not count")
+	}
+
+	for i := 0; i < maxFailures+10; i++ {
+		p.handshakeFailed(fmt.Sprintf("host%d.com", i))
+	}
+	if len(p.failures) > maxFailures {
+		t.Errorf("failures must be capped, but got %d", len(p.failures))
+	}
+}
+
+func Test_PassthroughAddConcurrent(t *testing.T) {
+	p, err := NewPassthrough()
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			p.Add(fmt.Sprintf("host%d.com", i))
+			p.Add(fmt.Sprintf("10.0.%d.0/24", i))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		p.Match("host99.com")
+		p.Match("10.0.99.1")
+	}
+	<-done
+	if !p.Match("host99.com") || !p.Match("10.0.99.1") {
+		t.Error("added rules must be matched")
+	}
+}
+
+func Test_SessionPassthrough(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	passthrough, err := NewPassthrough("127.0.0.1")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	conn := NewFakeConn()
+	service := &Service{client: echoClient()}
+	service.SetPassthrough(passthrough)
+	session := &Session{service: service, conn: conn.Server}
+
+	go session.handleLoop()
+
+	_, err = fmt.Fprintf(conn.Client, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("res.StatusCode must be 200, but got %d", res.StatusCode)
+	}
+
+	// the certificate of origin server must be trusted since the connection is not intercepted
+	tlsCfg := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsCfg.ServerName = "example.com"
+	tlsConn := tls.Client(conn.Client, tlsCfg)
+	if err = tlsConn.Handshake(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	_, err = fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	res, err = http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.ContentLength != int64(len("origin")) {
+		t.Errorf("response must come from origin server, but got %d bytes", res.ContentLength)
+	}
+}
+
+func Test_SessionPassthroughLearn(t *testing.T) {
+	cacert, cakey, err := mitm.NewAuthority("betproxy", "faceair", 10*365*24*time.Hour)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	tlsCfg, err := mitm.NewConfig(cacert, cakey)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	passthrough, err := NewPassthrough()
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	passthrough.SetLearnThreshold(1)
+
+	conn := NewFakeConn()
+	service := &Service{client: echoClient(), tlsCfg: tlsCfg}
+	service.SetPassthrough(passthrough)
+	session := &Session{service: service, conn: conn.Server}
+
+	done := make(chan error)
+	go func() {
+		done <- session.handleLoop()
+	}()
+
+	_, err = conn.Client.Write([]byte("CONNECT pinned.com:443 HTTP/1.1\r\nHost: pinned.com:443\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	if _, err = http.ReadResponse(bufio.NewReader(conn.Client), nil); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	// the client does not trust the forged certificate
+	tlsConn := tls.Client(conn.Client, &tls.Config{ServerName: "pinned.com"})
+	if err = tlsConn.Handshake(); err == nil {
+		t.Error("must error, but got nil")
+	}
+	if err = <-done; err == nil {
+		t.Error("must error, but got nil")
+	}
+	if !passthrough.Match("pinned.com:443") {
+		t.Error("host must be learned after failed handshake")
+	}
+}
@@ -0,0 +1,508 @@
+package betproxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DescriptorSet is a set of protobuf message and service definitions
+// It is loaded from a serialized google.protobuf.FileDescriptorSet, e.g. the output of
+// protoc --include_imports --descriptor_set_out=set.pb
+type DescriptorSet struct {
+	messages map[string]*messageDescriptor
+	enums    map[string]map[int32]string
+	methods  map[string]*methodDescriptor
+}
+
+type messageDescriptor struct {
+	name     string
+	fields   map[int32]*fieldDescriptor
+	mapEntry bool
+}
+
+type fieldDescriptor struct {
+	name     string
+	number   int32
+	repeated bool
+	kind     int32
+	typeName string
+}
+
+type methodDescriptor struct {
+	input  string
+	output string
+}
+
+// field types of google.protobuf.FieldDescriptorProto
+const (
+	protoDouble   = 1
+	protoFloat    = 2
+	protoInt64    = 3
+	protoUint64   = 4
+	protoInt32    = 5
+	protoFixed64  = 6
+	protoFixed32  = 7
+	protoBool     = 8
+	protoString   = 9
+	protoGroup    = 10
+	protoMessage  = 11
+	protoBytes    = 12
+	protoUint32   = 13
+	protoEnum     = 14
+	protoSfixed32 = 15
+	protoSfixed64 = 16
+	protoSint32   = 17
+	protoSint64   = 18
+)
+
+// LoadDescriptorSet reads a serialized FileDescriptorSet from file
+func LoadDescriptorSet(filename string) (*DescriptorSet, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewDescriptorSet(data)
+}
+
+// NewDescriptorSet parses a serialized FileDescriptorSet
+func NewDescriptorSet(data []byte) (*DescriptorSet, error) {
+	set := &DescriptorSet{
+		messages: make(map[string]*messageDescriptor),
+		enums:    make(map[string]map[int32]string),
+		methods:  make(map[string]*methodDescriptor),
+	}
+	err := walkFields(data, func(num int32, wire int, v uint64, b []byte) error {
+		if num == 1 && wire == 2 {
+			return set.parseFile(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+func (d *DescriptorSet) parseFile(data []byte) error {
+	var pkg string
+	var messages, enums, services [][]byte
+	err := walkFields(data, func(num int32, wire int, v uint64, b []byte) error {
+		switch num {
+		case 2:
+			pkg = string(b)
+		case 4:
+			messages = append(messages, b)
+		case 5:
+			enums = append(enums, b)
+		case 6:
+			services = append(services, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, b := range messages {
+		if err = d.parseMessage(pkg, b); err != nil {
+			return err
+		}
+	}
+	for _, b := range enums {
+		if err = d.parseEnum(pkg, b); err != nil {
+			return err
+		}
+	}
+	for _, b := range services {
+		if err = d.parseService(pkg, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DescriptorSet) parseMessage(scope string, data []byte) error {
+	msg := &messageDescriptor{fields: make(map[int32]*fieldDescriptor)}
+	var nested, enums [][]byte
+	err := walkFields(data, func(num int32, wire int, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			msg.name = qualify(scope, string(b))
+		case 2:
+			field, err := parseField(b)
+			if err != nil {
+				return err
+			}
+			msg.fields[field.number] = field
+		case 3:
+			nested = append(nested, b)
+		case 4:
+			enums = append(enums, b)
+		case 7:
+			return walkFields(b, func(num int32, wire int, v uint64, b []byte) error {
+				if num == 7 {
+					msg.mapEntry = v != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.messages[msg.name] = msg
+
+	for _, b := range nested {
+		if err = d.parseMessage(msg.name, b); err != nil {
+			return err
+		}
+	}
+	for _, b := range enums {
+		if err = d.parseEnum(msg.name, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseField(data []byte) (*fieldDescriptor, error) {
+	field := &fieldDescriptor{}
+	var jsonName string
+	err := walkFields(data, func(num int32, wire int, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			field.name = string(b)
+		case 3:
+			field.number = int32(v)
+		case 4:
+			field.repeated = v == 3
+		case 5:
+			field.kind = int32(v)
+		case 6:
+			field.typeName = strings.TrimPrefix(string(b), ".")
+		case 10:
+			jsonName = string(b)
+		}
+		return nil
+	})
+	if jsonName != "" {
+		field.name = jsonName
+	} else {
+		field.name = lowerCamelCase(field.name)
+	}
+	return field, err
+}
+
+func (d *DescriptorSet) parseEnum(scope string, data []byte) error {
+	var name string
+	values := make(map[int32]string)
+	err := walkFields(data, func(num int32, wire int, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			name = qualify(scope, string(b))
+		case 2:
+			var valueName string
+			var number int32
+			err := walkFields(b, func(num int32, wire int, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					valueName = string(b)
+				case 2:
+					number = int32(v)
+				}
+				return nil
+			})
+			values[number] = valueName
+			return err
+		}
+		return nil
+	})
+	d.enums[name] = values
+	return err
+}
+
+func (d *DescriptorSet) parseService(scope string, data []byte) error {
+	var name string
+	var methods [][]byte
+	err := walkFields(data, func(num int32, wire int, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			name = qualify(scope, string(b))
+		case 2:
+			methods = append(methods, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, b := range methods {
+		var methodName string
+		method := &methodDescriptor{}
+		err = walkFields(b, func(num int32, wire int, v uint64, b []byte) error {
+			switch num {
+			case 1:
+				methodName = string(b)
+			case 2:
+				method.input = strings.TrimPrefix(string(b), ".")
+			case 3:
+				method.output = strings.TrimPrefix(string(b), ".")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		d.methods["/"+name+"/"+methodName] = method
+	}
+	return nil
+}
+
+// MethodTypes returns the input and output message names of the gRPC method path, e.g. /helloworld.Greeter/SayHello
+func (d *DescriptorSet) MethodTypes(path string) (input, output string, ok bool) {
+	method, ok := d.methods[path]
+	if !ok {
+		return "", "", false
+	}
+	return method.input, method.output, true
+}
+
+// DecodeJSON decodes the protobuf binary data of the message type into JSON
+func (d *DescriptorSet) DecodeJSON(typeName string, data []byte) ([]byte, error) {
+	value, err := d.decodeMessage(typeName, data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+func (d *DescriptorSet) decodeMessage(typeName string, data []byte) (map[string]interface{}, error) {
+	msg, ok := d.messages[typeName]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %s", typeName)
+	}
+
+	result := make(map[string]interface{})
+	err := walkFields(data, func(num int32, wire int, v uint64, b []byte) error {
+		field, ok := msg.fields[num]
+		if !ok {
+			return nil
+		}
+
+		var values []interface{}
+		if wire == 2 && isPackable(field.kind) {
+			err := walkPacked(field.kind, b, func(v uint64) {
+				values = append(values, d.decodeScalar(field, v, nil))
+			})
+			if err != nil {
+				return err
+			}
+		} else {
+			value, err := d.decodeValue(field, v, b)
+			if err != nil {
+				return err
+			}
+			values = append(values, value)
+		}
+
+		if !field.repeated {
+			result[field.name] = values[len(values)-1]
+			return nil
+		}
+
+		if entry, ok := d.messages[field.typeName]; ok && entry.mapEntry {
+			m, _ := result[field.name].(map[string]interface{})
+			if m == nil {
+				m = make(map[string]interface{})
+				result[field.name] = m
+			}
+			for _, value := range values {
+				kv, ok := value.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("map field %s is not a message", field.name)
+				}
+				m[fmt.Sprint(kv["key"])] = kv["value"]
+			}
+			return nil
+		}
+
+		list, _ := result[field.name].([]interface{})
+		result[field.name] = append(list, values...)
+		return nil
+	})
+	return result, err
+}
+
+func (d *DescriptorSet) decodeValue(field *fieldDescriptor, v uint64, b []byte) (interface{}, error) {
+	switch field.kind {
+	case protoMessage:
+		return d.decodeMessage(field.typeName, b)
+	case protoGroup:
+		return nil, errors.New("protobuf groups are not supported")
+	}
+	return d.decodeScalar(field, v, b), nil
+}
+
+func (d *DescriptorSet) decodeScalar(field *fieldDescriptor, v uint64, b []byte) interface{} {
+	switch field.kind {
+	case protoDouble:
+		return jsonFloat(math.Float64frombits(v))
+	case protoFloat:
+		return jsonFloat(float64(math.Float32frombits(uint32(v))))
+	case protoInt64, protoSfixed64:
+		return strconv.FormatInt(int64(v), 10)
+	case protoUint64, protoFixed64:
+		return strconv.FormatUint(v, 10)
+	case protoSint64:
+		return strconv.FormatInt(int64(v>>1)^-int64(v&1), 10)
+	case protoInt32, protoSfixed32:
+		return int32(v)
+	case protoUint32, protoFixed32:
+		return uint32(v)
+	case protoSint32:
+		return int32(uint32(v)>>1) ^ -int32(v&1)
+	case protoBool:
+		return v != 0
+	case protoString:
+		return string(b)
+	case protoBytes:
+		return base64.StdEncoding.EncodeToString(b)
+	case protoEnum:
+		if name, ok := d.enums[field.typeName][int32(v)]; ok {
+			return name
+		}
+		return int32(v)
+	}
+	return nil
+}
+
+// jsonFloat keeps NaN and Inf encodable as the proto3 JSON mapping does
+func jsonFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return f
+}
+
+func isPackable(kind int32) bool {
+	switch kind {
+	case protoString, protoBytes, protoMessage, protoGroup:
+		return false
+	}
+	return true
+}
+
+func walkPacked(kind int32, data []byte, fn func(v uint64)) error {
+	for len(data) > 0 {
+		switch kind {
+		case protoDouble, protoFixed64, protoSfixed64:
+			if len(data) < 8 {
+				return errors.New("truncated packed field")
+			}
+			fn(binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case protoFloat, protoFixed32, protoSfixed32:
+			if len(data) < 4 {
+				return errors.New("truncated packed field")
+			}
+			fn(uint64(binary.LittleEndian.Uint32(data)))
+			data = data[4:]
+		default:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("invalid varint")
+			}
+			fn(v)
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// walkFields calls fn with every field of the protobuf binary data
+// v is set for varint and fixed fields, b is set for length-delimited fields
+func walkFields(data []byte, fn func(num int32, wire int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid field tag")
+		}
+		data = data[n:]
+
+		num, wire := int32(tag>>3), int(tag&7)
+		var v uint64
+		var b []byte
+		switch wire {
+		case 0:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("invalid varint")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return errors.New("truncated fixed64 field")
+			}
+			v = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errors.New("truncated length-delimited field")
+			}
+			b = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return errors.New("truncated fixed32 field")
+			}
+			v = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wire)
+		}
+
+		if err := fn(num, wire, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func qualify(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func lowerCamelCase(name string) string {
+	var sb strings.Builder
+	upper := false
+	for _, c := range name {
+		if c == '_' {
+			upper = true
+			continue
+		}
+		if upper && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper = false
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
@@ -0,0 +1,160 @@
+package betproxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func appendVarintField(b []byte, num int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(num<<3))
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytesField(b []byte, num int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num<<3|2))
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendStringField(b []byte, num int, s string) []byte {
+	return appendBytesField(b, num, []byte(s))
+}
+
+func testFieldDescriptor(name string, number, label, kind int, typeName string) []byte {
+	var b []byte
+	b = appendStringField(b, 1, name)
+	b = appendVarintField(b, 3, uint64(number))
+	b = appendVarintField(b, 4, uint64(label))
+	b = appendVarintField(b, 5, uint64(kind))
+	if typeName != "" {
+		b = appendStringField(b, 6, typeName)
+	}
+	return b
+}
+
+// testDescriptorSet builds the descriptor set of
+//
+//	package demo;
+//	enum Mood { SAD = 0; HAPPY = 1; }
+//	message HelloRequest { string user_name = 1; repeated int32 ids = 2; Mood mood = 3; map<string, int64> scores = 4; }
+//	message HelloReply { string message = 1; }
+//	service Greeter { rpc SayHello (HelloRequest) returns (HelloReply); }
+func testDescriptorSet() []byte {
+	var entry []byte
+	entry = appendStringField(entry, 1, "ScoresEntry")
+	entry = appendBytesField(entry, 2, testFieldDescriptor("key", 1, 1, protoString, ""))
+	entry = appendBytesField(entry, 2, testFieldDescriptor("value", 2, 1, protoInt64, ""))
+	entry = appendBytesField(entry, 7, appendVarintField(nil, 7, 1))
+
+	var request []byte
+	request = appendStringField(request, 1, "HelloRequest")
+	request = appendBytesField(request, 2, testFieldDescriptor("user_name", 1, 1, protoString, ""))
+	request = appendBytesField(request, 2, testFieldDescriptor("ids", 2, 3, protoInt32, ""))
+	request = appendBytesField(request, 2, testFieldDescriptor("mood", 3, 1, protoEnum, ".demo.Mood"))
+	request = appendBytesField(request, 2, testFieldDescriptor("scores", 4, 3, protoMessage, ".demo.HelloRequest.ScoresEntry"))
+	request = appendBytesField(request, 3, entry)
+
+	var reply []byte
+	reply = appendStringField(reply, 1, "HelloReply")
+	reply = appendBytesField(reply, 2, testFieldDescriptor("message", 1, 1, protoString, ""))
+
+	var enum []byte
+	enum = appendStringField(enum, 1, "Mood")
+	enum = appendBytesField(enum, 2, appendVarintField(appendStringField(nil, 1, "SAD"), 2, 0))
+	enum = appendBytesField(enum, 2, appendVarintField(appendStringField(nil, 1, "HAPPY"), 2, 1))
+
+	var method []byte
+	method = appendStringField(method, 1, "SayHello")
+	method = appendStringField(method, 2, ".demo.HelloRequest")
+	method = appendStringField(method, 3, ".demo.HelloReply")
+
+	var service []byte
+	service = appendStringField(service, 1, "Greeter")
+	service = appendBytesField(service, 2, method)
+
+	var file []byte
+	file = appendStringField(file, 1, "demo.proto")
+	file = appendStringField(file, 2, "demo")
+	file = appendBytesField(file, 4, request)
+	file = appendBytesField(file, 4, reply)
+	file = appendBytesField(file, 5, enum)
+	file = appendBytesField(file, 6, service)
+
+	return appendBytesField(nil, 1, file)
+}
+
+func Test_DescriptorSetDecodeJSON(t *testing.T) {
+	set, err := NewDescriptorSet(testDescriptorSet())
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	input, output, ok := set.MethodTypes("/demo.Greeter/SayHello")
+	if !ok || input != "demo.HelloRequest" || output != "demo.HelloReply" {
+		t.Errorf("method types not match, got %s %s %v", input, output, ok)
+	}
+
+	var msg []byte
+	msg = appendStringField(msg, 1, "faceair")
+	msg = appendBytesField(msg, 2, []byte{1, 2, 3})
+	msg = appendVarintField(msg, 2, 4)
+	msg = appendVarintField(msg, 3, 1)
+	msg = appendBytesField(msg, 4, appendVarintField(appendStringField(nil, 1, "go"), 2, 100))
+	msg = appendVarintField(msg, 15, 1)
+
+	data, err := set.DecodeJSON(input, msg)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	var got map[string]interface{}
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	want := map[string]interface{}{
+		"userName": "faceair",
+		"ids":      []interface{}{1.0, 2.0, 3.0, 4.0},
+		"mood":     "HAPPY",
+		"scores":   map[string]interface{}{"go": "100"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded json not match, got %s", data)
+	}
+
+	if _, err = set.DecodeJSON("demo.Unknown", msg); err == nil {
+		t.Error("must error, but got nil")
+	}
+}
+
+func Test_NewDescriptorSetInvalid(t *testing.T) {
+	_, err := NewDescriptorSet([]byte{0x0a, 0x10, 0x01})
+	if err == nil {
+		t.Error("must error, but got nil")
+	}
+}
+
+func Test_DescriptorSetMalformedMapEntry(t *testing.T) {
+	var entry []byte
+	entry = appendStringField(entry, 1, "ScoresEntry")
+	entry = appendBytesField(entry, 7, appendVarintField(nil, 7, 1))
+
+	var request []byte
+	request = appendStringField(request, 1, "HelloRequest")
+	// the map entry is referenced by a scalar field
+	request = appendBytesField(request, 2, testFieldDescriptor("scores", 4, 3, protoInt64, ".demo.HelloRequest.ScoresEntry"))
+	request = appendBytesField(request, 3, entry)
+
+	var file []byte
+	file = appendStringField(file, 2, "demo")
+	file = appendBytesField(file, 4, request)
+
+	set, err := NewDescriptorSet(appendBytesField(nil, 1, file))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if _, err = set.DecodeJSON("demo.HelloRequest", appendVarintField(nil, 4, 1)); err == nil {
+		t.Error("must error, but got nil")
+	}
+}
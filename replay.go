@@ -0,0 +1,272 @@
+package betproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordedExchange is a request and its response saved by the Recorder
+type RecordedExchange struct {
+	Time           time.Time   `json:"time"`
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	Header         http.Header `json:"header"`
+	Body           []byte      `json:"body,omitempty"`
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"responseHeader"`
+	ResponseBody   []byte      `json:"responseBody,omitempty"`
+}
+
+// Recorder appends every exchange passing through the Client as a JSON line
+type Recorder struct {
+	mu          sync.Mutex
+	w           io.Writer
+	maxBodySize int64
+}
+
+// NewRecorder create a Recorder instance which writes the exchanges to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w, maxBodySize: DefaultMaxBodySize}
+}
+
+// SetMaxBodySize sets the max size of the bodies kept in memory, the exchanges with larger bodies are not recorded
+func (r *Recorder) SetMaxBodySize(size int64) {
+	r.maxBodySize = size
+}
+
+// OpenRecorder create a Recorder instance which appends the exchanges to the file
+func OpenRecorder(filename string) (*Recorder, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(file), nil
+}
+
+// Close closes the underlying writer if it's closable
+func (r *Recorder) Close() error {
+	if closer, ok := r.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Middleware records the exchange after the response body is read completely
+// The upgraded connections, the aborted responses, the request bodies not read to the end and the exchanges exceeding the max body size are not recorded
+func (r *Recorder) Middleware(next Client) Client {
+	return ClientFunc(func(req *http.Request) (*http.Response, error) {
+		exchange := &RecordedExchange{
+			Time:   time.Now(),
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Header: req.Header.Clone(),
+		}
+
+		var reqBody *captureBody
+		var complete bool
+		if req.Body != nil && req.Body != http.NoBody {
+			reqBody = newCaptureBody(req.Body, r.maxBodySize, func(c *captureBody) {
+				complete = c.eof && !c.truncated
+				if complete {
+					exchange.Body = c.Bytes()
+				}
+			})
+			req.Body = reqBody
+		}
+
+		res, err := next.Do(req)
+		if err != nil || res.StatusCode == http.StatusSwitchingProtocols {
+			return res, err
+		}
+
+		exchange.Status = res.StatusCode
+		exchange.ResponseHeader = res.Header.Clone()
+		record := func(body []byte) {
+			// the request body not read to the end by the transport would not match on replay
+			if reqBody != nil && (!reqBody.detach() || !complete) {
+				return
+			}
+			exchange.ResponseBody = body
+			r.write(exchange)
+		}
+		if res.Body == nil || res.Body == http.NoBody {
+			record(nil)
+			return res, nil
+		}
+		res.Body = newCaptureBody(res.Body, r.maxBodySize, func(c *captureBody) {
+			// the body closed before EOF is incomplete
+			if c.eof && !c.truncated {
+				record(c.Bytes())
+			}
+		})
+		return res, nil
+	})
+}
+
+func (r *Recorder) write(exchange *RecordedExchange) error {
+	data, err := json.Marshal(exchange)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.w.Write(append(data, '\n'))
+	return err
+}
+
+// ReplayMatcher reports whether the recorded exchange answers the request
+type ReplayMatcher func(req *http.Request, body []byte, exchange *RecordedExchange) bool
+
+// MatchMethod matches the request method
+func MatchMethod(req *http.Request, body []byte, exchange *RecordedExchange) bool {
+	return req.Method == exchange.Method
+}
+
+// MatchURL matches the full request url
+func MatchURL(req *http.Request, body []byte, exchange *RecordedExchange) bool {
+	return req.URL.String() == exchange.URL
+}
+
+// MatchBody matches the request body
+func MatchBody(req *http.Request, body []byte, exchange *RecordedExchange) bool {
+	return bytes.Equal(body, exchange.Body)
+}
+
+// MatchHeaders matches the request headers except the ignored ones
+func MatchHeaders(ignore ...string) ReplayMatcher {
+	ignored := make(map[string]bool, len(ignore))
+	for _, name := range ignore {
+		ignored[http.CanonicalHeaderKey(name)] = true
+	}
+	contains := func(a, b http.Header) bool {
+		for name, values := range a {
+			if ignored[http.CanonicalHeaderKey(name)] {
+				continue
+			}
+			if strings.Join(values, ",") != strings.Join(b.Values(name), ",") {
+				return false
+			}
+		}
+		return true
+	}
+	return func(req *http.Request, body []byte, exchange *RecordedExchange) bool {
+		return contains(req.Header, exchange.Header) && contains(exchange.Header, req.Header)
+	}
+}
+
+// Replayer is a Client serving the recorded responses
+// The exchanges matching the same request are served in the recorded order, the last one is repeated
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges []*RecordedExchange
+	served    map[*RecordedExchange]bool
+	matchers  []ReplayMatcher
+	fallback  Client
+}
+
+// NewReplayer create a Replayer instance from the exchanges in JSON lines
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	replayer := &Replayer{
+		served:   make(map[*RecordedExchange]bool),
+		matchers: []ReplayMatcher{MatchMethod, MatchURL, MatchBody},
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), math.MaxInt32)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		exchange := new(RecordedExchange)
+		if err := json.Unmarshal(line, exchange); err != nil {
+			return nil, err
+		}
+		replayer.exchanges = append(replayer.exchanges, exchange)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return replayer, nil
+}
+
+// LoadReplayer create a Replayer instance from the file written by the Recorder
+func LoadReplayer(filename string) (*Replayer, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return NewReplayer(file)
+}
+
+// SetMatchers replaces the matchers, all of them must match, default is method, url and body
+func (p *Replayer) SetMatchers(matchers ...ReplayMatcher) {
+	p.matchers = matchers
+}
+
+// SetFallback sets the Client for the requests not recorded, they get 502 by default
+func (p *Replayer) SetFallback(client Client) {
+	p.fallback = client
+}
+
+// Do serves the recorded response matching the request
+func (p *Replayer) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	exchange := p.match(req, body)
+	if exchange == nil {
+		if p.fallback != nil {
+			return p.fallback.Do(req)
+		}
+		return HTTPError(http.StatusBadGateway, "no recorded response for "+req.Method+" "+req.URL.String(), req), nil
+	}
+
+	res := NewResponse(exchange.Status, exchange.ResponseHeader.Clone(), bytes.NewReader(exchange.ResponseBody), req)
+	res.ContentLength = int64(len(exchange.ResponseBody))
+	return res, nil
+}
+
+func (p *Replayer) match(req *http.Request, body []byte) *RecordedExchange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var last *RecordedExchange
+	for _, exchange := range p.exchanges {
+		if !p.matches(req, body, exchange) {
+			continue
+		}
+		if !p.served[exchange] {
+			p.served[exchange] = true
+			return exchange
+		}
+		last = exchange
+	}
+	return last
+}
+
+func (p *Replayer) matches(req *http.Request, body []byte, exchange *RecordedExchange) bool {
+	for _, matcher := range p.matchers {
+		if !matcher(req, body, exchange) {
+			return false
+		}
+	}
+	return true
+}
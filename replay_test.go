@@ -0,0 +1,188 @@
+package betproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_RecordAndReplay(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "exchanges.jsonl")
+	recorder, err := OpenRecorder(filename)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	count := 0
+	client := recorder.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		count++
+		body, _ := ioutil.ReadAll(req.Body)
+		header := http.Header{}
+		header.Set("X-Count", fmt.Sprint(count))
+		return HTTPText(http.StatusCreated, header, "echo "+string(body), req), nil
+	}))
+	for _, body := range []string{"a", "b", "a"} {
+		req, _ := http.NewRequest("POST", "http://example.com/post", strings.NewReader(body))
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	recorder.Close()
+
+	replayer, err := LoadReplayer(filename)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	expects := []struct {
+		body  string
+		count string
+	}{{"a", "1"}, {"b", "2"}, {"a", "3"}, {"a", "3"}}
+	for _, expect := range expects {
+		req, _ := http.NewRequest("POST", "http://example.com/post", strings.NewReader(expect.body))
+		res, err := replayer.Do(req)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != http.StatusCreated || string(body) != "echo "+expect.body {
+			t.Errorf("response must be 201 echo %s, but got %d %s", expect.body, res.StatusCode, body)
+		}
+		if res.Header.Get("X-Count") != expect.count {
+			t.Errorf("X-Count must be %s, but got %s", expect.count, res.Header.Get("X-Count"))
+		}
+	}
+}
+
+func Test_ReplayMiss(t *testing.T) {
+	replayer, err := NewReplayer(strings.NewReader(`{"method":"GET","url":"http://example.com/","status":200}` + "\n"))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/missing", nil)
+	res, err := replayer.Do(req)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("StatusCode must be 502, but got %d", res.StatusCode)
+	}
+
+	replayer.SetFallback(echoClient())
+	res, err = replayer.Do(req)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "http://example.com/missing" {
+		t.Errorf("body must come from the fallback, but got %s", body)
+	}
+}
+
+func Test_ReplayMatchHeaders(t *testing.T) {
+	record := `{"method":"GET","url":"http://example.com/","header":{"Accept":["text/plain"],"Date":["yesterday"]},"status":200,"responseBody":"b2s="}`
+	replayer, err := NewReplayer(bytes.NewBufferString(record))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	replayer.SetMatchers(MatchMethod, MatchURL, MatchHeaders("Date"))
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("Date", "today")
+	res, _ := replayer.Do(req)
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("response must be 200 ok, but got %d %s", res.StatusCode, body)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	res, _ = replayer.Do(req)
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("StatusCode must be 502, but got %d", res.StatusCode)
+	}
+}
+
+type rwcBody struct {
+	io.Reader
+	io.Writer
+}
+
+func (rwcBody) Close() error { return nil }
+
+func Test_RecorderSkipsIncomplete(t *testing.T) {
+	buf := &bytes.Buffer{}
+	recorder := NewRecorder(buf)
+	recorder.SetMaxBodySize(8)
+	client := recorder.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/ws" {
+			return NewResponse(http.StatusSwitchingProtocols, nil, rwcBody{strings.NewReader(""), ioutil.Discard}, req), nil
+		}
+		if req.URL.Path != "/unread" && req.Body != nil {
+			ioutil.ReadAll(req.Body)
+		}
+		return HTTPText(http.StatusOK, nil, strings.TrimPrefix(req.URL.Path, "/"), req), nil
+	}))
+	do := func(path string, read bool) *http.Response {
+		var body io.Reader
+		if path == "/unread" {
+			body = strings.NewReader("payload")
+		}
+		req, _ := http.NewRequest("GET", "http://example.com"+path, body)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		if read {
+			ioutil.ReadAll(res.Body)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if _, ok := do("/ws", false).Body.(io.ReadWriteCloser); !ok {
+		t.Error("upgraded body must not be wrapped")
+	}
+	do("/aborted", false)
+	do("/toolargebody", true)
+	do("/unread", true)
+	if buf.Len() != 0 {
+		t.Errorf("incomplete exchanges must not be recorded, but got %s", buf.String())
+	}
+
+	do("/ok", true)
+	if !strings.Contains(buf.String(), `"url":"http://example.com/ok"`) || strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("complete exchange must be recorded, but got %s", buf.String())
+	}
+}
+
+func Test_RecorderWebSocket(t *testing.T) {
+	server := newWebSocketEchoServer()
+	defer server.Close()
+
+	buf := &syncBuffer{}
+	service := &Service{client: &http.Client{}}
+	service.Use(NewRecorder(buf).Middleware)
+	conn, reader, _ := dialWebSocket(t, &Session{service: service}, strings.TrimPrefix(server.URL, "http://"))
+	defer conn.Client.Close()
+
+	if _, err := writeWebSocketFrame(conn.Client, &WebSocketFrame{Fin: true, Opcode: WebSocketText, Payload: []byte("hello")}, true); err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	frame, err := readWebSocketFrame(reader)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if string(frame.Payload) != "hello" {
+		t.Errorf("echo frame must be hello, but got %s", frame.Payload)
+	}
+}
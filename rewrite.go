@@ -0,0 +1,506 @@
+package betproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultReloadInterval is the interval to check the rewrite config for changes
+const DefaultReloadInterval = 2 * time.Second
+
+// DefaultMaxRewriteBodySize is the max size of the bodies buffered to be rewritten
+const DefaultMaxRewriteBodySize = 10 << 20
+
+// RewriteConfig is the JSON config of the RewriteEngine, YAML needs a third-party parser so it's not supported
+//
+//	{"rules": [{"match": {"host": "*.example.com", "path": "/api/*", "method": "GET"},
+//	            "mapRemote": "http://localhost:8080",
+//	            "responseHeaders": {"set": {"Access-Control-Allow-Origin": "*"}},
+//	            "responseBody": [{"pattern": "prod", "replace": "dev"}]}]}
+type RewriteConfig struct {
+	Rules []RewriteRule `json:"rules"`
+}
+
+// RewriteRule applies the actions to the requests matching all the matchers
+type RewriteRule struct {
+	Match RewriteMatch `json:"match"`
+	// MapRemote replaces the scheme and host of the request, and the path if it has one
+	MapRemote string `json:"mapRemote,omitempty"`
+	// MapLocal serves the file, or the request path under the directory, without calling upstream
+	MapLocal        string         `json:"mapLocal,omitempty"`
+	RequestHeaders  *HeaderActions `json:"requestHeaders,omitempty"`
+	ResponseHeaders *HeaderActions `json:"responseHeaders,omitempty"`
+	RequestBody     []BodyReplace  `json:"requestBody,omitempty"`
+	ResponseBody    []BodyReplace  `json:"responseBody,omitempty"`
+	Status          int            `json:"status,omitempty"`
+	remote          *url.URL
+	request         []*compiledReplace
+	response        []*compiledReplace
+}
+
+// RewriteMatch matches the request with path.Match patterns, empty field matches everything
+type RewriteMatch struct {
+	Host   string `json:"host,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Method string `json:"method,omitempty"`
+}
+
+// HeaderActions modifies the headers, the removal happens first
+type HeaderActions struct {
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+// BodyReplace replaces the regexp matches in the body, Replace supports $1 expansion
+type BodyReplace struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+}
+
+type compiledReplace struct {
+	pattern *regexp.Regexp
+	replace []byte
+}
+
+// RewriteEngine rewrites the requests and responses with the rules
+type RewriteEngine struct {
+	mu          sync.RWMutex
+	rules       []*RewriteRule
+	maxBodySize int64
+
+	filename string
+	modTime  time.Time
+	interval time.Duration
+	logger   Logger
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// NewRewriteEngine create a RewriteEngine instance with the rules
+func NewRewriteEngine(rules ...RewriteRule) (*RewriteEngine, error) {
+	engine := &RewriteEngine{maxBodySize: DefaultMaxRewriteBodySize, logger: defaultLogger{}, closed: make(chan struct{})}
+	if err := engine.SetRules(rules...); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// LoadRewriteEngine create a RewriteEngine instance from the JSON config
+// The file is reloaded when it's modified, until the engine is closed
+func LoadRewriteEngine(filename string) (*RewriteEngine, error) {
+	engine := &RewriteEngine{
+		filename:    filename,
+		interval:    DefaultReloadInterval,
+		maxBodySize: DefaultMaxRewriteBodySize,
+		logger:      defaultLogger{},
+		closed:      make(chan struct{}),
+	}
+	if err := engine.Reload(); err != nil {
+		return nil, err
+	}
+	go engine.watch()
+	return engine, nil
+}
+
+// SetReloadInterval sets the interval to check the config for changes
+func (e *RewriteEngine) SetReloadInterval(interval time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.interval = interval
+}
+
+// SetMaxBodySize sets the max size of the bodies buffered to be rewritten
+// The larger bodies are passed through without replacing
+func (e *RewriteEngine) SetMaxBodySize(size int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.maxBodySize = size
+}
+
+// SetLogger sets the logger of the reload failures, nil silences the logs
+func (e *RewriteEngine) SetLogger(logger Logger) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.logger = logger
+}
+
+// SetRules replaces the rules
+func (e *RewriteEngine) SetRules(rules ...RewriteRule) error {
+	compiled := make([]*RewriteRule, 0, len(rules))
+	for i := range rules {
+		rule := rules[i]
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rule %d: %s", i, err.Error())
+		}
+		compiled = append(compiled, &rule)
+	}
+	e.mu.Lock()
+	e.rules = compiled
+	e.mu.Unlock()
+	return nil
+}
+
+// Reload reads the config file, the rules are kept if it's invalid
+func (e *RewriteEngine) Reload() error {
+	stat, err := os.Stat(e.filename)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(e.filename)
+	if err != nil {
+		return err
+	}
+	var config RewriteConfig
+	if err = json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	if err = e.SetRules(config.Rules...); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.modTime = stat.ModTime()
+	e.mu.Unlock()
+	return nil
+}
+
+// Close stops watching the config file
+func (e *RewriteEngine) Close() error {
+	e.once.Do(func() {
+		close(e.closed)
+	})
+	return nil
+}
+
+func (e *RewriteEngine) watch() {
+	for {
+		e.mu.RLock()
+		interval := e.interval
+		e.mu.RUnlock()
+
+		select {
+		case <-e.closed:
+			return
+		case <-time.After(interval):
+		}
+
+		stat, err := os.Stat(e.filename)
+		if err != nil {
+			continue
+		}
+		e.mu.RLock()
+		modified := !stat.ModTime().Equal(e.modTime)
+		e.mu.RUnlock()
+		if !modified {
+			continue
+		}
+		if err = e.Reload(); err != nil {
+			e.mu.RLock()
+			logger := e.logger
+			e.mu.RUnlock()
+			if logger != nil {
+				logger.Log(context.Background(), slog.LevelError, "reload rewrite config failed", slog.String("file", e.filename), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// Middleware applies the matching rules in order
+func (e *RewriteEngine) Middleware(next Client) Client {
+	return ClientFunc(func(req *http.Request) (*http.Response, error) {
+		rules, maxBodySize := e.match(req)
+		if len(rules) == 0 {
+			return next.Do(req)
+		}
+
+		var res *http.Response
+		for _, rule := range rules {
+			if err := rule.rewriteRequest(req, maxBodySize); err != nil {
+				if req.Body != nil {
+					req.Body.Close()
+				}
+				return nil, err
+			}
+			if rule.MapLocal != "" && res == nil {
+				res = mapLocal(rule.MapLocal, req)
+			}
+		}
+		if res == nil {
+			var err error
+			if res, err = next.Do(req); err != nil {
+				return res, err
+			}
+		}
+		for _, rule := range rules {
+			if err := rule.rewriteResponse(res, maxBodySize); err != nil {
+				res.Body.Close()
+				return nil, err
+			}
+		}
+		return res, nil
+	})
+}
+
+// match returns the rules matching the request and the max body size to rewrite
+func (e *RewriteEngine) match(req *http.Request) ([]*RewriteRule, int64) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var matched []*RewriteRule
+	for _, rule := range e.rules {
+		if rule.Match.match(req) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched, e.maxBodySize
+}
+
+func (m *RewriteMatch) match(req *http.Request) bool {
+	if m.Method != "" && !strings.EqualFold(m.Method, req.Method) {
+		return false
+	}
+	if m.Host != "" {
+		host := req.URL.Host
+		if host == "" {
+			host = req.Host
+		}
+		if ok, _ := path.Match(m.Host, stripPort(host)); !ok {
+			return false
+		}
+	}
+	if m.Path != "" {
+		if ok, _ := path.Match(m.Path, req.URL.Path); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *RewriteRule) compile() error {
+	for _, pattern := range []string{r.Match.Host, r.Match.Path} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	if r.MapRemote != "" {
+		remote, err := url.Parse(r.MapRemote)
+		if err != nil {
+			return err
+		}
+		if remote.Scheme == "" || remote.Host == "" {
+			return errors.New("mapRemote must be an absolute url")
+		}
+		r.remote = remote
+	}
+	var err error
+	if r.request, err = compileReplaces(r.RequestBody); err != nil {
+		return err
+	}
+	if r.response, err = compileReplaces(r.ResponseBody); err != nil {
+		return err
+	}
+	return nil
+}
+
+func compileReplaces(replaces []BodyReplace) ([]*compiledReplace, error) {
+	compiled := make([]*compiledReplace, 0, len(replaces))
+	for _, replace := range replaces {
+		pattern, err := regexp.Compile(replace.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, &compiledReplace{pattern: pattern, replace: []byte(replace.Replace)})
+	}
+	return compiled, nil
+}
+
+func (r *RewriteRule) rewriteRequest(req *http.Request, maxBodySize int64) error {
+	if r.remote != nil {
+		req.URL.Scheme = r.remote.Scheme
+		req.URL.Host = r.remote.Host
+		req.Host = r.remote.Host
+		if r.remote.Path != "" && r.remote.Path != "/" {
+			req.URL.Path = r.remote.Path
+			req.URL.RawPath = ""
+		}
+	}
+	r.RequestHeaders.apply(req.Header)
+	if len(r.request) > 0 && req.Body != nil && req.Body != http.NoBody {
+		body, size, err := replaceBody(req.Body, r.request, maxBodySize)
+		if err != nil {
+			return err
+		}
+		req.Body = body
+		if size >= 0 {
+			req.ContentLength = size
+			req.Header.Del("Content-Length")
+		}
+	}
+	return nil
+}
+
+func (r *RewriteRule) rewriteResponse(res *http.Response, maxBodySize int64) error {
+	streaming := isStreaming(res)
+	if r.Status != 0 {
+		res.StatusCode = r.Status
+		res.Status = fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status))
+	}
+	r.ResponseHeaders.apply(res.Header)
+	if len(r.response) == 0 || res.Body == nil || res.Body == http.NoBody || streaming {
+		return nil
+	}
+
+	encoding := strings.ToLower(res.Header.Get("Content-Encoding"))
+	raw := &rawBody{ReadCloser: res.Body, record: encoding != ""}
+	decoded, err := decodeBody(raw, encoding)
+	if err == nil {
+		var body io.ReadCloser
+		var size int64
+		if body, size, err = replaceBody(readCloser{decoded, raw}, r.response, maxBodySize); err == nil {
+			raw.stop()
+			// the length is unknown if the body is decoded but too large to replace
+			res.Body = body
+			res.ContentLength = size
+			res.Header.Del("Content-Length")
+			if encoding != "" {
+				res.Header.Del("Content-Encoding")
+			}
+			return nil
+		}
+	}
+	if raw.err != nil {
+		return raw.err
+	}
+	// the body can't be decoded, so it passes through unchanged
+	res.Body = readCloser{io.MultiReader(bytes.NewReader(raw.buf.Bytes()), raw.ReadCloser), raw.ReadCloser}
+	return nil
+}
+
+// isStreaming reports whether the response body may never end, so it can't be buffered
+func isStreaming(res *http.Response) bool {
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || strings.HasPrefix(mediaType, "application/grpc")
+}
+
+func (h *HeaderActions) apply(header http.Header) {
+	if h == nil {
+		return
+	}
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+	for name, value := range h.Add {
+		header.Add(name, value)
+	}
+}
+
+// replaceBody returns the replaced body and its size, the body is not closed on error
+// The body larger than limit is returned as it is with the size -1
+func replaceBody(body io.ReadCloser, replaces []*compiledReplace, limit int64) (io.ReadCloser, int64, error) {
+	// one more byte is read to tell whether the body exceeds the limit
+	max := limit
+	if max < math.MaxInt64 {
+		max++
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, max))
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(data)) > limit {
+		return readCloser{io.MultiReader(bytes.NewReader(data), body), body}, -1, nil
+	}
+	body.Close()
+	for _, replace := range replaces {
+		data = replace.pattern.ReplaceAll(data, replace.replace)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+// decodeBody removes the content encoding so the body can be modified
+func decodeBody(body io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return flate.NewReader(body), nil
+	}
+	return body, nil
+}
+
+// rawBody keeps the bytes read from the encoded body until it's stopped, so they can be served again if the decoding fails
+// err is the error of the body itself, not of the decoding
+type rawBody struct {
+	io.ReadCloser
+	record bool
+	buf    bytes.Buffer
+	err    error
+}
+
+func (b *rawBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.record {
+		b.buf.Write(p[:n])
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *rawBody) stop() {
+	b.record = false
+	b.buf = bytes.Buffer{}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// mapLocal serves the local file for the request
+func mapLocal(name string, req *http.Request) *http.Response {
+	if stat, err := os.Stat(name); err == nil && stat.IsDir() {
+		name = filepath.Join(name, filepath.FromSlash(path.Clean("/"+req.URL.Path)))
+		if strings.HasSuffix(req.URL.Path, "/") {
+			name = filepath.Join(name, "index.html")
+		}
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return HTTPError(http.StatusNotFound, err.Error(), req)
+	}
+	header := http.Header{}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	header.Set("Content-Type", contentType)
+	res := NewResponse(http.StatusOK, header, bytes.NewReader(data), req)
+	res.ContentLength = int64(len(data))
+	return res
+}
@@ -0,0 +1,237 @@
+package betproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func rewriteDo(t *testing.T, client Client, method, url, body string) (*http.Response, string) {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	return res, string(data)
+}
+
+func Test_RewriteMapRemoteAndHeaders(t *testing.T) {
+	engine, err := NewRewriteEngine(RewriteRule{
+		Match:           RewriteMatch{Host: "*.example.com", Path: "/api/*", Method: "get"},
+		MapRemote:       "http://localhost:8080",
+		RequestHeaders:  &HeaderActions{Set: map[string]string{"X-Env": "dev"}, Remove: []string{"Cookie"}},
+		ResponseHeaders: &HeaderActions{Add: map[string]string{"X-Rewritten": "1"}},
+	})
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	client := engine.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		return HTTPText(http.StatusOK, nil, req.URL.String()+" "+req.Header.Get("X-Env")+" "+req.Header.Get("Cookie"), req), nil
+	}))
+
+	res, body := rewriteDo(t, client, "GET", "https://www.example.com/api/users?id=1", "")
+	if body != "http://localhost:8080/api/users?id=1 dev " {
+		t.Errorf("request must be mapped, but got %s", body)
+	}
+	if res.Header.Get("X-Rewritten") != "1" {
+		t.Errorf("X-Rewritten must be 1, but got %s", res.Header.Get("X-Rewritten"))
+	}
+
+	_, body = rewriteDo(t, client, "POST", "https://www.example.com/api/users", "")
+	if body != "https://www.example.com/api/users  " {
+		t.Errorf("POST must not match, but got %s", body)
+	}
+}
+
+func Test_RewriteBodyAndStatus(t *testing.T) {
+	engine, err := NewRewriteEngine(RewriteRule{
+		RequestBody:  []BodyReplace{{Pattern: "secret", Replace: "xxx"}},
+		ResponseBody: []BodyReplace{{Pattern: `"env":"(\w+)"`, Replace: `"env":"dev-$1"`}},
+		Status:       http.StatusTeapot,
+	})
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	client := engine.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		data, _ := ioutil.ReadAll(req.Body)
+		buf := &bytes.Buffer{}
+		writer := gzip.NewWriter(buf)
+		writer.Write([]byte(`{"env":"prod","body":"` + string(data) + `"}`))
+		writer.Close()
+		header := http.Header{}
+		header.Set("Content-Encoding", "gzip")
+		return NewResponse(http.StatusOK, header, buf, req), nil
+	}))
+
+	res, body := rewriteDo(t, client, "POST", "http://example.com/", "my secret")
+	if body != `{"env":"dev-prod","body":"my xxx"}` {
+		t.Errorf("body must be replaced, but got %s", body)
+	}
+	if res.StatusCode != http.StatusTeapot {
+		t.Errorf("StatusCode must be 418, but got %d", res.StatusCode)
+	}
+	if res.Header.Get("Content-Encoding") != "" || res.ContentLength != int64(len(body)) {
+		t.Errorf("body must be decoded, but got %s %d", res.Header.Get("Content-Encoding"), res.ContentLength)
+	}
+}
+
+func Test_RewriteMapLocal(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "data.json"), []byte(`{"ok":true}`), 0644)
+	engine, err := NewRewriteEngine(RewriteRule{Match: RewriteMatch{Host: "static.com"}, MapLocal: dir})
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	client := engine.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		t.Error("upstream must not be called")
+		return HTTPText(http.StatusOK, nil, "upstream", req), nil
+	}))
+
+	res, body := rewriteDo(t, client, "GET", "http://static.com/data.json", "")
+	if body != `{"ok":true}` || res.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("local file must be served, but got %s %s", res.Header.Get("Content-Type"), body)
+	}
+	res, _ = rewriteDo(t, client, "GET", "http://static.com/../missing.json", "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("StatusCode must be 404, but got %d", res.StatusCode)
+	}
+}
+
+func Test_RewriteInvalidRule(t *testing.T) {
+	if _, err := NewRewriteEngine(RewriteRule{ResponseBody: []BodyReplace{{Pattern: "("}}}); err == nil {
+		t.Error("invalid pattern must be rejected")
+	}
+	if _, err := NewRewriteEngine(RewriteRule{MapRemote: "localhost"}); err == nil {
+		t.Error("relative mapRemote must be rejected")
+	}
+}
+
+func Test_RewriteHotReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.json")
+	ioutil.WriteFile(filename, []byte(`{"rules":[{"status":201}]}`), 0644)
+
+	engine, err := LoadRewriteEngine(filename)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	defer engine.Close()
+	engine.SetReloadInterval(10 * time.Millisecond)
+	client := engine.Middleware(echoClient())
+
+	res, _ := rewriteDo(t, client, "GET", "http://example.com/", "")
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("StatusCode must be 201, but got %d", res.StatusCode)
+	}
+
+	ioutil.WriteFile(filename, []byte(`{"rules":[{"status":202}]}`), 0644)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(filename, later, later)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		res, _ = rewriteDo(t, client, "GET", "http://example.com/", "")
+		if res.StatusCode == http.StatusAccepted {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("rules must be reloaded, but got %d", res.StatusCode)
+}
+
+func Test_RewriteBodySkipped(t *testing.T) {
+	engine, err := NewRewriteEngine(RewriteRule{
+		ResponseBody: []BodyReplace{{Pattern: "a", Replace: "b"}},
+	})
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	engine.SetMaxBodySize(4)
+	upgraded := &rwcBody{strings.NewReader("aaaa"), ioutil.Discard}
+	client := engine.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/ws":
+			return NewResponse(http.StatusSwitchingProtocols, nil, upgraded, req), nil
+		case "/events":
+			return NewResponse(http.StatusOK, http.Header{"Content-Type": {"text/event-stream"}}, strings.NewReader("aaaa"), req), nil
+		}
+		return HTTPText(http.StatusOK, nil, strings.TrimPrefix(req.URL.Path, "/"), req), nil
+	}))
+
+	req, _ := http.NewRequest("GET", "http://example.com/ws", nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.Body != upgraded {
+		t.Error("upgraded body must not be read")
+	}
+	if _, body := rewriteDo(t, client, "GET", "http://example.com/events", ""); body != "aaaa" {
+		t.Errorf("event stream must not be replaced, but got %s", body)
+	}
+	if res, body := rewriteDo(t, client, "GET", "http://example.com/aaaaa", ""); body != "aaaaa" || res.ContentLength != -1 {
+		t.Errorf("large body must be passed through, but got %s %d", body, res.ContentLength)
+	}
+	if _, body := rewriteDo(t, client, "GET", "http://example.com/aaaa", ""); body != "bbbb" {
+		t.Errorf("body must be replaced, but got %s", body)
+	}
+}
+
+type errorBody struct {
+	closed bool
+}
+
+func (b *errorBody) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func (b *errorBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func Test_RewriteBodyUndecodable(t *testing.T) {
+	engine, err := NewRewriteEngine(RewriteRule{
+		ResponseBody: []BodyReplace{{Pattern: "a", Replace: "b"}},
+	})
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	compressed := &bytes.Buffer{}
+	gw := gzip.NewWriter(compressed)
+	gw.Write([]byte(strings.Repeat("a", 1024)))
+	gw.Close()
+	corrupted := compressed.Bytes()[:compressed.Len()/2]
+	broken := &errorBody{}
+	client := engine.Middleware(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/plain":
+			return NewResponse(http.StatusOK, http.Header{"Content-Encoding": {"gzip"}}, strings.NewReader("aaaa"), req), nil
+		case "/corrupted":
+			return NewResponse(http.StatusOK, http.Header{"Content-Encoding": {"gzip"}}, bytes.NewReader(corrupted), req), nil
+		}
+		return NewResponse(http.StatusOK, nil, broken, req), nil
+	}))
+
+	if res, body := rewriteDo(t, client, "GET", "http://example.com/plain", ""); body != "aaaa" || res.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("body not gzipped must be passed through, but got %s %s", body, res.Header.Get("Content-Encoding"))
+	}
+	if _, body := rewriteDo(t, client, "GET", "http://example.com/corrupted", ""); body != string(corrupted) {
+		t.Errorf("corrupted body must be passed through, but got %q", body)
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/broken", nil)
+	if _, err := client.Do(req); err == nil {
+		t.Error("err must not be nil")
+	}
+	if !broken.closed {
+		t.Error("body must be closed on error")
+	}
+}
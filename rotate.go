@@ -0,0 +1,215 @@
+package betproxy
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NewRotatingWriter create a RotatingWriter appending to the file
+// The file is rotated once it would exceed maxSize bytes, and when the interval boundary passes, e.g. 24h rotates at midnight UTC
+// Zero maxSize or interval disables the trigger
+func NewRotatingWriter(filename string, maxSize int64, interval time.Duration) (*RotatingWriter, error) {
+	w := &RotatingWriter{
+		filename: filename,
+		maxSize:  maxSize,
+		interval: interval,
+		now:      time.Now,
+		logger:   defaultLogger{},
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// RotatingWriter is an io.Writer to a file which is renamed with the rotation time and reopened
+// It's safe for concurrent use
+type RotatingWriter struct {
+	filename string
+	maxSize  int64
+	interval time.Duration
+	compress bool
+	now      func() time.Time
+	logger   Logger
+
+	mu     sync.Mutex
+	file   *os.File
+	closed bool
+	size   int64
+	next   time.Time
+	wg     sync.WaitGroup
+}
+
+// EnableCompress gzips the rotated files in background
+func (w *RotatingWriter) EnableCompress(enable bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.compress = enable
+}
+
+// SetLogger sets the logger of the compression failures, nil silences the logs
+func (w *RotatingWriter) SetLogger(logger Logger) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.logger = logger
+}
+
+// Write appends p to the file, the file is rotated before writing if needed
+// The file failed to be reopened by the last rotation is opened again
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.reopen(); err != nil {
+		return 0, err
+	}
+	now := w.now()
+	if (w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize) || (!w.next.IsZero() && !now.Before(w.next)) {
+		if err := w.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate renames the current file and opens a new one
+func (w *RotatingWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.reopen(); err != nil {
+		return err
+	}
+	return w.rotate(w.now())
+}
+
+// Close closes the file and waits for the rotated files to be compressed
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	var err error
+	w.closed = true
+	if w.file != nil {
+		err = w.file.Close()
+		w.file = nil
+	}
+	w.mu.Unlock()
+
+	w.wg.Wait()
+	return err
+}
+
+func (w *RotatingWriter) open() error {
+	file, err := os.OpenFile(w.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = stat.Size()
+	if w.interval > 0 {
+		w.next = w.now().Truncate(w.interval).Add(w.interval)
+	}
+	return nil
+}
+
+// reopen opens the file if the last rotation failed to, it returns os.ErrClosed after Close
+func (w *RotatingWriter) reopen() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	if w.file == nil {
+		return w.open()
+	}
+	return nil
+}
+
+func (w *RotatingWriter) rotate(now time.Time) error {
+	// the file is rotated even if it fails to be closed, so the later writes don't fail
+	if err := w.file.Close(); err != nil && w.logger != nil {
+		w.logger.Log(context.Background(), slog.LevelWarn, "close rotated file failed", slog.String("file", w.filename), slog.Any("error", err))
+	}
+	w.file = nil
+
+	rotated := w.rotatedName(now)
+	if err := os.Rename(w.filename, rotated); err != nil {
+		// keep appending to the current file
+		if openErr := w.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	if w.compress {
+		logger := w.logger
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			if err := compressFile(rotated); err != nil && logger != nil {
+				logger.Log(context.Background(), slog.LevelError, "compress rotated file failed", slog.String("file", rotated), slog.Any("error", err))
+			}
+		}()
+	}
+	return nil
+}
+
+// rotatedName returns a name for the rotated file which doesn't exist yet
+func (w *RotatingWriter) rotatedName(now time.Time) string {
+	base := w.filename + "." + now.Format("20060102-150405.000")
+	name := base
+	for i := 1; exists(name) || exists(name+".gz"); i++ {
+		name = base + "." + strconv.Itoa(i)
+	}
+	return name
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// compressFile replaces the file with a gzip file, the file is kept if it fails
+// The gzip file is written under a temporary name, so a partial one is never left with the final name
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := name + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	src.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,177 @@
+package betproxy
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func rotatedFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "access.log.*"))
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	sort.Strings(files)
+	return files
+}
+
+func Test_RotatingWriterSize(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "access.log")
+	w, err := NewRotatingWriter(filename, 10, 0)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	defer w.Close()
+
+	for _, line := range []string{"12345\n", "67890\n", "abc\n"} {
+		if _, err = w.Write([]byte(line)); err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+	}
+
+	files := rotatedFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("rotated files must be 1, but got %v", files)
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if string(data) != "12345\n" {
+		t.Errorf("rotated file must be 12345, but got %q", data)
+	}
+	data, _ = ioutil.ReadFile(filename)
+	if string(data) != "67890\nabc\n" {
+		t.Errorf("current file must be 67890 abc, but got %q", data)
+	}
+}
+
+func Test_RotatingWriterInterval(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "access.log")
+	now := time.Date(2026, 1, 1, 23, 59, 0, 0, time.UTC)
+
+	w, err := NewRotatingWriter(filename, 0, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	defer w.Close()
+	w.now = func() time.Time { return now }
+	w.next = time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	w.Write([]byte("first\n"))
+	if files := rotatedFiles(t, dir); len(files) != 0 {
+		t.Fatalf("file must not be rotated before midnight, but got %v", files)
+	}
+
+	now = now.Add(time.Minute)
+	w.Write([]byte("second\n"))
+	files := rotatedFiles(t, dir)
+	if len(files) != 1 || filepath.Base(files[0]) != "access.log.20260102-000000.000" {
+		t.Fatalf("file must be rotated at midnight, but got %v", files)
+	}
+	if !w.next.Equal(time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("next rotation must be the next midnight, but got %s", w.next)
+	}
+}
+
+func Test_RotatingWriterCompress(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "access.log")
+	w, err := NewRotatingWriter(filename, 0, 0)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	w.EnableCompress(true)
+
+	w.Write([]byte("rotated\n"))
+	if err = w.Rotate(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	w.Write([]byte("current\n"))
+	if err = w.Close(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if _, err = w.Write([]byte("closed\n")); err != os.ErrClosed {
+		t.Errorf("err must be os.ErrClosed, but got %v", err)
+	}
+
+	files := rotatedFiles(t, dir)
+	if len(files) != 1 || filepath.Ext(files[0]) != ".gz" {
+		t.Fatalf("rotated file must be compressed, but got %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	data, _ := ioutil.ReadAll(gz)
+	if string(data) != "rotated\n" {
+		t.Errorf("rotated file must be rotated, but got %q", data)
+	}
+}
+
+func Test_RotatingWriterReopen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	os.Mkdir(dir, 0755)
+	filename := filepath.Join(dir, "access.log")
+	w, err := NewRotatingWriter(filename, 0, 0)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	defer w.Close()
+
+	os.RemoveAll(dir)
+	if err = w.Rotate(); err == nil {
+		t.Fatal("err must not be nil")
+	}
+	os.Mkdir(dir, 0755)
+	if _, err = w.Write([]byte("reopened\n")); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if data, _ := ioutil.ReadFile(filename); string(data) != "reopened\n" {
+		t.Errorf("file must be reopened, but got %q", data)
+	}
+}
+
+func Test_RotatingWriterCompressFailed(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "access.log")
+	w, err := NewRotatingWriter(filename, 0, 0)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	var logs []string
+	w.SetLogger(LoggerFunc(func(ctx context.Context, level slog.Level, msg string, args ...any) {
+		logs = append(logs, msg)
+	}))
+	w.EnableCompress(true)
+	now := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	w.now = func() time.Time { return now }
+	// the temporary gzip file can't be created
+	os.Mkdir(filename+".20260102-000000.000.gz.tmp", 0755)
+
+	w.Write([]byte("rotated\n"))
+	if err = w.Rotate(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	w.Close()
+
+	if len(logs) != 1 || logs[0] != "compress rotated file failed" {
+		t.Errorf("compression failure must be logged, but got %v", logs)
+	}
+	if data, _ := ioutil.ReadFile(filename + ".20260102-000000.000"); string(data) != "rotated\n" {
+		t.Errorf("rotated file must be kept, but got %q", data)
+	}
+	if exists(filename + ".20260102-000000.000.gz") {
+		t.Error("gzip file must not be left")
+	}
+}
@@ -1,9 +1,11 @@
 package betproxy
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net"
 	"net/http"
+	"sync"
 
 	"github.com/faceair/betproxy/mitm"
 )
@@ -18,6 +20,7 @@ func NewService(address string, tlsCfg *mitm.Config) (*Service, error) {
 	service := &Service{
 		tlsCfg: tlsCfg,
 		server: server,
+		logger: defaultLogger{},
 	}
 	return service, nil
 }
@@ -29,9 +32,31 @@ type Client interface {
 
 // Service is the proxy server
 type Service struct {
-	tlsCfg *mitm.Config
-	server *TCPServer
-	client Client
+	tlsCfg      *mitm.Config
+	server      *TCPServer
+	client      Client
+	middlewares []Middleware
+	hooks       hooks
+	passthrough *Passthrough
+	socks       bool
+	socksAuth   func(username, password string) bool
+	originalDst func(conn net.Conn) (string, error)
+	auth        Authenticator
+	upstream    *Upstream
+	pac         bool
+	options     ServiceOptions
+	metrics     *Metrics
+	admin       *http.Server
+	logger      Logger
+	accessLog   *AccessLog
+	tracer      *Tracer
+
+	mu       sync.Mutex
+	chain    Client
+	sessions map[*Session]bool
+	shutdown bool
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
 // Listen proxy server start accept connection
@@ -41,26 +66,144 @@ func (s *Service) Listen() error {
 	}
 
 	defer s.Close()
-	return s.server.Serve(s.OnAcceptHandler)
+	err := s.server.Serve(s.OnAcceptHandler)
+	if s.shuttingDown() {
+		return ErrServiceClosed
+	}
+	return err
 }
 
 // SetClient as name
 func (s *Service) SetClient(client Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.client = client
+	s.chain = nil
+}
+
+// Use appends middlewares to the client chain
+// Middlewares are called in the order they are added, the first one is the outermost
+func (s *Service) Use(middlewares ...Middleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.middlewares = append(s.middlewares, middlewares...)
+	s.chain = nil
+}
+
+// AddHook registers a hook for every phase it implements
+// The hook must implement at least one of ConnectHook, RequestHook, ResponseHook, ErrorHook and WebSocketHook
+// Hooks of the same phase are called in the order they are added
+func (s *Service) AddHook(hook interface{}) {
+	if !s.hooks.add(hook) {
+		panic("hook must implement at least one hook interface")
+	}
+}
+
+// SetPassthrough sets the hosts which are tunnelled without MITM
+func (s *Service) SetPassthrough(passthrough *Passthrough) {
+	s.passthrough = passthrough
+}
+
+// EnableSOCKS accepts SOCKS4, SOCKS4a and SOCKS5 clients on the same port
+// The protocol is detected by the first byte of the connection
+func (s *Service) EnableSOCKS(enable bool) {
+	s.socks = enable
+}
+
+// SetSOCKSAuth requires SOCKS5 clients to authenticate with username and password
+// SOCKS4 clients are rejected since they can't send password
+// If it is not set, the Authenticator is used when it implements PasswordVerifier
+func (s *Service) SetSOCKSAuth(auth func(username, password string) bool) {
+	s.socksAuth = auth
+}
+
+// socksVerify returns the function to authenticate SOCKS clients, nil means no authentication is required
+func (s *Service) socksVerify() func(username, password string) bool {
+	if s.socksAuth != nil {
+		return s.socksAuth
+	}
+	if s.auth == nil {
+		return nil
+	}
+	if verifier, ok := s.auth.(PasswordVerifier); ok {
+		return verifier.Verify
+	}
+	return func(username, password string) bool {
+		return false
+	}
+}
+
+// SetAuthenticator requires the clients to authenticate before using the proxy
+// The requests without valid credentials are replied with 407 Proxy Authentication Required
+func (s *Service) SetAuthenticator(auth Authenticator) {
+	s.auth = auth
+}
+
+// EnableTransparent accepts the connections redirected by iptables REDIRECT
+// The original destination is recovered by SO_ORIGINAL_DST, so it only works on linux
+func (s *Service) EnableTransparent(enable bool) {
+	s.originalDst = nil
+	if enable {
+		s.originalDst = OriginalDst
+	}
+}
+
+// SetUpstream routes the tunnels through the parent proxies
+// The intercepted requests are sent by the client, use Upstream.Transport for it to follow the same rules
+func (s *Service) SetUpstream(upstream *Upstream) {
+	s.upstream = upstream
+}
+
+// EnablePAC serves a generated PAC file at PACPath on the proxy port
+// Clients configured with http://<proxy address>/proxy.pac use the proxy for all hosts except the passthrough ones
+func (s *Service) EnablePAC(enable bool) {
+	s.pac = enable
+}
+
+// dial connects to the destination of the tunnels
+func (s *Service) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if s.options.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.options.DialTimeout)
+		defer cancel()
+	}
+	if s.upstream != nil {
+		return s.upstream.DialContext(ctx, network, address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+// handler returns the client wrapped by all middlewares
+// The chain is built once and rebuilt only after SetClient or Use
+func (s *Service) handler() Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chain == nil {
+		s.chain = Chain(s.client, s.middlewares...)
+	}
+	return s.chain
 }
 
 // OnAcceptHandler each connection is handled by this method
 func (s *Service) OnAcceptHandler(conn net.Conn) {
-	session := &Session{service: s, conn: conn}
+	session := &Session{service: s, conn: s.metrics.countConn(conn)}
 	defer session.Close()
+	if !s.trackSession(session) {
+		return
+	}
+	defer s.untrackSession(session)
+	s.metrics.sessionOpened()
+	defer s.metrics.sessionClosed()
 
-	err := session.handleLoop()
+	err := session.serve()
 	if err != nil {
-		log.Printf("handle session: %s", err.Error())
+		session.log(session.context(), slog.LevelWarn, "handle session failed", slog.Any("error", err))
 	}
 }
 
 // Close proxy server
 func (s *Service) Close() (err error) {
+	s.closeAdmin()
 	return s.server.Close()
 }
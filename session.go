@@ -5,13 +5,17 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 )
 
@@ -21,48 +25,284 @@ type Session struct {
 	reader  *bufio.Reader
 	writer  *bufio.Writer
 	conn    net.Conn
+	tlsConn *tls.Conn
 	secure  bool
+	// dst is the original destination of the transparent proxied connection
+	dst string
+	// user is the identity authenticated by the Authenticator or SOCKS
+	user string
+	// authenticated is set when the tunnel is authenticated, so the requests inside are trusted
+	authenticated bool
+	// handshake is the time spent on the TLS handshake with the client
+	handshake time.Duration
+	// tunnel is set once the connection carries a tunnel, so the requests are for the destination
+	tunnel bool
+	// serverName is the SNI sent by the client
+	serverName string
+	// handshakeStart is when the TLS handshake starts, it's recorded in the span of the first request
+	handshakeStart  time.Time
+	handshakeTraced sync.Once
+
+	id     uint64
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func (s *Session) handleLoop() (err error) {
+// serve detects the front-end protocol of the connection and handles it
+func (s *Session) serve() error {
 	s.reader = bufio.NewReader(s.conn)
 	s.writer = bufio.NewWriter(s.conn)
+	s.context()
+
+	if s.service.originalDst != nil {
+		dst, err := s.service.originalDst(unwrapConn(s.conn))
+		// connections to the proxy address are not redirected
+		if err == nil && dst != s.conn.LocalAddr().String() {
+			s.dst = dst
+			return s.handleTransparent()
+		}
+	}
+	if !s.service.socks {
+		return s.handleLoop()
+	}
+
+	b, err := s.reader.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	var r *http.Request
+	switch b[0] {
+	case socks4Version:
+		r, err = s.handleSOCKS4()
+	case socks5Version:
+		r, err = s.handleSOCKS5()
+	default:
+		return s.handleLoop()
+	}
+	if err != nil || r == nil {
+		return err
+	}
+	if closed, err := s.handleConnect(r); closed || err != nil {
+		return err
+	}
+	return s.handleLoop()
+}
+
+// handleTransparent handles the redirected connection as if the client sent a CONNECT request to the original destination
+func (s *Session) handleTransparent() error {
+	b, err := s.reader.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	// the connections are redirected by the firewall and can't send credentials
+	s.authenticated = true
+
+	host := s.dst
+	if b[0] == 22 {
+		if name := s.peekServerName(); name != "" {
+			s.serverName = name
+			_, port, _ := net.SplitHostPort(s.dst)
+			host = net.JoinHostPort(name, port)
+		}
+	}
+
+	r := s.connectRequest(host)
+	if w := s.service.hooks.onConnect(r); w != nil {
+		return w.Body.Close()
+	}
+	if closed, err := s.handleConnect(r); closed || err != nil {
+		return err
+	}
+	return s.handleLoop()
+}
+
+func (s *Session) handleLoop() (err error) {
+	if s.reader == nil {
+		s.reader = bufio.NewReader(s.conn)
+		s.writer = bufio.NewWriter(s.conn)
+	}
+	s.context()
 
-	for {
-		r, err := http.ReadRequest(s.reader)
+	// watching is closed when the background read of the last request is done
+	var watching <-chan struct{}
+	for first := true; ; first = false {
+		if !s.service.setSessionIdle(s, true) {
+			return nil
+		}
+		r, err := s.readRequest(first, watching)
+		s.service.setSessionIdle(s, false)
 		if err != nil {
 			if err == io.EOF {
 				return nil
 			}
 			return err
 		}
+		if r == nil {
+			return nil
+		}
 		r.RemoteAddr = s.conn.RemoteAddr().String()
+		if s.isPACRequest(r) {
+			if err = s.writeResponse(s.servePAC(r)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !s.authenticate(r) {
+			if closed, err := s.rejectUnauthenticated(r); closed || err != nil {
+				return err
+			}
+			continue
+		}
 		r.RequestURI = ""
 
 		switch r.Method {
 		case "CONNECT":
+			if w := s.service.hooks.onConnect(r); w != nil {
+				start := time.Now()
+				if err = s.writeResponse(w); err != nil {
+					return err
+				}
+				s.logAccess(r, w.StatusCode, w.Header, w.ContentLength, start)
+				continue
+			}
 			if _, err = fmt.Fprintf(s.conn, "%s 200 Connection established\r\n\r\n", r.Proto); err != nil {
 				return err
 			}
-			if err = s.handleTLS(r); err != nil {
+			if closed, err := s.handleConnect(r); closed || err != nil {
 				return err
 			}
 		default:
 			start := time.Now()
 
+			ctx, cancel := context.WithCancel(s.ctx)
+			r = r.WithContext(ctx)
+			r, span := s.startSpan(r, start)
+			watching = s.watchClientClose(r, cancel)
+
 			w := s.handleHTTP(r)
-			if err = w.Write(s.writer); err != nil {
-				return err
+			if w.StatusCode == http.StatusSwitchingProtocols {
+				defer cancel()
+				s.finishSpan(r, span, w.StatusCode)
+				return s.handleUpgrade(r, w, start)
 			}
-			if err = s.writer.Flush(); err != nil {
-				return err
-			}
-			if err = w.Body.Close(); err != nil {
+			body := s.countBody(w)
+			write := traceWrite(span)
+			err = s.writeResponse(w)
+			finishChild(write, err)
+			s.finishSpan(r, span, w.StatusCode)
+			cancel()
+			if err != nil {
 				return err
 			}
 
-			log.Printf("%s %s %db %d %s", r.RemoteAddr, r.URL.String(), w.ContentLength, w.StatusCode, time.Since(start))
+			s.logAccess(r, w.StatusCode, w.Header, sentBytes(body, w), start)
+			s.service.metrics.observeRequest(r.URL.Hostname(), w.StatusCode, time.Since(start))
+			s.logRequest(r.Context(), r.Method, r.URL.String(), w.StatusCode, sentBytes(body, w), time.Since(start))
+		}
+	}
+}
+
+// maxDiscardBody is the max size of request body discarded to keep the connection alive
+const maxDiscardBody = 256 << 10
+
+// authenticate checks the credentials of the request if the Authenticator is set
+func (s *Session) authenticate(r *http.Request) bool {
+	if s.service.auth == nil || s.authenticated {
+		return true
+	}
+	user, ok := s.service.auth.Authenticate(r)
+	if !ok {
+		return false
+	}
+	s.user = user
+	if r.Method == "CONNECT" {
+		s.authenticated = true
+	}
+	return true
+}
+
+// rejectUnauthenticated replies 407 with the challenges of the Authenticator
+func (s *Session) rejectUnauthenticated(r *http.Request) (closed bool, err error) {
+	w := HTTPError(http.StatusProxyAuthRequired, http.StatusText(http.StatusProxyAuthRequired), r)
+	for _, challenge := range s.service.auth.Challenge(r) {
+		w.Header.Add("Proxy-Authenticate", challenge)
+	}
+
+	// the body must be read before reading next request
+	n, err := io.CopyN(ioutil.Discard, r.Body, maxDiscardBody+1)
+	if n > maxDiscardBody || (err != nil && err != io.EOF) {
+		w.Close = true
+	}
+	start := time.Now()
+	if err = s.writeResponse(w); err != nil {
+		return true, err
+	}
+	s.logAccess(r, w.StatusCode, w.Header, w.ContentLength, start)
+	return w.Close, nil
+}
+
+func (s *Session) writeResponse(w *http.Response) (err error) {
+	defer s.writeTimeout()()
+	if err = w.Write(s.writer); err != nil {
+		return err
+	}
+	if err = s.writer.Flush(); err != nil {
+		return err
+	}
+	return w.Body.Close()
+}
+
+// connectRequest creates a CONNECT request to the destination for the protocols without CONNECT
+func (s *Session) connectRequest(host string) *http.Request {
+	return &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: host},
+		Host:       host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		RemoteAddr: s.conn.RemoteAddr().String(),
+	}
+}
+
+// handleConnect handles the stream after the tunnel is established
+// It returns closed if the stream is consumed and the session should not read requests any more
+func (s *Session) handleConnect(r *http.Request) (closed bool, err error) {
+	// the SOCKS and transparent sessions are still idle since no HTTP request is read
+	s.service.setSessionIdle(s, false)
+	s.tunnel = true
+	s.service.metrics.connectRequest()
+	if s.service.passthrough.Match(r.Host) {
+		return true, s.handleTunnel(r)
+	}
+
+	protocol, err := s.sniff()
+	if err != nil {
+		return true, err
+	}
+	switch protocol {
+	case protocolTLS:
+		if err = s.handleTLS(r); err != nil {
+			return true, err
 		}
+		if s.tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			return true, s.serveHTTP2()
+		}
+		return false, nil
+	case protocolHTTP:
+		// plaintext http requests are read by the loop
+		return false, nil
+	default:
+		return true, s.handleTunnel(r)
 	}
 }
 
@@ -83,10 +323,26 @@ func (s *Session) handleTLS(r *http.Request) error {
 	}
 
 	tlsconn := tls.Server(&peekedConn{s.conn, io.MultiReader(bytes.NewReader(b), bytes.NewReader(buf), s.conn)}, s.service.tlsCfg.TLSForHost(r.Host))
-	if err := tlsconn.Handshake(); err != nil {
+	start := time.Now()
+	if timeout := s.service.options.TLSHandshakeTimeout; timeout > 0 {
+		s.conn.SetDeadline(deadline(timeout))
+		defer s.conn.SetDeadline(time.Time{})
+	}
+	err := tlsconn.Handshake()
+	s.service.metrics.handshake(err)
+	if err != nil {
+		if s.service.tlsCfg != nil {
+			s.service.tlsCfg.HandshakeErrorCallback(r, err)
+		}
+		s.service.passthrough.handshakeFailed(r.Host)
 		return err
 	}
+	s.service.passthrough.handshakeSucceeded(r.Host)
+	s.handshakeStart = start
+	s.handshake = time.Since(start)
+	s.serverName = tlsconn.ConnectionState().ServerName
 	s.secure = true
+	s.tlsConn = tlsconn
 	s.reader.Reset(tlsconn)
 	s.writer.Reset(tlsconn)
 	return nil
@@ -95,6 +351,7 @@ func (s *Session) handleTLS(r *http.Request) error {
 func (s *Session) handleHTTP(r *http.Request) *http.Response {
 	var err error
 
+	r = s.withSessionContext(r)
 	r.URL.Scheme = "http"
 	if s.secure {
 		r.URL.Scheme = "https"
@@ -115,28 +372,127 @@ func (s *Session) handleHTTP(r *http.Request) *http.Response {
 		r.Header.Set("Content-Encoding", "identity")
 	}
 
+	upgrade := ""
+	if isUpgrade(r.Header) {
+		upgrade = r.Header.Get("Upgrade")
+	}
+	// the declared trailers are kept in r.Trailer and sent by the Client after the body
 	for key := range r.Header {
 		switch key {
-		case "Connection", "Prxoy-Authenticate", "Proxy-Connection", "Trailer", "Transfer-Encoding", "Upgrade":
+		case "Connection", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Trailer", "Transfer-Encoding", "Upgrade":
 			r.Header.Del(key)
 		}
 	}
+	if upgrade != "" {
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", upgrade)
+		// extensions like permessage-deflate make the frames opaque to the hooks
+		if isWebSocket(r.Header) && len(s.service.hooks.websocket) > 0 {
+			r.Header.Del("Sec-WebSocket-Extensions")
+		}
+	}
 
-	res, err := s.service.client.Do(r)
-	if err != nil {
-		return HTTPError(http.StatusInternalServerError, err.Error(), r)
+	r, res := s.service.hooks.onRequest(r)
+	if res == nil {
+		upstream := s.traceUpstream(r)
+		res, err = s.doUpstream(r)
+		if err == nil {
+			upstream.SetAttribute("http.response.status_code", res.StatusCode)
+		}
+		finishChild(upstream, err)
+		if err != nil {
+			s.log(r.Context(), slog.LevelWarn, "upstream error", slog.String("method", r.Method), slog.String("url", r.URL.String()), slog.Any("error", err))
+			res = s.service.hooks.onError(r, err)
+		}
 	}
+	res = s.service.hooks.onResponse(res)
 	if res.ContentLength == -1 {
 		res.TransferEncoding = []string{"chunked"}
 	}
 	return res
 }
 
+// handleUpgrade relays the 101 response and then splices the raw streams
+// The request is logged once the upgrade is accepted, the relayed bytes are logged when the streams are closed
+func (s *Session) handleUpgrade(r *http.Request, w *http.Response, start time.Time) error {
+	upstream, ok := w.Body.(io.ReadWriteCloser)
+	if !ok {
+		w.Body.Close()
+		return s.writeResponse(HTTPError(http.StatusBadGateway, "upstream connection is not upgradable", r))
+	}
+	defer upstream.Close()
+
+	if _, err := fmt.Fprintf(s.writer, "HTTP/1.1 %s\r\n", w.Status); err != nil {
+		return err
+	}
+	if err := w.Header.Write(s.writer); err != nil {
+		return err
+	}
+	if _, err := s.writer.WriteString("\r\n"); err != nil {
+		return err
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	s.logAccess(r, w.StatusCode, w.Header, 0, start)
+	s.service.metrics.observeRequest(r.URL.Hostname(), w.StatusCode, time.Since(start))
+	s.logRequest(r.Context(), r.Method, r.URL.String(), w.StatusCode, 0, time.Since(start))
+
+	relayStart := time.Now()
+	client := &sessionStream{reader: s.reader, Conn: s.transport()}
+
+	var sent, received int64
+	var err error
+	if isWebSocket(w.Header) && len(s.service.hooks.websocket) > 0 {
+		sent, received, err = relay(client, upstream, s.frameCopier(r, true), s.frameCopier(r, false))
+	} else {
+		sent, received, err = splice(client, upstream)
+	}
+	s.log(r.Context(), slog.LevelInfo, "upgrade",
+		slog.String("url", r.URL.String()),
+		slog.String("protocol", w.Header.Get("Upgrade")),
+		slog.Int64("sent", sent),
+		slog.Int64("received", received),
+		slog.Duration("duration", time.Since(relayStart)),
+	)
+	return err
+}
+
+// transport returns the connection that the http messages are transferred on
+func (s *Session) transport() net.Conn {
+	if s.tlsConn != nil {
+		return s.tlsConn
+	}
+	return s.conn
+}
+
 // Close connection
 func (s *Session) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
 	return s.conn.Close()
 }
 
+// watchClientClose cancels the request when the client closes the connection while the request is handled
+// Only the requests without body are watched, otherwise reading the body detects the close
+// The returned channel is closed when the background read is done
+func (s *Session) watchClientClose(r *http.Request, cancel context.CancelFunc) <-chan struct{} {
+	done := make(chan struct{})
+	if r.Body != http.NoBody || isUpgrade(r.Header) {
+		close(done)
+		return done
+	}
+	go func() {
+		defer close(done)
+		// data means the next pipelined request, it's left in the buffer
+		if _, err := s.reader.Peek(1); err != nil {
+			cancel()
+		}
+	}()
+	return done
+}
+
 type peekedConn struct {
 	net.Conn
 	r io.Reader
@@ -0,0 +1,107 @@
+package betproxy
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrServiceClosed is returned by Listen after Shutdown
+var ErrServiceClosed = errors.New("betproxy: service closed")
+
+// shutdownPollInterval is the interval to check whether the active sessions are finished
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown stops accepting connections, closes the idle sessions and waits for the active ones to finish
+// The sessions still active when the context is done are closed, their count is returned with the context error
+func (s *Service) Shutdown(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	s.shutdown = true
+	for session, idle := range s.sessions {
+		if idle {
+			session.conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	err := s.server.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		active := len(s.sessions)
+		s.mu.Unlock()
+		if active == 0 {
+			s.server.Wait()
+			s.cancelContext()
+			return 0, err
+		}
+
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			aborted := len(s.sessions)
+			for session := range s.sessions {
+				session.conn.Close()
+			}
+			s.mu.Unlock()
+			s.cancelContext()
+			return aborted, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// cancelContext cancels the requests of all sessions
+func (s *Service) cancelContext() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+func (s *Service) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+// trackSession registers the session, it returns false if the service is shutting down
+func (s *Service) trackSession(session *Session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[*Session]bool)
+	}
+	// a new session is idle until the first request is read
+	s.sessions[session] = true
+	return true
+}
+
+func (s *Service) untrackSession(session *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, session)
+}
+
+// setSessionIdle marks the session idle while it waits for the next request
+// It returns false if the session should be closed instead since the service is shutting down
+func (s *Service) setSessionIdle(session *Session, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sessions[session]; !ok {
+		return true
+	}
+	if idle && s.shutdown {
+		return false
+	}
+	s.sessions[session] = idle
+	return true
+}
@@ -0,0 +1,228 @@
+package betproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newShutdownService(t *testing.T, client Client) (*Service, chan error) {
+	service, err := NewService("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	service.SetClient(client)
+	done := make(chan error, 1)
+	go func() {
+		done <- service.Listen()
+	}()
+	return service, done
+}
+
+func dialService(t *testing.T, service *Service) net.Conn {
+	conn, err := net.Dial("tcp", service.server.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	return conn
+}
+
+func waitSessions(service *Service, count int) {
+	for i := 0; i < 100; i++ {
+		service.mu.Lock()
+		n := len(service.sessions)
+		service.mu.Unlock()
+		if n == count {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func Test_ServiceShutdownIdle(t *testing.T) {
+	service, done := newShutdownService(t, echoClient())
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "GET /get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	waitSessions(service, 1)
+
+	aborted, err := service.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	if aborted != 0 {
+		t.Errorf("aborted must be 0, but got %d", aborted)
+	}
+	if _, err = reader.ReadByte(); err == nil {
+		t.Error("idle session must be closed")
+	}
+	if err = <-done; err != ErrServiceClosed {
+		t.Errorf("Listen must return ErrServiceClosed, but got %v", err)
+	}
+}
+
+func Test_ServiceShutdownDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	service, _ := newShutdownService(t, ClientFunc(func(req *http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return HTTPText(http.StatusOK, nil, "finished", req), nil
+	}))
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /slow HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	<-started
+
+	result := make(chan int, 1)
+	go func() {
+		aborted, _ := service.Shutdown(context.Background())
+		result <- aborted
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := net.Dial("tcp", service.server.listener.Addr().String()); err == nil {
+		t.Error("new connections must be refused")
+	}
+	close(release)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode must be 200, but got %d", res.StatusCode)
+	}
+	if aborted := <-result; aborted != 0 {
+		t.Errorf("aborted must be 0, but got %d", aborted)
+	}
+}
+
+func Test_ServiceShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	service, _ := newShutdownService(t, ClientFunc(func(req *http.Request) (*http.Response, error) {
+		close(started)
+		<-req.Context().Done()
+		close(cancelled)
+		return nil, req.Context().Err()
+	}))
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /slow HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	aborted, err := service.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("err must be context.DeadlineExceeded, but got %v", err)
+	}
+	if aborted != 1 {
+		t.Errorf("aborted must be 1, but got %d", aborted)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("request context must be cancelled after the sessions are aborted")
+	}
+}
+
+func Test_ServiceShutdownIdleHTTP2(t *testing.T) {
+	service := newMITMService(t, echoClient())
+	service.tlsCfg.EnableHTTP2(true)
+	go service.Listen()
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	if _, err := http.ReadResponse(reader, nil); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	tlsConn := tls.Client(&peekedConn{conn, reader}, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	client := &http.Client{Transport: &http.Transport{
+		ForceAttemptHTTP2: true,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return tlsConn, nil
+		},
+	}}
+	res, err := client.Get("https://example.com/get")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Fatalf("res.ProtoMajor must be 2, but got %d", res.ProtoMajor)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	aborted, err := service.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	if aborted != 0 {
+		t.Errorf("aborted must be 0, but got %d", aborted)
+	}
+}
+
+func Test_ServiceShutdownDrainSOCKS(t *testing.T) {
+	listener := newTCPServer(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	service, err := NewService("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	service.SetClient(echoClient())
+	service.EnableSOCKS(true)
+	go service.Listen()
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	readExactly(t, conn, []byte{socks5Version, socks5AuthNone})
+	conn.Write(socks5Request("127.0.0.1", portNum))
+	readExactly(t, conn, []byte{socks5Version, socks5Succeeded, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	conn.Write([]byte("SSH-2.0-betproxy\r\n"))
+	readExactly(t, conn, []byte("SSH-2.0-betproxy\r\n"))
+
+	result := make(chan int, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	go func() {
+		aborted, _ := service.Shutdown(ctx)
+		result <- aborted
+	}()
+
+	// the tunnel is drained instead of being closed as idle
+	time.Sleep(50 * time.Millisecond)
+	conn.Write([]byte("ping"))
+	readExactly(t, conn, []byte("ping"))
+	if aborted := <-result; aborted != 1 {
+		t.Errorf("aborted must be 1, but got %d", aborted)
+	}
+}
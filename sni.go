@@ -0,0 +1,91 @@
+package betproxy
+
+import "encoding/binary"
+
+// peekServerName returns the SNI of the TLS ClientHello without consuming it
+// It returns empty string if the ClientHello does not fit in the buffer or has no SNI
+func (s *Session) peekServerName() string {
+	header, err := s.reader.Peek(5)
+	if err != nil || header[0] != 22 {
+		return ""
+	}
+	n := 5 + int(binary.BigEndian.Uint16(header[3:5]))
+	if n > s.reader.Size() {
+		n = s.reader.Size()
+	}
+	record, err := s.reader.Peek(n)
+	if err != nil {
+		return ""
+	}
+	return parseServerName(record[5:])
+}
+
+// parseServerName extracts the server_name extension from the ClientHello handshake message
+// https://tools.ietf.org/html/rfc8446#section-4.1.2
+// https://tools.ietf.org/html/rfc6066#section-3
+func parseServerName(hello []byte) string {
+	// handshake type, length, legacy version and random
+	if len(hello) < 38 || hello[0] != 1 {
+		return ""
+	}
+	b := hello[38:]
+
+	// session id, cipher suites and compression methods
+	for _, size := range []int{1, 2, 1} {
+		var length int
+		if b, length = readLength(b, size); length < 0 || len(b) < length {
+			return ""
+		}
+		b = b[length:]
+	}
+
+	b, length := readLength(b, 2)
+	if length < 0 || len(b) < length {
+		return ""
+	}
+	b = b[:length]
+	for len(b) >= 4 {
+		extType := binary.BigEndian.Uint16(b)
+		extLength := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if len(b) < extLength {
+			return ""
+		}
+		ext := b[:extLength]
+		b = b[extLength:]
+		if extType != 0 {
+			continue
+		}
+
+		ext, listLength := readLength(ext, 2)
+		if listLength < 0 || len(ext) < listLength {
+			return ""
+		}
+		ext = ext[:listLength]
+		for len(ext) >= 3 {
+			nameType := ext[0]
+			var nameLength int
+			ext, nameLength = readLength(ext[1:], 2)
+			if nameLength < 0 || len(ext) < nameLength {
+				return ""
+			}
+			if nameType == 0 {
+				return string(ext[:nameLength])
+			}
+			ext = ext[nameLength:]
+		}
+	}
+	return ""
+}
+
+// readLength reads a big endian length of size bytes, it returns -1 if b is too short
+func readLength(b []byte, size int) ([]byte, int) {
+	if len(b) < size {
+		return b, -1
+	}
+	length := 0
+	for _, c := range b[:size] {
+		length = length<<8 | int(c)
+	}
+	return b[size:], length
+}
@@ -0,0 +1,58 @@
+package betproxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+)
+
+// sniffTimeout is how long to wait for the client to speak first after the tunnel is established
+// Protocols like SMTP wait for the server greeting, so they are tunnelled after the timeout
+const sniffTimeout = time.Second
+
+const (
+	protocolUnknown = iota
+	protocolTLS
+	protocolHTTP
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "), []byte("HEAD "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "), []byte("CONNECT "),
+}
+
+// sniff peeks the first bytes sent by the client to detect the protocol in the tunnel
+func (s *Session) sniff() (int, error) {
+	s.conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer s.conn.SetReadDeadline(time.Time{})
+
+	b, err := s.reader.Peek(1)
+	if err != nil {
+		if isTimeout(err) {
+			return protocolUnknown, nil
+		}
+		return protocolUnknown, err
+	}
+	// 22 is the TLS handshake
+	// https://tools.ietf.org/html/rfc5246#section-6.2.1
+	if b[0] == 22 {
+		return protocolTLS, nil
+	}
+
+	b, err = s.reader.Peek(len("OPTIONS "))
+	if err != nil && !isTimeout(err) {
+		return protocolUnknown, err
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(b, method) {
+			return protocolHTTP, nil
+		}
+	}
+	return protocolUnknown, nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
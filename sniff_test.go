@@ -0,0 +1,116 @@
+package betproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func newTCPServer(t *testing.T, handler func(conn net.Conn)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func connectTunnel(t *testing.T, client net.Conn, host string) *bufio.Reader {
+	_, err := fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	reader := bufio.NewReader(client)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("res.StatusCode must be 200, but got %d", res.StatusCode)
+	}
+	return reader
+}
+
+func Test_SessionTunnelOpaque(t *testing.T) {
+	listener := newTCPServer(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	defer listener.Close()
+
+	conn := NewFakeConn()
+	session := &Session{service: &Service{client: echoClient()}, conn: conn.Server}
+	go session.handleLoop()
+
+	reader := connectTunnel(t, conn.Client, listener.Addr().String())
+
+	_, err := conn.Client.Write([]byte("SSH-2.0-betproxy\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if line != "SSH-2.0-betproxy\r\n" {
+		t.Errorf("echo line not match, got %q", line)
+	}
+}
+
+func Test_SessionTunnelServerFirst(t *testing.T) {
+	listener := newTCPServer(t, func(conn net.Conn) {
+		conn.Write([]byte("220 smtp ready\r\n"))
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer listener.Close()
+
+	// net.Pipe supports deadlines, so the sniffing times out
+	server, client := net.Pipe()
+	defer client.Close()
+	session := &Session{service: &Service{client: echoClient()}, conn: server}
+	go session.handleLoop()
+
+	reader := connectTunnel(t, client, listener.Addr().String())
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if line != "220 smtp ready\r\n" {
+		t.Errorf("greeting not match, got %q", line)
+	}
+}
+
+func Test_SessionTunnelHTTP(t *testing.T) {
+	conn := NewFakeConn()
+	session := &Session{service: &Service{client: echoClient()}, conn: conn.Server}
+	go session.handleLoop()
+
+	reader := connectTunnel(t, conn.Client, "example.com:80")
+
+	_, err := conn.Client.Write([]byte("GET /plain HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "http://example.com/plain" {
+		t.Errorf("body must be http://example.com/plain, but got %s", body)
+	}
+}
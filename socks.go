@@ -0,0 +1,218 @@
+package betproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// https://www.openssh.com/txt/socks4.protocol
+// https://www.openssh.com/txt/socks4a.protocol
+// https://tools.ietf.org/html/rfc1928
+// https://tools.ietf.org/html/rfc1929
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socks4Granted  = 0x5A
+	socks4Rejected = 0x5B
+
+	socksCmdConnect = 0x01
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xFF
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded           = 0x00
+	socks5NotAllowed          = 0x02
+	socks5CmdNotSupported     = 0x07
+	socks5AddrTypeUnsupported = 0x08
+)
+
+// handleSOCKS4 performs the SOCKS4 and SOCKS4a handshake
+// It returns a CONNECT request to the destination, or nil if the request is rejected
+func (s *Session) handleSOCKS4() (*http.Request, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(s.reader, header); err != nil {
+		return nil, err
+	}
+	// the user id is read but unused since SOCKS4 clients can't authenticate
+	if _, err := s.readNulString(); err != nil {
+		return nil, err
+	}
+
+	port := binary.BigEndian.Uint16(header[2:4])
+	host := net.IP(header[4:8]).String()
+	var err error
+	// SOCKS4a sends the domain after the user id with an invalid ip 0.0.0.x
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		if host, err = s.readNulString(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply := func(code byte) error {
+		_, err := s.conn.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	if header[1] != socksCmdConnect {
+		return nil, reply(socks4Rejected)
+	}
+	// SOCKS4 can't send password, so it's rejected whenever authentication is required
+	if s.service.socksVerify() != nil {
+		return nil, reply(socks4Rejected)
+	}
+	s.authenticated = true
+
+	r := s.connectRequest(net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if w := s.service.hooks.onConnect(r); w != nil {
+		w.Body.Close()
+		return nil, reply(socks4Rejected)
+	}
+	return r, reply(socks4Granted)
+}
+
+// handleSOCKS5 performs the SOCKS5 handshake
+// It returns a CONNECT request to the destination, or nil if the request is rejected
+func (s *Session) handleSOCKS5() (*http.Request, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(s.reader, header); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(s.reader, methods); err != nil {
+		return nil, err
+	}
+
+	method := byte(socks5AuthNoAccept)
+	want := byte(socks5AuthNone)
+	verify := s.service.socksVerify()
+	if verify != nil {
+		want = socks5AuthPassword
+	}
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	if _, err := s.conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+	switch method {
+	case socks5AuthNoAccept:
+		return nil, nil
+	case socks5AuthPassword:
+		ok, err := s.socks5Authenticate(verify)
+		if err != nil || !ok {
+			return nil, err
+		}
+	}
+	s.authenticated = true
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(s.reader, request); err != nil {
+		return nil, err
+	}
+	reply := func(code byte) error {
+		_, err := s.conn.Write([]byte{socks5Version, code, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(s.reader, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length, err := s.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		domain := make([]byte, length)
+		if _, err = io.ReadFull(s.reader, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		return nil, reply(socks5AddrTypeUnsupported)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(s.reader, port); err != nil {
+		return nil, err
+	}
+
+	if request[1] != socksCmdConnect {
+		return nil, reply(socks5CmdNotSupported)
+	}
+
+	r := s.connectRequest(net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if w := s.service.hooks.onConnect(r); w != nil {
+		w.Body.Close()
+		return nil, reply(socks5NotAllowed)
+	}
+	return r, reply(socks5Succeeded)
+}
+
+// socks5Authenticate performs the username/password authentication
+func (s *Session) socks5Authenticate(verify func(username, password string) bool) (bool, error) {
+	version, err := s.reader.ReadByte()
+	if err != nil {
+		return false, err
+	}
+	if version != 0x01 {
+		return false, fmt.Errorf("invalid socks5 auth version %d", version)
+	}
+	username, err := s.readLengthString()
+	if err != nil {
+		return false, err
+	}
+	password, err := s.readLengthString()
+	if err != nil {
+		return false, err
+	}
+
+	if !verify(username, password) {
+		_, err = s.conn.Write([]byte{0x01, 0x01})
+		return false, err
+	}
+	s.user = username
+	_, err = s.conn.Write([]byte{0x01, 0x00})
+	return err == nil, err
+}
+
+func (s *Session) readLengthString() (string, error) {
+	length, err := s.reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, length)
+	if _, err = io.ReadFull(s.reader, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (s *Session) readNulString() (string, error) {
+	b, err := s.reader.ReadSlice(0)
+	if err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", errors.New("invalid socks4 string")
+	}
+	return string(b[:len(b)-1]), nil
+}
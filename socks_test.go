@@ -0,0 +1,162 @@
+package betproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func newSOCKSSession(auth func(username, password string) bool) *FakeConn {
+	conn := NewFakeConn()
+	service := &Service{client: echoClient()}
+	service.EnableSOCKS(true)
+	service.SetSOCKSAuth(auth)
+	session := &Session{service: service, conn: conn.Server}
+	go session.serve()
+	return conn
+}
+
+func socks5Request(host string, port int) []byte {
+	b := []byte{socks5Version, socksCmdConnect, 0, socks5AddrDomain, byte(len(host))}
+	b = append(b, host...)
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func readExactly(t *testing.T, r io.Reader, want []byte) {
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("reply must be %v, but got %v", want, got)
+	}
+}
+
+func Test_SessionSOCKS5(t *testing.T) {
+	listener := newTCPServer(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	conn := newSOCKSSession(nil)
+	defer conn.Client.Close()
+
+	conn.Client.Write([]byte{socks5Version, 1, socks5AuthNone})
+	readExactly(t, conn.Client, []byte{socks5Version, socks5AuthNone})
+
+	conn.Client.Write(socks5Request("127.0.0.1", portNum))
+	readExactly(t, conn.Client, []byte{socks5Version, socks5Succeeded, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+
+	conn.Client.Write([]byte("SSH-2.0-betproxy\r\n"))
+	readExactly(t, conn.Client, []byte("SSH-2.0-betproxy\r\n"))
+}
+
+func Test_SessionSOCKS5Auth(t *testing.T) {
+	auth := func(username, password string) bool {
+		return username == "faceair" && password == "secret"
+	}
+
+	conn := newSOCKSSession(auth)
+	conn.Client.Write([]byte{socks5Version, 1, socks5AuthNone})
+	readExactly(t, conn.Client, []byte{socks5Version, socks5AuthNoAccept})
+	conn.Client.Close()
+
+	conn = newSOCKSSession(auth)
+	conn.Client.Write([]byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword})
+	readExactly(t, conn.Client, []byte{socks5Version, socks5AuthPassword})
+	conn.Client.Write([]byte("\x01\x07faceair\x05wrong"))
+	readExactly(t, conn.Client, []byte{0x01, 0x01})
+	conn.Client.Close()
+
+	conn = newSOCKSSession(auth)
+	defer conn.Client.Close()
+	conn.Client.Write([]byte{socks5Version, 1, socks5AuthPassword})
+	readExactly(t, conn.Client, []byte{socks5Version, socks5AuthPassword})
+	conn.Client.Write([]byte("\x01\x07faceair\x06secret"))
+	readExactly(t, conn.Client, []byte{0x01, 0x00})
+
+	conn.Client.Write(socks5Request("example.com", 80))
+	readExactly(t, conn.Client, []byte{socks5Version, socks5Succeeded, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+
+	conn.Client.Write([]byte("GET /socks5 HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "http://example.com/socks5" {
+		t.Errorf("body must be http://example.com/socks5, but got %s", body)
+	}
+}
+
+func Test_SessionSOCKS5Unsupported(t *testing.T) {
+	conn := newSOCKSSession(nil)
+	defer conn.Client.Close()
+
+	conn.Client.Write([]byte{socks5Version, 1, socks5AuthNone})
+	readExactly(t, conn.Client, []byte{socks5Version, socks5AuthNone})
+
+	// BIND command
+	conn.Client.Write([]byte{socks5Version, 0x02, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 80})
+	readExactly(t, conn.Client, []byte{socks5Version, socks5CmdNotSupported, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+}
+
+func Test_SessionSOCKS4a(t *testing.T) {
+	conn := newSOCKSSession(nil)
+	defer conn.Client.Close()
+
+	conn.Client.Write([]byte("\x04\x01\x00\x50\x00\x00\x00\x01faceair\x00example.com\x00"))
+	readExactly(t, conn.Client, []byte{0, socks4Granted, 0, 0, 0, 0, 0, 0})
+
+	conn.Client.Write([]byte("GET /socks4a HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "http://example.com/socks4a" {
+		t.Errorf("body must be http://example.com/socks4a, but got %s", body)
+	}
+}
+
+func Test_SessionSOCKS4Rejected(t *testing.T) {
+	conn := newSOCKSSession(func(username, password string) bool {
+		return false
+	})
+	defer conn.Client.Close()
+
+	conn.Client.Write([]byte("\x04\x01\x00\x50\x7f\x00\x00\x01faceair\x00"))
+	readExactly(t, conn.Client, []byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+
+	// the verify function accepting any password must not let SOCKS4 in
+	conn = newSOCKSSession(func(username, password string) bool {
+		return true
+	})
+	defer conn.Client.Close()
+
+	conn.Client.Write([]byte("\x04\x01\x00\x50\x7f\x00\x00\x01faceair\x00"))
+	readExactly(t, conn.Client, []byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+}
+
+func Test_SessionSOCKSDisabled(t *testing.T) {
+	conn := NewFakeConn()
+	session := &Session{service: &Service{client: echoClient()}, conn: conn.Server}
+	go session.serve()
+
+	conn.Client.Write([]byte("GET /http HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("res.StatusCode must be 200, but got %d", res.StatusCode)
+	}
+}
@@ -2,6 +2,7 @@ package betproxy
 
 import (
 	"net"
+	"sync"
 	"time"
 )
 
@@ -19,6 +20,7 @@ func NewTCPServer(address string) (*TCPServer, error) {
 // TCPServer as name
 type TCPServer struct {
 	listener net.Listener
+	wg       sync.WaitGroup
 }
 
 // Serve start accetp new connection and call onAcceptHandler
@@ -44,10 +46,19 @@ func (s *TCPServer) Serve(onAcceptHandler func(net.Conn)) error {
 		}
 		tempDelay = 0
 
-		go onAcceptHandler(conn)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			onAcceptHandler(conn)
+		}()
 	}
 }
 
+// Wait blocks until all the connection handlers return
+func (s *TCPServer) Wait() {
+	s.wg.Wait()
+}
+
 // Close server
 func (s *TCPServer) Close() (err error) {
 	return s.listener.Close()
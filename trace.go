@@ -0,0 +1,468 @@
+package betproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID is the W3C trace id
+type TraceID [16]byte
+
+// IsValid reports whether the id is not all zeros
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID is the W3C parent id
+type SpanID [8]byte
+
+// IsValid reports whether the id is not all zeros
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext identifies a span across the process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// ParseTraceparent parses the W3C traceparent header
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// the future versions may append fields, version 00 has exactly 4
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(make([]byte, 1), []byte(parts[0])); err != nil {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags := make([]byte, 1)
+	if _, err := hex.Decode(flags, []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	if !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// Traceparent formats the span context as the W3C traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// SpanKind is the role of the span in the trace
+type SpanKind int
+
+// The values are the same as OTLP
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// SpanStatus is the status code of the span
+type SpanStatus int
+
+// The values are the same as OTLP
+const (
+	SpanStatusUnset SpanStatus = 0
+	SpanStatusOK    SpanStatus = 1
+	SpanStatusError SpanStatus = 2
+)
+
+// Attribute is a key value pair of the span, the value is a string, bool, int64 or float64
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is a timed operation of a request
+// A nil *Span is valid and records nothing
+type Span struct {
+	Name          string
+	Kind          SpanKind
+	Context       SpanContext
+	Parent        SpanID
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	Status        SpanStatus
+	StatusMessage string
+
+	mu       sync.Mutex
+	tracer   *Tracer
+	root     *Span
+	children []*Span
+	ended    bool
+}
+
+// SetAttribute records the attribute, int values are stored as int64
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	switch v := value.(type) {
+	case int:
+		value = int64(v)
+	case string, bool, int64, float64:
+	default:
+		value = fmt.Sprint(v)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes = append(s.Attributes, Attribute{Key: key, Value: value})
+}
+
+// SetError marks the span failed with the error message
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Status = SpanStatusError
+	s.StatusMessage = err.Error()
+}
+
+// startChild starts a span in the same trace, it returns nil if the span id can't be generated
+func (s *Span) startChild(name string, kind SpanKind, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	id, err := newSpanID()
+	if err != nil {
+		return nil
+	}
+	child := &Span{
+		Name:    name,
+		Kind:    kind,
+		Context: SpanContext{TraceID: s.Context.TraceID, SpanID: id, Sampled: s.Context.Sampled},
+		Parent:  s.Context.SpanID,
+		Start:   start,
+		tracer:  s.tracer,
+		root:    s.root,
+	}
+	s.root.mu.Lock()
+	s.root.children = append(s.root.children, child)
+	s.root.mu.Unlock()
+	return child
+}
+
+// finish ends the span, the root span queues the whole trace of the request for the export
+func (s *Span) finish(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = end
+	s.mu.Unlock()
+
+	if s.root != s || !s.Context.Sampled || s.tracer.exporter == nil {
+		return
+	}
+	s.mu.Lock()
+	spans := append([]*Span{s}, s.children...)
+	s.mu.Unlock()
+	s.tracer.enqueue(spans)
+}
+
+// SpanExporter sends the finished spans to the collector
+// ExportSpans is called from the background goroutine of the Tracer, one batch at a time
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+}
+
+const (
+	// DefaultTraceQueueSize is the default max number of traces waiting for the export
+	DefaultTraceQueueSize = 2048
+	// DefaultTraceBatchSize is the default max number of spans exported at once
+	DefaultTraceBatchSize = 512
+)
+
+// NewTracer create a Tracer instance exporting the spans with the exporter
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{
+		exporter:  exporter,
+		queueSize: DefaultTraceQueueSize,
+		batchSize: DefaultTraceBatchSize,
+		stop:      make(chan struct{}),
+		exited:    make(chan struct{}),
+	}
+}
+
+// Tracer creates a span for every proxied request
+// The span has children for the TLS handshake, the upstream call and the response write
+// The finished traces are queued and exported in batches in the background, they are dropped when the queue is full
+// A nil *Tracer is valid and records nothing
+type Tracer struct {
+	exporter  SpanExporter
+	inject    bool
+	logger    *slog.Logger
+	queueSize int
+	batchSize int
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	queue     chan []*Span
+	stop      chan struct{}
+	stopCtx   context.Context
+	exited    chan struct{}
+	dropped   uint64
+}
+
+// EnableInject sets the traceparent header of the upstream requests to the upstream span
+// Otherwise the traceparent header of the client is forwarded as is
+func (t *Tracer) EnableInject(enable bool) {
+	t.inject = enable
+}
+
+// SetQueueSize sets the max number of traces waiting for the export, it must be called before the tracer is used
+func (t *Tracer) SetQueueSize(size int) {
+	t.queueSize = size
+}
+
+// SetBatchSize sets the max number of spans exported at once, it must be called before the tracer is used
+func (t *Tracer) SetBatchSize(size int) {
+	t.batchSize = size
+}
+
+// SetLogger sets the logger of the export errors, they are discarded by default
+func (t *Tracer) SetLogger(logger *slog.Logger) {
+	t.logger = logger
+}
+
+// Dropped returns the number of spans dropped since the queue was full or the tracer was shut down
+func (t *Tracer) Dropped() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Shutdown exports the queued traces and stops the background export
+// The traces finished after Shutdown are dropped
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.startOnce.Do(t.startExport)
+	t.stopOnce.Do(func() {
+		t.stopCtx = ctx
+		close(t.stop)
+	})
+	select {
+	case <-t.exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enqueue hands the trace to the background export without blocking
+func (t *Tracer) enqueue(spans []*Span) {
+	t.startOnce.Do(t.startExport)
+	select {
+	case <-t.stop:
+		atomic.AddUint64(&t.dropped, uint64(len(spans)))
+		return
+	default:
+	}
+	select {
+	case t.queue <- spans:
+	default:
+		atomic.AddUint64(&t.dropped, uint64(len(spans)))
+	}
+}
+
+func (t *Tracer) startExport() {
+	size := t.queueSize
+	if size < 1 {
+		size = 1
+	}
+	t.queue = make(chan []*Span, size)
+	go t.runExport()
+}
+
+// runExport exports the traces queued while the previous batch was being exported
+func (t *Tracer) runExport() {
+	defer close(t.exited)
+	for {
+		select {
+		case spans := <-t.queue:
+			t.export(context.Background(), t.collect(spans))
+		case <-t.stop:
+			for {
+				select {
+				case spans := <-t.queue:
+					t.export(t.stopCtx, t.collect(spans))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// collect appends the queued traces to the batch until it's full or the queue is empty
+func (t *Tracer) collect(batch []*Span) []*Span {
+	for len(batch) < t.batchSize {
+		select {
+		case spans := <-t.queue:
+			batch = append(batch, spans...)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (t *Tracer) export(ctx context.Context, spans []*Span) {
+	if err := t.exporter.ExportSpans(ctx, spans); err != nil && t.logger != nil {
+		t.logger.LogAttrs(ctx, slog.LevelWarn, "export spans failed", slog.Int("spans", len(spans)), slog.Any("error", err))
+	}
+}
+
+// SetTracer traces the requests handled by the service
+func (s *Service) SetTracer(tracer *Tracer) {
+	s.tracer = tracer
+}
+
+// start starts the root span of the request, the parent is taken from the traceparent header
+func (t *Tracer) start(r *http.Request, start time.Time) (*Span, error) {
+	if t == nil {
+		return nil, nil
+	}
+	id, err := newSpanID()
+	if err != nil {
+		return nil, err
+	}
+	span := &Span{
+		Name:    "HTTP " + r.Method,
+		Kind:    SpanKindServer,
+		Context: SpanContext{SpanID: id, Sampled: true},
+		Start:   start,
+		tracer:  t,
+	}
+	span.root = span
+	if parent, ok := ParseTraceparent(r.Header.Get("Traceparent")); ok {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.Parent = parent.SpanID
+	} else if _, err := rand.Read(span.Context.TraceID[:]); err != nil {
+		return nil, err
+	}
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("client.address", r.RemoteAddr)
+	return span, nil
+}
+
+func newSpanID() (SpanID, error) {
+	var id SpanID
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+// startSpan starts the span of the request and attaches it to the request context
+// The TLS handshake of the session is recorded as a child of the first request on the connection
+func (s *Session) startSpan(r *http.Request, start time.Time) (*http.Request, *Span) {
+	span, err := s.service.tracer.start(r, start)
+	if err != nil {
+		s.log(r.Context(), slog.LevelWarn, "start span failed", slog.Any("error", err))
+	}
+	if span == nil {
+		return r, nil
+	}
+	span.SetAttribute("betproxy.session_id", int64(s.id))
+	if s.secure {
+		s.handshakeTraced.Do(func() {
+			handshake := span.startChild("tls.handshake", SpanKindInternal, s.handshakeStart)
+			handshake.SetAttribute("tls.server_name", s.serverName)
+			handshake.finish(s.handshakeStart.Add(s.handshake))
+		})
+	}
+	return r.WithContext(context.WithValue(r.Context(), spanContextKey, span)), span
+}
+
+// finishSpan records the response status and ends the request span
+// The url is recorded at the end since handleHTTP completes it for the requests in the tunnels
+func (s *Session) finishSpan(r *http.Request, span *Span, status int) {
+	if span == nil {
+		return
+	}
+	span.SetAttribute("url.full", r.URL.String())
+	span.SetAttribute("http.response.status_code", status)
+	if status >= 500 {
+		span.mu.Lock()
+		span.Status = SpanStatusError
+		span.mu.Unlock()
+	}
+	span.finish(time.Now())
+}
+
+// traceWrite starts the child span of the response write
+func traceWrite(span *Span) *Span {
+	return span.startChild("response.write", SpanKindInternal, time.Now())
+}
+
+// finishChild records the error and ends the child span
+func finishChild(span *Span, err error) {
+	span.SetError(err)
+	span.finish(time.Now())
+}
+
+// traceUpstream starts the child span of the upstream call, and injects the traceparent if it's enabled
+func (s *Session) traceUpstream(r *http.Request) *Span {
+	parent, ok := SpanFromContext(r.Context())
+	if !ok {
+		return nil
+	}
+	span := parent.startChild("upstream", SpanKindClient, time.Now())
+	span.SetAttribute("server.address", r.URL.Host)
+	if s.service.tracer.inject {
+		r.Header.Set("Traceparent", span.Context.Traceparent())
+	}
+	return span
+}
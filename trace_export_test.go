@@ -0,0 +1,93 @@
+package betproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_InMemoryExporter(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	exporter.ExportSpans(context.Background(), []*Span{{Name: "a"}, {Name: "b"}})
+	if spans := exporter.Spans(); len(spans) != 2 || spans[1].Name != "b" {
+		t.Errorf("spans must be kept in order, but got %v", spans)
+	}
+	exporter.Reset()
+	if spans := exporter.Spans(); len(spans) != 0 {
+		t.Errorf("spans must be dropped, but got %d", len(spans))
+	}
+}
+
+func Test_OTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	root := &Span{
+		Name:    "HTTP GET",
+		Kind:    SpanKindServer,
+		Context: SpanContext{TraceID: TraceID{1}, SpanID: SpanID{2}, Sampled: true},
+		Start:   time.Unix(1, 0),
+		End:     time.Unix(2, 0),
+	}
+	root.SetAttribute("http.request.method", "GET")
+	root.SetAttribute("http.response.status_code", 200)
+	root.SetAttribute("tls", true)
+	child := &Span{Name: "upstream", Kind: SpanKindClient, Context: SpanContext{TraceID: TraceID{1}, SpanID: SpanID{3}}, Parent: SpanID{2}}
+	child.SetError(errors.New("connection refused"))
+
+	exporter := NewOTLPExporter(server.URL + "/v1/traces")
+	exporter.SetServiceName("proxy")
+	exporter.SetHeader("Authorization", "Bearer token")
+	if err := exporter.ExportSpans(context.Background(), []*Span{root, child}); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	if header.Get("Content-Type") != "application/json" || header.Get("Authorization") != "Bearer token" {
+		t.Errorf("headers must be set, but got %v", header)
+	}
+	data, _ := json.Marshal(body)
+	for _, expected := range []string{
+		`"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"proxy"}}]}`,
+		`"traceId":"01000000000000000000000000000000"`,
+		`"spanId":"0200000000000000"`,
+		`"parentSpanId":"0200000000000000"`,
+		`"kind":2`,
+		`"startTimeUnixNano":"1000000000"`,
+		`"endTimeUnixNano":"2000000000"`,
+		`{"key":"http.response.status_code","value":{"intValue":"200"}}`,
+		`{"key":"tls","value":{"boolValue":true}}`,
+		`"status":{"code":2,"message":"connection refused"}`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("request must contain %s, but got %s", expected, data)
+		}
+	}
+	if strings.Count(string(data), "parentSpanId") != 1 {
+		t.Errorf("root span must not have a parent, but got %s", data)
+	}
+}
+
+func Test_OTLPExporterFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	err := NewOTLPExporter(server.URL).ExportSpans(context.Background(), []*Span{{Name: "a"}})
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("err must contain the status, but got %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package betproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_TraceParseTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatalf("traceparent must be valid")
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Errorf("span context must be parsed, but got %+v", sc)
+	}
+	if sc.Traceparent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("traceparent must be formatted, but got %s", sc.Traceparent())
+	}
+
+	// the future versions may have more fields
+	if _, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); !ok {
+		t.Errorf("traceparent of the future version must be accepted")
+	}
+	for _, value := range []string{
+		"",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(value); ok {
+			t.Errorf("traceparent %q must be invalid", value)
+		}
+	}
+}
+
+func spanByName(spans []*Span, name string) *Span {
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func spanAttribute(span *Span, key string) interface{} {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return nil
+}
+
+func newTraceSession(client Client, inject bool) (*FakeConn, *InMemoryExporter) {
+	exporter := NewInMemoryExporter()
+	tracer := NewTracer(exporter)
+	tracer.EnableInject(inject)
+	conn, session := newHookSession(client)
+	session.service.SetTracer(tracer)
+	go session.handleLoop()
+	return conn, exporter
+}
+
+func waitSpans(exporter *InMemoryExporter, count int) []*Span {
+	for i := 0; i < 100; i++ {
+		if spans := exporter.Spans(); len(spans) >= count {
+			return spans
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return exporter.Spans()
+}
+
+func Test_TraceRequest(t *testing.T) {
+	var upstreamHeader string
+	conn, exporter := newTraceSession(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		upstreamHeader = req.Header.Get("Traceparent")
+		return HTTPText(http.StatusOK, nil, "ok", req), nil
+	}), true)
+
+	fmt.Fprint(conn.Client, "GET http://example.com/get HTTP/1.1\r\nHost: example.com\r\nTraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+
+	spans := waitSpans(exporter, 3)
+	if len(spans) != 3 {
+		t.Fatalf("spans must be 3, but got %d", len(spans))
+	}
+	root, upstream, write := spans[0], spanByName(spans, "upstream"), spanByName(spans, "response.write")
+	if root.Name != "HTTP GET" || root.Kind != SpanKindServer {
+		t.Errorf("root span must be the server span, but got %s", root.Name)
+	}
+	if root.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || root.Parent.String() != "00f067aa0ba902b7" {
+		t.Errorf("root span must continue the trace of the client, but got %s %s", root.Context.TraceID, root.Parent)
+	}
+	if spanAttribute(root, "url.full") != "http://example.com/get" || spanAttribute(root, "http.response.status_code") != int64(http.StatusOK) {
+		t.Errorf("root span must record the request, but got %v", root.Attributes)
+	}
+	if upstream == nil || write == nil {
+		t.Fatalf("upstream and write spans must be recorded")
+	}
+	for _, child := range []*Span{upstream, write} {
+		if child.Parent != root.Context.SpanID || child.Context.TraceID != root.Context.TraceID {
+			t.Errorf("span %s must be a child of the root span", child.Name)
+		}
+		if child.End.Before(child.Start) || child.Start.Before(root.Start) || child.End.After(root.End) {
+			t.Errorf("span %s must be within the root span", child.Name)
+		}
+	}
+	if upstream.Kind != SpanKindClient {
+		t.Errorf("upstream span must be a client span")
+	}
+	if upstreamHeader != upstream.Context.Traceparent() {
+		t.Errorf("traceparent must be injected as %s, but got %s", upstream.Context.Traceparent(), upstreamHeader)
+	}
+}
+
+func Test_TraceForwardTraceparent(t *testing.T) {
+	var upstreamHeader string
+	conn, exporter := newTraceSession(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		upstreamHeader = req.Header.Get("Traceparent")
+		return HTTPText(http.StatusOK, nil, "ok", req), nil
+	}), false)
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+	fmt.Fprintf(conn.Client, "GET http://example.com/get HTTP/1.1\r\nHost: example.com\r\nTraceparent: %s\r\n\r\n", traceparent)
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+
+	if upstreamHeader != traceparent {
+		t.Errorf("traceparent must be forwarded as is, but got %s", upstreamHeader)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if spans := exporter.Spans(); len(spans) != 0 {
+		t.Errorf("unsampled trace must not be exported, but got %d spans", len(spans))
+	}
+}
+
+func Test_TraceUpstreamError(t *testing.T) {
+	conn, exporter := newTraceSession(ClientFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}), false)
+
+	fmt.Fprint(conn.Client, "GET http://example.com/get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+
+	spans := waitSpans(exporter, 3)
+	if len(spans) != 3 {
+		t.Fatalf("spans must be 3, but got %d", len(spans))
+	}
+	if !spans[0].Context.TraceID.IsValid() || spans[0].Parent.IsValid() {
+		t.Errorf("root span must start a new trace")
+	}
+	if spans[0].Status != SpanStatusError {
+		t.Errorf("root span must be failed")
+	}
+	upstream := spanByName(spans, "upstream")
+	if upstream.Status != SpanStatusError || upstream.StatusMessage != "connection refused" {
+		t.Errorf("upstream span must record the error, but got %d %s", upstream.Status, upstream.StatusMessage)
+	}
+}
+
+func Test_TraceHandshake(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	service := newMITMService(t, echoClient())
+	defer service.Close()
+	service.SetTracer(NewTracer(exporter))
+	go service.Listen()
+
+	conn := dialService(t, service)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	if _, err := http.ReadResponse(reader, nil); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	tlsConn := tls.Client(&peekedConn{conn, reader}, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	tlsReader := bufio.NewReader(tlsConn)
+	for i := 0; i < 2; i++ {
+		fmt.Fprint(tlsConn, "GET /get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		res, err := http.ReadResponse(tlsReader, nil)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		ioutil.ReadAll(res.Body)
+	}
+
+	spans := waitSpans(exporter, 7)
+	if len(spans) != 7 {
+		t.Fatalf("spans must be 7, but got %d", len(spans))
+	}
+	handshake := spanByName(spans, "tls.handshake")
+	if handshake == nil || handshake.Parent != spans[0].Context.SpanID {
+		t.Fatalf("handshake must be a child of the first request")
+	}
+	if spanAttribute(handshake, "tls.server_name") != "example.com" {
+		t.Errorf("handshake must record the server name")
+	}
+	if !handshake.End.After(handshake.Start) || handshake.End.After(spans[0].Start) {
+		t.Errorf("handshake must end before the request, but got %s %s", handshake.Start, handshake.End)
+	}
+	if spanByName(spans[4:], "tls.handshake") != nil {
+		t.Errorf("handshake must be recorded once")
+	}
+	if spanAttribute(spans[0], "url.full") != "https://example.com/get" {
+		t.Errorf("url must be completed, but got %v", spanAttribute(spans[0], "url.full"))
+	}
+}
+
+type blockingExporter struct {
+	InMemoryExporter
+	release chan struct{}
+}
+
+func (e *blockingExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	<-e.release
+	return e.InMemoryExporter.ExportSpans(ctx, spans)
+}
+
+func Test_TraceExportQueue(t *testing.T) {
+	exporter := &blockingExporter{release: make(chan struct{})}
+	tracer := NewTracer(exporter)
+	tracer.SetQueueSize(1)
+	tracer.SetBatchSize(1)
+	conn, session := newHookSession(echoClient())
+	session.service.SetTracer(tracer)
+	go session.handleLoop()
+
+	// the responses are not blocked by the export
+	reader := bufio.NewReader(conn.Client)
+	for i := 0; i < 3; i++ {
+		fmt.Fprint(conn.Client, "GET http://example.com/get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		ioutil.ReadAll(res.Body)
+	}
+	for i := 0; i < 100 && tracer.Dropped() == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if tracer.Dropped() == 0 {
+		t.Fatalf("traces must be dropped when the queue is full")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := tracer.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("err must be context.DeadlineExceeded, but got %v", err)
+	}
+	close(exporter.release)
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if spans := exporter.Spans(); len(spans) < 3 {
+		t.Errorf("queued spans must be exported by Shutdown, but got %d", len(spans))
+	}
+
+	fmt.Fprint(conn.Client, "GET http://example.com/get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	ioutil.ReadAll(res.Body)
+	for i := 0; i < 100 && uint64(len(exporter.Spans()))+tracer.Dropped() < 12; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// one trace is being exported and one is queued at most, the others are dropped
+	if exported := len(exporter.Spans()); exported > 6 || uint64(exported)+tracer.Dropped() != 12 {
+		t.Errorf("spans must be exported or dropped, but got %d exported and %d dropped", exported, tracer.Dropped())
+	}
+}
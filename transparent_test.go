@@ -0,0 +1,144 @@
+package betproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/faceair/betproxy/mitm"
+)
+
+// newTransparentSession emulates a connection redirected from dst to the proxy
+func newTransparentSession(service *Service, dst string) *FakeConn {
+	service.originalDst = func(conn net.Conn) (string, error) {
+		return dst, nil
+	}
+	conn := NewFakeConn()
+	session := &Session{service: service, conn: conn.Server}
+	go session.serve()
+	return conn
+}
+
+func Test_SessionTransparentHTTP(t *testing.T) {
+	conn := newTransparentSession(&Service{client: echoClient()}, "93.184.216.34:80")
+	defer conn.Client.Close()
+
+	conn.Client.Write([]byte("GET /transparent HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "http://example.com/transparent" {
+		t.Errorf("body must be http://example.com/transparent, but got %s", body)
+	}
+}
+
+func Test_SessionTransparentNotRedirected(t *testing.T) {
+	conn := newTransparentSession(&Service{client: echoClient()}, "127.0.0.1:10086")
+	defer conn.Client.Close()
+
+	conn.Client.Write([]byte("GET http://example.com/proxy HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn.Client), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "http://example.com/proxy" {
+		t.Errorf("body must be http://example.com/proxy, but got %s", body)
+	}
+}
+
+func Test_SessionTransparentTLS(t *testing.T) {
+	cacert, cakey, err := mitm.NewAuthority("betproxy", "faceair", 10*365*24*time.Hour)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	tlsCfg, err := mitm.NewConfig(cacert, cakey)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	conn := newTransparentSession(&Service{client: echoClient(), tlsCfg: tlsCfg}, "93.184.216.34:443")
+	defer conn.Client.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cacert)
+	tlsConn := tls.Client(conn.Client, &tls.Config{ServerName: "example.com", RootCAs: roots})
+	if err = tlsConn.Handshake(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	tlsConn.Write([]byte("GET /secure HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "https://example.com/secure" {
+		t.Errorf("body must be https://example.com/secure, but got %s", body)
+	}
+}
+
+func Test_SessionTransparentPassthrough(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer server.Close()
+
+	// passthrough is matched by SNI, the tunnel is connected to the original destination
+	passthrough, err := NewPassthrough("example.com")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	service := &Service{client: echoClient()}
+	service.SetPassthrough(passthrough)
+	conn := newTransparentSession(service, server.Listener.Addr().String())
+	defer conn.Client.Close()
+
+	tlsCfg := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsCfg.ServerName = "example.com"
+	tlsConn := tls.Client(conn.Client, tlsCfg)
+	if err = tlsConn.Handshake(); err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+
+	tlsConn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "origin" {
+		t.Errorf("body must be origin, but got %s", body)
+	}
+}
+
+func Test_ParseServerName(t *testing.T) {
+	server, client := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: "sni.example.com"}).Handshake()
+
+	reader := bufio.NewReaderSize(server, 16<<10)
+	session := &Session{reader: reader}
+	if name := session.peekServerName(); name != "sni.example.com" {
+		t.Errorf("server name must be sni.example.com, but got %q", name)
+	}
+	server.Close()
+
+	if name := parseServerName([]byte{1, 0, 0}); name != "" {
+		t.Errorf("server name must be empty, but got %q", name)
+	}
+}
+
+func Test_OriginalDst(t *testing.T) {
+	conn := NewFakeConn()
+	if _, err := OriginalDst(conn.Server); err == nil {
+		t.Error("must error, but got nil")
+	}
+}
@@ -0,0 +1,109 @@
+package betproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleTunnel connects to the destination of the CONNECT request and splices the raw bytes
+func (s *Session) handleTunnel(r *http.Request) error {
+	start := time.Now()
+
+	address := withDefaultPort(r.Host, "443")
+	if s.dst != "" {
+		address = s.dst
+	}
+	upstream, err := s.service.dial(s.context(), "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+
+	client := &sessionStream{reader: s.reader, Conn: s.conn}
+	sent, received, err := splice(client, upstream)
+	s.logAccess(r, http.StatusOK, nil, received, start)
+	s.log(s.context(), slog.LevelInfo, "tunnel",
+		slog.String("host", r.Host),
+		slog.Int64("sent", sent),
+		slog.Int64("received", received),
+		slog.Duration("duration", time.Since(start)),
+	)
+	return err
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// copyFunc copies from src to dst until either EOF is reached on src or an error occurs
+type copyFunc func(dst io.Writer, src io.Reader) (int64, error)
+
+// splice copies bytes in both directions until both sides are done
+// It returns the bytes sent to upstream and the bytes received from upstream
+func splice(client, upstream io.ReadWriteCloser) (sent, received int64, err error) {
+	return relay(client, upstream, io.Copy, io.Copy)
+}
+
+// relay is like splice but uses the giving copy functions for each direction
+func relay(client, upstream io.ReadWriteCloser, up, down copyFunc) (sent, received int64, err error) {
+	errc := make(chan error, 2)
+	go func() {
+		var err error
+		sent, err = up(upstream, client)
+		closeWrite(upstream)
+		errc <- err
+	}()
+	go func() {
+		var err error
+		received, err = down(client, upstream)
+		closeWrite(client)
+		errc <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		if e := <-errc; err == nil && !isClosedErr(e) {
+			err = e
+		}
+	}
+	return sent, received, err
+}
+
+// closeWrite shuts down the writing side of the connection if it supports, otherwise close it
+func closeWrite(c io.Closer) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err == nil {
+			return
+		}
+	}
+	c.Close()
+}
+
+func isClosedErr(err error) bool {
+	return err == nil || err == io.EOF || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// sessionStream reads the buffered data of the session before reading from the connection
+type sessionStream struct {
+	reader *bufio.Reader
+	net.Conn
+}
+
+func (s *sessionStream) Read(buf []byte) (int, error) {
+	return s.reader.Read(buf)
+}
+
+func (s *sessionStream) CloseWrite() error {
+	if cw, ok := s.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return s.Conn.Close()
+}
@@ -0,0 +1,130 @@
+package betproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newParentProxy(t *testing.T) (net.Listener, net.Listener) {
+	echo := newTCPServer(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	parent := &Service{client: echoClient()}
+	parent.EnableSOCKS(true)
+	parent.SetAuthenticator(NewBasicAuth("betproxy", verifyFaceair))
+	return echo, newTCPServer(t, parent.OnAcceptHandler)
+}
+
+func Test_UpstreamProxySelection(t *testing.T) {
+	upstream := NewUpstream()
+	if err := upstream.AddRule("*.internal", "direct"); err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	if err := upstream.AddRule("*.example.com", "socks5://127.0.0.1:1080"); err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	if err := upstream.AddRule("*", "ftp://127.0.0.1"); err == nil {
+		t.Error("unsupported scheme must be rejected")
+	}
+	upstream.SetSelector(ProxySelectorFunc(func(req *http.Request) (*url.URL, error) {
+		return url.Parse("http://10.0.0.1:3128")
+	}))
+
+	cases := map[string]string{
+		"http://db.internal/":         "",
+		"https://www.example.com:443": "socks5://127.0.0.1:1080",
+		"http://other.com/":           "http://10.0.0.1:3128",
+	}
+	for target, expect := range cases {
+		req, _ := http.NewRequest("GET", target, nil)
+		proxy, err := upstream.Proxy(req)
+		if err != nil {
+			t.Errorf("err must be nil, but got %s", err.Error())
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != expect {
+			t.Errorf("proxy of %s must be %q, but got %q", target, expect, got)
+		}
+	}
+}
+
+func Test_UpstreamDial(t *testing.T) {
+	echo, parent := newParentProxy(t)
+	defer echo.Close()
+	defer parent.Close()
+
+	for _, scheme := range []string{"http", "socks5"} {
+		upstream := NewUpstream()
+		upstream.AddRule("*", fmt.Sprintf("%s://faceair:secret@%s", scheme, parent.Addr().String()))
+
+		conn, err := upstream.DialContext(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: err must be nil, but got %s", scheme, err.Error())
+		}
+		fmt.Fprint(conn, "ping\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Errorf("err must be nil, but got %s", err.Error())
+		}
+		if line != "ping\n" {
+			t.Errorf("%s: line must be ping, but got %q", scheme, line)
+		}
+		conn.Close()
+	}
+}
+
+func Test_UpstreamDialRejected(t *testing.T) {
+	echo, parent := newParentProxy(t)
+	defer echo.Close()
+	defer parent.Close()
+
+	for _, scheme := range []string{"http", "socks5"} {
+		upstream := NewUpstream()
+		upstream.AddRule("*", fmt.Sprintf("%s://faceair:wrong@%s", scheme, parent.Addr().String()))
+
+		_, err := upstream.DialContext(context.Background(), "tcp", echo.Addr().String())
+		if err == nil {
+			t.Errorf("%s: err must not be nil", scheme)
+		}
+	}
+}
+
+func Test_ServiceTunnelThroughUpstream(t *testing.T) {
+	echo, parent := newParentProxy(t)
+	defer echo.Close()
+	defer parent.Close()
+
+	upstream := NewUpstream()
+	upstream.AddRule("*", "socks5://faceair:secret@"+parent.Addr().String())
+	service := &Service{client: echoClient()}
+	service.SetUpstream(upstream)
+	passthrough, err := NewPassthrough("127.0.0.1")
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	service.SetPassthrough(passthrough)
+
+	conn := NewFakeConn()
+	session := &Session{service: service, conn: conn.Server}
+	go session.serve()
+
+	reader := connectTunnel(t, conn.Client, echo.Addr().String())
+	fmt.Fprint(conn.Client, "hello\n")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	if strings.TrimSpace(line) != "hello" {
+		t.Errorf("line must be hello, but got %q", line)
+	}
+}
@@ -0,0 +1,191 @@
+package betproxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// WebSocket opcodes
+// https://tools.ietf.org/html/rfc6455#section-5.2
+const (
+	WebSocketContinuation = 0x0
+	WebSocketText         = 0x1
+	WebSocketBinary       = 0x2
+	WebSocketClose        = 0x8
+	WebSocketPing         = 0x9
+	WebSocketPong         = 0xA
+)
+
+// maxWebSocketPayload limits the size of a single frame read by the proxy
+const maxWebSocketPayload = 32 << 20
+
+// WebSocketFrame is a single WebSocket frame with unmasked payload
+type WebSocketFrame struct {
+	Fin     bool
+	RSV     byte
+	Opcode  byte
+	Payload []byte
+}
+
+// WebSocketHook is called with every frame of the WebSocket connections
+// fromClient reports whether the frame is sent by the client, the returned frame is forwarded instead of the original one
+// Returning nil drops the frame
+type WebSocketHook interface {
+	OnFrame(r *http.Request, frame *WebSocketFrame, fromClient bool) *WebSocketFrame
+}
+
+// WebSocketHookFunc is an adapter to allow the use of ordinary functions as WebSocketHook
+type WebSocketHookFunc func(r *http.Request, frame *WebSocketFrame, fromClient bool) *WebSocketFrame
+
+// OnFrame calls f(r, frame, fromClient)
+func (f WebSocketHookFunc) OnFrame(r *http.Request, frame *WebSocketFrame, fromClient bool) *WebSocketFrame {
+	return f(r, frame, fromClient)
+}
+
+func (h *hooks) onFrame(r *http.Request, frame *WebSocketFrame, fromClient bool) *WebSocketFrame {
+	for _, hook := range h.websocket {
+		if frame = hook.OnFrame(r, frame, fromClient); frame == nil {
+			return nil
+		}
+	}
+	return frame
+}
+
+// isUpgrade reports whether the request asks to switch protocol
+func isUpgrade(h http.Header) bool {
+	return headerContainsToken(h, "Connection", "upgrade") && h.Get("Upgrade") != ""
+}
+
+func isWebSocket(h http.Header) bool {
+	return strings.EqualFold(h.Get("Upgrade"), "websocket")
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h[name] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readWebSocketFrame reads a frame from r and unmask the payload
+func readWebSocketFrame(r io.Reader) (*WebSocketFrame, error) {
+	header := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	frame := &WebSocketFrame{
+		Fin:    header[0]&0x80 != 0,
+		RSV:    header[0] & 0x70 >> 4,
+		Opcode: header[0] & 0x0F,
+	}
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(b)
+	}
+	if length > maxWebSocketPayload {
+		return nil, errors.New("websocket frame too large")
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	frame.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskBytes(key, frame.Payload)
+	}
+	return frame, nil
+}
+
+// writeWebSocketFrame writes the frame to w, the payload is masked with a random key if mask is true
+// It returns the number of bytes written
+func writeWebSocketFrame(w io.Writer, frame *WebSocketFrame, mask bool) (int64, error) {
+	header := make([]byte, 2, 14)
+	header[0] = frame.Opcode&0x0F | (frame.RSV&0x07)<<4
+	if frame.Fin {
+		header[0] |= 0x80
+	}
+
+	length := len(frame.Payload)
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	payload := frame.Payload
+	if mask {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return 0, err
+		}
+		header[1] |= 0x80
+		header = append(header, key[:]...)
+		payload = append([]byte(nil), payload...)
+		maskBytes(key, payload)
+	}
+
+	n, err := w.Write(append(header, payload...))
+	return int64(n), err
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+// frameCopier returns a copyFunc which passes every frame through the WebSocket hooks
+func (s *Session) frameCopier(r *http.Request, fromClient bool) copyFunc {
+	return func(dst io.Writer, src io.Reader) (written int64, err error) {
+		for {
+			frame, err := readWebSocketFrame(src)
+			if err != nil {
+				return written, err
+			}
+			if frame = s.service.hooks.onFrame(r, frame, fromClient); frame == nil {
+				continue
+			}
+			// frames sent from client to server must be masked
+			n, err := writeWebSocketFrame(dst, frame, fromClient)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package betproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newWebSocketEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgrade(r.Header) || !isWebSocket(r.Header) {
+			http.Error(w, "not websocket", http.StatusBadRequest)
+			return
+		}
+		h := sha1.New()
+		h.Write([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\nX-Extensions: %s\r\n\r\n", accept, r.Header.Get("Sec-WebSocket-Extensions"))
+		rw.Flush()
+
+		for {
+			frame, err := readWebSocketFrame(rw)
+			if err != nil {
+				return
+			}
+			if _, err = writeWebSocketFrame(conn, frame, false); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func dialWebSocket(t *testing.T, session *Session, host string) (*FakeConn, *bufio.Reader, *http.Response) {
+	conn := NewFakeConn()
+	session.conn = conn.Server
+
+	go session.handleLoop()
+
+	_, err := fmt.Fprintf(conn.Client, "GET /ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Extensions: permessage-deflate\r\n\r\n", host)
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+
+	reader := bufio.NewReader(conn.Client)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("res.StatusCode must be 101, but got %d", res.StatusCode)
+	}
+	return conn, reader, res
+}
+
+func Test_SessionWebSocket(t *testing.T) {
+	server := newWebSocketEchoServer()
+	defer server.Close()
+
+	session := &Session{service: &Service{client: &http.Client{}}}
+	conn, reader, res := dialWebSocket(t, session, strings.TrimPrefix(server.URL, "http://"))
+	defer conn.Client.Close()
+
+	if res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept not match, got %s", res.Header.Get("Sec-WebSocket-Accept"))
+	}
+	if res.Header.Get("X-Extensions") != "permessage-deflate" {
+		t.Error("extensions must be forwarded without websocket hooks")
+	}
+
+	_, err := writeWebSocketFrame(conn.Client, &WebSocketFrame{Fin: true, Opcode: WebSocketText, Payload: []byte("hello")}, true)
+	if err != nil {
+		t.Errorf("err must be nil, but got %s", err.Error())
+	}
+	frame, err := readWebSocketFrame(reader)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if !frame.Fin || frame.Opcode != WebSocketText || string(frame.Payload) != "hello" {
+		t.Errorf("echo frame not match, got %+v", frame)
+	}
+}
+
+func Test_SessionWebSocketHook(t *testing.T) {
+	server := newWebSocketEchoServer()
+	defer server.Close()
+
+	service := &Service{client: &http.Client{}}
+	service.AddHook(WebSocketHookFunc(func(r *http.Request, frame *WebSocketFrame, fromClient bool) *WebSocketFrame {
+		if string(frame.Payload) == "drop" {
+			return nil
+		}
+		if fromClient {
+			frame.Payload = bytes.ToUpper(frame.Payload)
+		} else {
+			frame.Payload = append(frame.Payload, '!')
+		}
+		return frame
+	}))
+	session := &Session{service: service}
+	conn, reader, res := dialWebSocket(t, session, strings.TrimPrefix(server.URL, "http://"))
+	defer conn.Client.Close()
+
+	if res.Header.Get("X-Extensions") != "" {
+		t.Error("extensions must be removed with websocket hooks")
+	}
+
+	for _, payload := range []string{"drop", "hello"} {
+		_, err := writeWebSocketFrame(conn.Client, &WebSocketFrame{Fin: true, Opcode: WebSocketText, Payload: []byte(payload)}, true)
+		if err != nil {
+			t.Errorf("err must be nil, but got %s", err.Error())
+		}
+	}
+	frame, err := readWebSocketFrame(reader)
+	if err != nil {
+		t.Fatalf("err must be nil, but got %s", err.Error())
+	}
+	if string(frame.Payload) != "HELLO!" {
+		t.Errorf("payload must be HELLO!, but got %s", frame.Payload)
+	}
+}
+
+func Test_WebSocketFrameLength(t *testing.T) {
+	for _, length := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		buf := &bytes.Buffer{}
+		payload := bytes.Repeat([]byte{'a'}, length)
+		_, err := writeWebSocketFrame(buf, &WebSocketFrame{Fin: true, Opcode: WebSocketBinary, Payload: payload}, length%2 == 0)
+		if err != nil {
+			t.Errorf("err must be nil, but got %s", err.Error())
+		}
+		frame, err := readWebSocketFrame(buf)
+		if err != nil {
+			t.Fatalf("err must be nil, but got %s", err.Error())
+		}
+		if !bytes.Equal(frame.Payload, payload) {
+			t.Errorf("payload of length %d not equal", length)
+		}
+	}
+}
+
+func Test_SessionWebSocketLogged(t *testing.T) {
+	server := newWebSocketEchoServer()
+	defer server.Close()
+
+	buf := &syncBuffer{}
+	metrics := NewMetrics()
+	service := &Service{client: &http.Client{}}
+	service.SetAccessLog(NewAccessLog(buf, AccessLogCommon))
+	service.SetMetrics(metrics)
+	session := &Session{service: service}
+	conn, _, _ := dialWebSocket(t, session, strings.TrimPrefix(server.URL, "http://"))
+	defer conn.Client.Close()
+
+	for i := 0; i < 100 && buf.String() == ""; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if line := buf.String(); !strings.Contains(line, `/ws HTTP/1.1" 101 -`) {
+		t.Errorf("upgrade must be logged, but got %s", line)
+	}
+	out := &bytes.Buffer{}
+	metrics.WriteTo(out)
+	if !strings.Contains(out.String(), `betproxy_requests_total{host="127.0.0.1",status="101"} 1`) {
+		t.Errorf("upgrade must be counted, but got\n%s", out.String())
+	}
+}